@@ -0,0 +1,281 @@
+package wmv2
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type boundRequestKey struct{}
+
+// apiRoute 路由选项
+type apiRoute struct {
+	token       bool
+	auth        bool
+	apis        []string
+	rateBy      string
+	rateLimit   int
+	rateWindow  time.Duration
+	request     interface{}
+	idempotent  bool
+	idemMust    bool
+	audited     bool
+	audit       string
+	doc         *RouteDoc
+	middlewares []gin.HandlerFunc
+}
+
+// APIOption 路由选项，可用于API和APIGroup的路由方法
+type APIOption func(*apiRoute)
+
+// WithToken 要求有效的User-Token
+func WithToken() APIOption {
+	return func(r *apiRoute) {
+		r.token = true
+	}
+}
+
+// WithAuth 要求User-Token，并且用户为管理员或拥有指定的接口权限（enable_api）
+// apis: 接口权限名称，为空时使用路由路径
+func WithAuth(apis ...string) APIOption {
+	return func(r *apiRoute) {
+		r.token = true
+		r.auth = true
+		r.apis = apis
+	}
+}
+
+// WithRateLimit 对路由单独限流，参数与RateLimit相同
+func WithRateLimit(by string, limit int, window time.Duration) APIOption {
+	return func(r *apiRoute) {
+		r.rateBy = by
+		r.rateLimit = limit
+		r.rateWindow = window
+	}
+}
+
+// WithRequest 按req的类型绑定并校验参数，校验失败时返回参数错误，成功时通过BoundRequest获取
+// req: 请求参数结构体实例，同时用于生成文档
+func WithRequest(req interface{}) APIOption {
+	return func(r *apiRoute) {
+		r.request = req
+	}
+}
+
+// WithDoc 设置路由文档信息
+func WithDoc(doc *RouteDoc) APIOption {
+	return func(r *apiRoute) {
+		r.doc = doc
+	}
+}
+
+// WithMiddleware 添加其他中间件，在框架中间件之后执行
+func WithMiddleware(h ...gin.HandlerFunc) APIOption {
+	return func(r *apiRoute) {
+		r.middlewares = append(r.middlewares, h...)
+	}
+}
+
+// BoundRequest 返回WithRequest绑定的参数，类型为req类型的指针
+func BoundRequest(c *gin.Context) interface{} {
+	return c.Request.Context().Value(boundRequestKey{})
+}
+
+// APIGroup 版本化的路由组，路由为/<服务名>/v<版本>/...
+type APIGroup struct {
+	fw      *WMFrameWorkV2
+	group   *gin.RouterGroup
+	version int
+	opts    []APIOption
+	locker  sync.RWMutex
+	docs    []*RouteDoc
+	// 弃用信息
+	deprecated bool
+	sunset     time.Time
+	link       string
+}
+
+// API 在NewHTTPEngine创建的引擎上添加版本化的路由组，需在NewHTTPEngine之后调用，如在OptionHTTP.EngineFunc中
+// version: 版本号，路由前缀为/<服务名>/v<version>
+// opts: 组内所有路由的默认选项，路由方法的选项追加在其后
+// sample：
+//
+//	v1 := fw.API(1, wmv2.WithToken())
+//	v1.GET("/user/:id", getUser, wmv2.WithAuth("user_view"), wmv2.WithRequest(userReq{}))
+//	v1.Deprecate(time.Date(2027, 1, 1, 0, 0, 0, 0, time.Local), "/"+fw.ServerName()+"/v2")
+func (fw *WMFrameWorkV2) API(version int, opts ...APIOption) *APIGroup {
+	if fw.httpEngine == nil {
+		panic("wmv2: fw.API must be called after fw.NewHTTPEngine, e.g. in OptionHTTP.EngineFunc")
+	}
+	g := &APIGroup{
+		fw:      fw,
+		version: version,
+		opts:    opts,
+		docs:    make([]*RouteDoc, 0),
+	}
+	if sunset, ok := fw.apiSunset[fmt.Sprintf("v%d", version)]; ok {
+		g.Deprecate(sunset, "")
+	}
+	g.group = fw.httpEngine.Group(fmt.Sprintf("/%s/v%d", fw.serverName, version), g.deprecation)
+	return g
+}
+
+// Deprecate 弃用此版本，返回Deprecation，Sunset头，文档中标记为已弃用
+// sunset: 停用时间，为零值时不返回Sunset头
+// link: 替代版本的地址，为空时不返回Link头
+func (g *APIGroup) Deprecate(sunset time.Time, link string) {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+	g.deprecated = true
+	g.sunset = sunset
+	g.link = link
+	for _, v := range g.docs {
+		v.Deprecated = true
+	}
+}
+
+func (g *APIGroup) deprecation(c *gin.Context) {
+	g.locker.RLock()
+	defer g.locker.RUnlock()
+	if !g.deprecated {
+		return
+	}
+	c.Header("Deprecation", "true")
+	if !g.sunset.IsZero() {
+		c.Header("Sunset", g.sunset.UTC().Format(http.TimeFormat))
+	}
+	if g.link != "" {
+		c.Header("Link", "<"+g.link+`>; rel="successor-version"`)
+	}
+}
+
+// Handle 添加路由
+func (g *APIGroup) Handle(method, path string, h gin.HandlerFunc, opts ...APIOption) {
+	r := &apiRoute{}
+	for _, o := range append(g.opts, opts...) {
+		o(r)
+	}
+	full := strings.TrimSuffix(g.group.BasePath(), "/") + "/" + strings.TrimPrefix(path, "/")
+	hs := make([]gin.HandlerFunc, 0, 5+len(r.middlewares))
+	if r.rateLimit > 0 {
+		hs = append(hs, g.fw.RateLimit(method+" "+full, r.rateBy, r.rateLimit, r.rateWindow))
+	}
+	if r.token {
+		hs = append(hs, g.fw.PrepareToken(true))
+	}
+	if r.auth {
+		apis := r.apis
+		if len(apis) == 0 {
+			apis = []string{full}
+		}
+		hs = append(hs, g.fw.Authorize(apis...))
+	}
+	if r.audited {
+		hs = append(hs, g.fw.AuditLog(r.audit))
+	}
+	if r.idempotent {
+		hs = append(hs, g.fw.Idempotency(r.idemMust))
+	}
+	if r.request != nil {
+		hs = append(hs, g.fw.bindRequest(r.request))
+	}
+	hs = append(hs, r.middlewares...)
+	hs = append(hs, h)
+	g.group.Handle(method, path, hs...)
+	// 文档
+	if r.doc == nil && r.request == nil && !r.token {
+		return
+	}
+	doc := &RouteDoc{}
+	if r.doc != nil {
+		*doc = *r.doc
+	}
+	if doc.Request == nil {
+		doc.Request = r.request
+	}
+	if len(doc.Tags) == 0 {
+		doc.Tags = []string{fmt.Sprintf("v%d", g.version)}
+	}
+	doc.Token = doc.Token || r.token
+	g.locker.Lock()
+	doc.Deprecated = doc.Deprecated || g.deprecated
+	g.docs = append(g.docs, doc)
+	g.locker.Unlock()
+	g.fw.DocRoute(method, full, doc)
+}
+
+// GET 添加GET路由
+func (g *APIGroup) GET(path string, h gin.HandlerFunc, opts ...APIOption) {
+	g.Handle(http.MethodGet, path, h, opts...)
+}
+
+// POST 添加POST路由
+func (g *APIGroup) POST(path string, h gin.HandlerFunc, opts ...APIOption) {
+	g.Handle(http.MethodPost, path, h, opts...)
+}
+
+// PUT 添加PUT路由
+func (g *APIGroup) PUT(path string, h gin.HandlerFunc, opts ...APIOption) {
+	g.Handle(http.MethodPut, path, h, opts...)
+}
+
+// DELETE 添加DELETE路由
+func (g *APIGroup) DELETE(path string, h gin.HandlerFunc, opts ...APIOption) {
+	g.Handle(http.MethodDelete, path, h, opts...)
+}
+
+// Authorize 要求用户为管理员或拥有指定的接口权限之一，需在PrepareToken之后使用
+func (fw *WMFrameWorkV2) Authorize(apis ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Param("_userTokenName") == "" {
+			fw.Fail(c, ErrUnauthorized, nil)
+			return
+		}
+		// 管理员不检查接口权限，客户端证书身份需在http_mtls_admin_identities中
+		if c.Param("_userAsAdmin") == "1" {
+			return
+		}
+		enable := strings.Split(c.Param("_enableAPI"), ",")
+		for _, v := range apis {
+			if containsString(enable, v) {
+				return
+			}
+		}
+		fw.Fail(c, ErrForbidden, nil)
+	}
+}
+
+// bindRequest 按req的类型绑定参数
+func (fw *WMFrameWorkV2) bindRequest(req interface{}) gin.HandlerFunc {
+	t := reflect.TypeOf(req)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return func(c *gin.Context) {
+		v := reflect.New(t).Interface()
+		if !fw.Bind(c, v) {
+			return
+		}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), boundRequestKey{}, v))
+	}
+}
+
+// loadAPIConfig 读取接口版本弃用配置，格式为v1=2027-01-01
+func (fw *WMFrameWorkV2) loadAPIConfig() {
+	fw.apiSunset = make(map[string]time.Time)
+	for _, v := range splitConfigList(fw.wmConf.GetItemDefault("api_deprecated", "", "已弃用的接口版本和停用日期，格式为v1=2027-01-01，用`,`分割多个，日期可留空，使用fw.API添加的路由返回Deprecation和Sunset头")) {
+		kv := strings.SplitN(v, "=", 2)
+		var t time.Time
+		if len(kv) == 2 {
+			t, _ = time.ParseInLocation("2006-01-02", strings.TrimSpace(kv[1]), time.Local)
+		}
+		fw.apiSunset[strings.ToLower(strings.TrimSpace(kv[0]))] = t
+	}
+	fw.wmConf.Save()
+}
@@ -0,0 +1,73 @@
+package wmv2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xyzj/gopsu"
+)
+
+func TestLoadAPIConfig(t *testing.T) {
+	conf, err := gopsu.LoadConfig(filepath.Join(t.TempDir(), "test.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.SetItem("api_deprecated", "v1=2027-01-01, V2 ,v3=bad", "")
+	fw := &WMFrameWorkV2{wmConf: conf}
+	fw.loadAPIConfig()
+	if len(fw.apiSunset) != 3 {
+		t.Fatalf("got %v", fw.apiSunset)
+	}
+	if want := time.Date(2027, 1, 1, 0, 0, 0, 0, time.Local); !fw.apiSunset["v1"].Equal(want) {
+		t.Fatalf("v1 sunset %v", fw.apiSunset["v1"])
+	}
+	// 未指定或格式错误的日期只弃用，不返回Sunset
+	if t2, ok := fw.apiSunset["v2"]; !ok || !t2.IsZero() {
+		t.Fatalf("v2 %v %v", t2, ok)
+	}
+	if !fw.apiSunset["v3"].IsZero() {
+		t.Fatalf("v3 sunset %v", fw.apiSunset["v3"])
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fw := &WMFrameWorkV2{}
+	cases := []struct {
+		params gin.Params
+		want   int
+	}{
+		{gin.Params{}, http.StatusUnauthorized},
+		{gin.Params{{Key: "_userTokenName", Value: "u"}, {Key: "_enableAPI", Value: "a,b"}}, http.StatusOK},
+		{gin.Params{{Key: "_userTokenName", Value: "u"}, {Key: "_enableAPI", Value: "ab"}}, http.StatusForbidden},
+		{gin.Params{{Key: "_userTokenName", Value: "u"}, {Key: "_userAsAdmin", Value: "1"}}, http.StatusOK},
+		// 客户端证书身份不是管理员时同样检查接口权限
+		{gin.Params{{Key: "_userTokenName", Value: "svc"}, {Key: "_clientIdentity", Value: "svc"}}, http.StatusForbidden},
+	}
+	for i, v := range cases {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request, _ = http.NewRequest("GET", "/", nil)
+		c.Params = v.params
+		fw.Authorize("b")(c)
+		if !c.IsAborted() {
+			c.Status(http.StatusOK)
+		}
+		if w.Code != v.want {
+			t.Errorf("case %d: got %d, want %d", i, w.Code, v.want)
+		}
+	}
+}
+
+func TestAPIWithoutEngine(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("API should panic without NewHTTPEngine")
+		}
+	}()
+	(&WMFrameWorkV2{}).API(1)
+}
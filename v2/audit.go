@@ -0,0 +1,566 @@
+package wmv2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/xyzj/gopsu"
+)
+
+// 审计日志输出
+const (
+	// AuditSinkSQL 写入数据库，自动建表，支持查询
+	AuditSinkSQL = "sql"
+	// AuditSinkMQ 发布到mq
+	AuditSinkMQ = "mq"
+	// AuditSinkFile 写入jsonl文件，支持查询
+	AuditSinkFile = "file"
+)
+
+// AuditRecord 审计记录
+type AuditRecord struct {
+	// 时间，unix秒
+	Time int64 `json:"time"`
+	// 用户名，来自User-Token或客户端证书身份
+	User string `json:"user"`
+	// 操作
+	Action string `json:"action"`
+	// 操作对象
+	Target string `json:"target"`
+	// 路由，method path
+	Route string `json:"route"`
+	// 请求参数，已脱敏
+	Params string `json:"params"`
+	// http状态码
+	Status int `json:"status"`
+	// 结果，ok/fail
+	Result string `json:"result"`
+	// 来源ip
+	From string `json:"from"`
+	// 请求id
+	RequestID string `json:"request_id"`
+	// 详细说明
+	Detail string `json:"detail"`
+}
+
+// 审计配置
+type auditConfigure struct {
+	forshow string
+	// 是否启用
+	enable bool
+	// 输出方式
+	sinks []string
+	// 数据表名称
+	table string
+	// mq过滤器
+	mqKey string
+	// 文件路径
+	file string
+	// 单个文件最大字节数，超过后重命名为<文件名>.<时间>
+	fileMaxSize int64
+	// 重命名后的文件保留天数
+	fileKeepDays int
+	// 记录的请求参数最大字节数
+	maxParams int
+	// 需要脱敏的参数名，小写
+	redact []string
+	// 待写入的记录
+	chanRecord chan *AuditRecord
+	startOnce  sync.Once
+	// 数据表是否已创建，1-已创建
+	tableReady int32
+}
+
+func (conf *auditConfigure) show() string {
+	conf.forshow, _ = sjson.Set("", "enable", conf.enable)
+	conf.forshow, _ = sjson.Set(conf.forshow, "sinks", conf.sinks)
+	conf.forshow, _ = sjson.Set(conf.forshow, "table", conf.table)
+	conf.forshow, _ = sjson.Set(conf.forshow, "mq_key", conf.mqKey)
+	conf.forshow, _ = sjson.Set(conf.forshow, "file", conf.file)
+	conf.forshow, _ = sjson.Set(conf.forshow, "file_maxsize", conf.fileMaxSize)
+	conf.forshow, _ = sjson.Set(conf.forshow, "file_keep_days", conf.fileKeepDays)
+	conf.forshow, _ = sjson.Set(conf.forshow, "max_params", conf.maxParams)
+	conf.forshow, _ = sjson.Set(conf.forshow, "redact", conf.redact)
+	return conf.forshow
+}
+
+func (conf *auditConfigure) has(sink string) bool {
+	return containsString(conf.sinks, sink)
+}
+
+func (fw *WMFrameWorkV2) loadAuditConfig() {
+	fw.auditCtl.enable, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("audit_enable", "false", "是否启用审计日志"))
+	fw.auditCtl.sinks = splitConfigList(strings.ToLower(fw.wmConf.GetItemDefault("audit_sink", AuditSinkFile, "审计日志输出方式，sql-写入数据库，mq-发布到mq，file-写入文件，用`,`分割多个")))
+	fw.auditCtl.table = fw.wmConf.GetItemDefault("audit_table", "audit_log", "审计日志数据表名称，不存在时自动创建")
+	fw.auditCtl.mqKey = fw.wmConf.GetItemDefault("audit_mq_key", "audit."+fw.serverName, "审计日志发布到mq时使用的过滤器")
+	fw.auditCtl.file = fw.wmConf.GetItemDefault("audit_file", "", "审计日志文件路径，留空时使用日志目录下的<服务名>.audit.jsonl")
+	fw.auditCtl.fileMaxSize = int64(gopsu.String2Int(fw.wmConf.GetItemDefault("audit_file_maxsize", "100", "审计日志文件最大MB，超过后重命名为<文件名>.<时间>并创建新文件"), 10)) * 1024 * 1024
+	fw.auditCtl.fileKeepDays = gopsu.String2Int(fw.wmConf.GetItemDefault("audit_file_keep_days", "180", "重命名后的审计日志文件保留天数"), 10)
+	fw.auditCtl.maxParams = gopsu.String2Int(fw.wmConf.GetItemDefault("audit_max_params", "4096", "审计日志记录的请求参数最大字节数，超过的请求体不解析，参数截断"), 10)
+	fw.auditCtl.redact = splitConfigList(strings.ToLower(fw.wmConf.GetItemDefault("audit_redact", "pwd,passwd,password,token,secret,=key,apikey,api_key,private_key", "审计日志中需要脱敏的参数名，用`,`分割多个，不区分大小写，部分匹配，以=开头时完全匹配")))
+	fw.wmConf.Save()
+	if fw.auditCtl.fileMaxSize <= 0 {
+		fw.auditCtl.fileMaxSize = 100 * 1024 * 1024
+	}
+	if fw.auditCtl.fileKeepDays <= 0 {
+		fw.auditCtl.fileKeepDays = 180
+	}
+	if fw.auditCtl.maxParams <= 0 {
+		fw.auditCtl.maxParams = 4096
+	}
+	if fw.auditCtl.file == "" {
+		fw.auditCtl.file = filepath.Join(gopsu.DefaultLogDir, fw.serverName+".audit.jsonl")
+	}
+	fw.auditCtl.show()
+	if !fw.auditCtl.enable {
+		return
+	}
+	fw.auditCtl.startOnce.Do(func() {
+		fw.auditCtl.chanRecord = make(chan *AuditRecord, 1000)
+		go fw.auditWriter()
+	})
+}
+
+// auditRoutes 添加审计日志查询路由
+func (fw *WMFrameWorkV2) auditRoutes(r *gin.Engine) {
+	fw.loadAuditConfig()
+	if !fw.auditCtl.enable {
+		return
+	}
+	r.GET("/audit", fw.PrepareToken(true), fw.Authorize("audit_view"), fw.auditQuery)
+	fw.DocRoute("GET", "/audit", &RouteDoc{Summary: "查询审计日志", Tags: []string{"framework"}, Token: true})
+}
+
+// redactParams 将参数名在脱敏列表中的值替换为***
+func (fw *WMFrameWorkV2) redactParams(js string) string {
+	return redactJSON(gjson.Parse(js), fw.auditCtl.redact)
+}
+
+// gjsonEscape 转义sjson路径中的特殊字符
+func gjsonEscape(s string) string {
+	return strings.NewReplacer(".", `\.`, "*", `\*`, "?", `\?`).Replace(s)
+}
+
+// truncateString 截断到最多n字节，不拆分utf8字符
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "..."
+}
+
+// auditParams 读取query，form和json参数，请求体超过audit_max_params时不解析
+func (fw *WMFrameWorkV2) auditParams(c *gin.Context) string {
+	js := "{}"
+	for k, v := range c.Request.URL.Query() {
+		js, _ = sjson.Set(js, gjsonEscape(k), strings.Join(v, ","))
+	}
+	if c.Request.ContentLength > int64(fw.auditCtl.maxParams) {
+		js, _ = sjson.Set(js, "body", fmt.Sprintf("%d bytes omitted", c.Request.ContentLength))
+		return truncateString(fw.redactParams(js), fw.auditCtl.maxParams)
+	}
+	b, truncated := peekBody(c.Request, fw.auditCtl.maxParams)
+	if b == nil {
+		return truncateString(fw.redactParams(js), fw.auditCtl.maxParams)
+	}
+	if truncated {
+		js, _ = sjson.Set(js, "body", "too large, omitted")
+		return truncateString(fw.redactParams(js), fw.auditCtl.maxParams)
+	}
+	if strings.HasPrefix(c.ContentType(), "application/json") {
+		if gjson.ValidBytes(b) {
+			js, _ = sjson.SetRaw(js, "body", string(b))
+		}
+	} else if c.Request.ParseForm() == nil {
+		for k, v := range c.Request.PostForm {
+			js, _ = sjson.Set(js, gjsonEscape(k), strings.Join(v, ","))
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(b))
+	}
+	return truncateString(fw.redactParams(js), fw.auditCtl.maxParams)
+}
+
+// Audit 记录审计日志，异步写入
+// action: 操作，如user.delete
+// target: 操作对象，如用户id
+// detail: 详细说明
+func (fw *WMFrameWorkV2) Audit(c *gin.Context, action, target, detail string) {
+	if !fw.auditCtl.enable {
+		return
+	}
+	rec := &AuditRecord{
+		Time:      time.Now().Unix(),
+		Action:    action,
+		Target:    target,
+		Detail:    detail,
+		Result:    "ok",
+		RequestID: c.Param("_requestID"),
+		From:      fw.ClientIP(c),
+		Route:     c.Request.Method + " " + c.FullPath(),
+	}
+	rec.User = c.Param("_userTokenName")
+	if rec.User == "" {
+		rec.User, _ = fw.ClientIdentity(c)
+	}
+	if c.Writer.Written() {
+		rec.Status = c.Writer.Status()
+		if rec.Status >= 400 {
+			rec.Result = "fail"
+		}
+	}
+	fw.writeAudit(rec)
+}
+
+// AuditLog 记录接口的调用情况，包括请求参数和结果，需在PrepareToken之后使用
+// action: 操作，为空时使用路由
+func (fw *WMFrameWorkV2) AuditLog(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !fw.auditCtl.enable {
+			return
+		}
+		params := fw.auditParams(c)
+		c.Next()
+		rec := &AuditRecord{
+			Time:      time.Now().Unix(),
+			Action:    action,
+			Target:    c.Request.URL.Path,
+			Params:    params,
+			Status:    c.Writer.Status(),
+			Result:    "ok",
+			RequestID: c.Param("_requestID"),
+			From:      fw.ClientIP(c),
+			Route:     c.Request.Method + " " + c.FullPath(),
+		}
+		rec.User = c.Param("_userTokenName")
+		if rec.User == "" {
+			rec.User, _ = fw.ClientIdentity(c)
+		}
+		if rec.Action == "" {
+			rec.Action = rec.Route
+		}
+		if rec.Status >= 400 {
+			rec.Result = "fail"
+		}
+		if len(c.Errors) > 0 {
+			rec.Detail = c.Errors.String()
+		}
+		fw.writeAudit(rec)
+	}
+}
+
+// WithAudit 使用AuditLog中间件
+func WithAudit(action string) APIOption {
+	return func(r *apiRoute) {
+		r.audited = true
+		r.audit = action
+	}
+}
+
+func (fw *WMFrameWorkV2) writeAudit(rec *AuditRecord) {
+	select {
+	case fw.auditCtl.chanRecord <- rec:
+	default:
+		fw.WriteError("AUDIT", "audit queue is full, drop "+rec.User+"|"+rec.Action+"|"+rec.Target)
+	}
+}
+
+// rotatedFiles 返回文件和按大小重命名的文件，当前文件在前，重命名的文件按时间倒序
+func rotatedFiles(name string) []string {
+	ss, _ := filepath.Glob(name + ".*")
+	sort.Sort(sort.Reverse(sort.StringSlice(ss)))
+	return append([]string{name}, ss...)
+}
+
+// rotateFile 当前文件超过maxSize时重命名为<文件名>.<时间>，并删除超过保留天数的文件，返回打开的当前文件
+// tag: 日志类别
+// f: 已打开的当前文件，为nil时直接打开
+func (fw *WMFrameWorkV2) rotateFile(tag, name string, f *os.File, maxSize int64, keepDays int) *os.File {
+	if f != nil {
+		info, err := f.Stat()
+		if err != nil || info.Size() < maxSize {
+			return f
+		}
+		f.Close()
+		if err := os.Rename(name, name+"."+time.Now().Format("20060102150405.000000")); err != nil {
+			fw.WriteError(tag, "rotate file error: "+err.Error())
+		}
+		for _, v := range rotatedFiles(name)[1:] {
+			if info, err := os.Stat(v); err == nil && time.Since(info.ModTime()) > time.Hour*24*time.Duration(keepDays) {
+				os.Remove(v)
+			}
+		}
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		fw.WriteError(tag, "open file error: "+err.Error())
+		return nil
+	}
+	return f
+}
+
+// auditFiles 返回审计日志文件，当前文件在前，重命名的文件按时间倒序
+func (fw *WMFrameWorkV2) auditFiles() []string {
+	return rotatedFiles(fw.auditCtl.file)
+}
+
+// rotateAuditFile 当前文件超过audit_file_maxsize时重命名，并删除超过保留天数的文件
+func (fw *WMFrameWorkV2) rotateAuditFile(f *os.File) *os.File {
+	return fw.rotateFile("AUDIT", fw.auditCtl.file, f, fw.auditCtl.fileMaxSize, fw.auditCtl.fileKeepDays)
+}
+
+// auditWriter 写入审计记录
+func (fw *WMFrameWorkV2) auditWriter() {
+	var f *os.File
+	for rec := range fw.auditCtl.chanRecord {
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					fw.WriteError("AUDIT", fmt.Sprintf("audit writer crash: %+v", err))
+				}
+			}()
+			b, _ := json.Marshal(rec)
+			if fw.auditCtl.has(AuditSinkFile) {
+				f = fw.rotateAuditFile(f)
+				if f != nil {
+					f.Write(append(b, '\n'))
+				}
+			}
+			if fw.auditCtl.has(AuditSinkMQ) {
+				fw.WriteRabbitMQ(fw.auditCtl.mqKey, b, time.Hour*24)
+			}
+			if fw.auditCtl.has(AuditSinkSQL) {
+				fw.auditSQL(rec)
+			}
+		}()
+	}
+}
+
+// auditTable 创建审计日志数据表
+func (fw *WMFrameWorkV2) auditTable() bool {
+	if atomic.LoadInt32(&fw.auditCtl.tableReady) == 1 {
+		return true
+	}
+	if !fw.MysqlIsReady() {
+		return false
+	}
+	var s string
+	switch fw.dbCtl.driver {
+	case "mssql":
+		s = "IF OBJECT_ID(N'" + fw.auditCtl.table + "', N'U') IS NULL CREATE TABLE " + fw.auditCtl.table + ` (
+id BIGINT IDENTITY(1,1) PRIMARY KEY,
+dt BIGINT NOT NULL,
+user_name NVARCHAR(100) NOT NULL,
+action NVARCHAR(200) NOT NULL,
+target NVARCHAR(500) NOT NULL,
+route NVARCHAR(500) NOT NULL,
+params NVARCHAR(MAX) NOT NULL,
+status INT NOT NULL,
+result NVARCHAR(10) NOT NULL,
+from_ip NVARCHAR(50) NOT NULL,
+request_id NVARCHAR(50) NOT NULL,
+detail NVARCHAR(MAX) NOT NULL);`
+	default:
+		s = "CREATE TABLE IF NOT EXISTS `" + fw.auditCtl.table + "` (" + `
+id BIGINT NOT NULL AUTO_INCREMENT,
+dt BIGINT NOT NULL,
+user_name VARCHAR(100) NOT NULL,
+action VARCHAR(200) NOT NULL,
+target VARCHAR(500) NOT NULL,
+route VARCHAR(500) NOT NULL,
+params TEXT NOT NULL,
+status INT NOT NULL,
+result VARCHAR(10) NOT NULL,
+from_ip VARCHAR(50) NOT NULL,
+request_id VARCHAR(50) NOT NULL,
+detail TEXT NOT NULL,
+PRIMARY KEY (id),
+KEY idx_dt (dt),
+KEY idx_user (user_name, dt),
+KEY idx_action (action, dt)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`
+	}
+	if _, _, err := fw.dbCtl.client.Exec(s); err != nil {
+		fw.WriteError("AUDIT", "create audit table error: "+err.Error())
+		return false
+	}
+	atomic.StoreInt32(&fw.auditCtl.tableReady, 1)
+	return true
+}
+
+func (fw *WMFrameWorkV2) auditSQL(rec *AuditRecord) {
+	if !fw.auditTable() {
+		return
+	}
+	_, _, err := fw.dbCtl.client.Exec("insert into "+fw.auditCtl.table+" (dt,user_name,action,target,route,params,status,result,from_ip,request_id,detail) values (?,?,?,?,?,?,?,?,?,?,?)",
+		rec.Time, rec.User, rec.Action, rec.Target, rec.Route, rec.Params, rec.Status, rec.Result, rec.From, rec.RequestID, rec.Detail)
+	if err != nil {
+		fw.WriteError("AUDIT", "write audit record error: "+err.Error())
+	}
+}
+
+// auditFilter 审计日志查询条件
+type auditFilter struct {
+	User   string `form:"user"`
+	Action string `form:"action"`
+	// 开始时间，unix秒
+	Start int64 `form:"start"`
+	// 结束时间，unix秒
+	End int64 `form:"end"`
+	// 最大返回数量，默认100，最大1000
+	Limit int `form:"limit" binding:"omitempty,gte=1,lte=1000"`
+}
+
+func (af *auditFilter) match(rec *AuditRecord) bool {
+	return (af.User == "" || rec.User == af.User) &&
+		(af.Action == "" || strings.HasPrefix(rec.Action, af.Action)) &&
+		(af.Start == 0 || rec.Time >= af.Start) &&
+		(af.End == 0 || rec.Time <= af.End)
+}
+
+// auditQuery 查询审计日志，按时间倒序，action按前缀匹配
+func (fw *WMFrameWorkV2) auditQuery(c *gin.Context) {
+	var af auditFilter
+	if !fw.Bind(c, &af) {
+		return
+	}
+	if af.Limit == 0 {
+		af.Limit = 100
+	}
+	var recs []*AuditRecord
+	var err error
+	switch {
+	case fw.auditCtl.has(AuditSinkSQL):
+		recs, err = fw.auditQuerySQL(&af)
+	case fw.auditCtl.has(AuditSinkFile):
+		recs, err = fw.auditQueryFile(&af)
+	default:
+		fw.Fail(c, ErrNotFound, fmt.Errorf("audit query needs sql or file sink"))
+		return
+	}
+	if err != nil {
+		fw.Fail(c, ErrInternal, err)
+		return
+	}
+	fw.OK(c, recs)
+}
+
+func (fw *WMFrameWorkV2) auditQuerySQL(af *auditFilter) ([]*AuditRecord, error) {
+	if !fw.auditTable() {
+		return nil, fmt.Errorf("sql is not ready")
+	}
+	where := make([]string, 0)
+	params := make([]interface{}, 0)
+	if af.User != "" {
+		where = append(where, "user_name=?")
+		params = append(params, af.User)
+	}
+	if af.Action != "" {
+		where = append(where, "action like ?")
+		params = append(params, af.Action+"%")
+	}
+	if af.Start > 0 {
+		where = append(where, "dt>=?")
+		params = append(params, af.Start)
+	}
+	if af.End > 0 {
+		where = append(where, "dt<=?")
+		params = append(params, af.End)
+	}
+	s := "select dt,user_name,action,target,route,params,status,result,from_ip,request_id,detail from " + fw.auditCtl.table
+	if len(where) > 0 {
+		s += " where " + strings.Join(where, " and ")
+	}
+	s += " order by id desc"
+	ans, err := fw.dbCtl.client.QueryPB2(s, af.Limit, params...)
+	if err != nil {
+		return nil, err
+	}
+	recs := make([]*AuditRecord, 0, len(ans.Rows))
+	for _, row := range ans.Rows {
+		if len(row.Cells) < 11 {
+			continue
+		}
+		recs = append(recs, &AuditRecord{
+			Time:      gopsu.String2Int64(row.Cells[0], 10),
+			User:      row.Cells[1],
+			Action:    row.Cells[2],
+			Target:    row.Cells[3],
+			Route:     row.Cells[4],
+			Params:    row.Cells[5],
+			Status:    gopsu.String2Int(row.Cells[6], 10),
+			Result:    row.Cells[7],
+			From:      row.Cells[8],
+			RequestID: row.Cells[9],
+			Detail:    row.Cells[10],
+		})
+	}
+	return recs, nil
+}
+
+// auditQueryFile 从文件查询，返回最新的记录，当前文件数量不足时继续查询重命名的文件
+func (fw *WMFrameWorkV2) auditQueryFile(af *auditFilter) ([]*AuditRecord, error) {
+	recs := make([]*AuditRecord, 0)
+	for _, name := range fw.auditFiles() {
+		ss, err := scanAuditFile(name, af, af.Limit-len(recs))
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, ss...)
+		if len(recs) >= af.Limit {
+			break
+		}
+	}
+	return recs, nil
+}
+
+// scanAuditFile 返回文件中最新的n条记录，按时间倒序
+func scanAuditFile(name string, af *auditFilter, n int) ([]*AuditRecord, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*AuditRecord{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	recs := make([]*AuditRecord, 0)
+	scan := bufio.NewScanner(f)
+	scan.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scan.Scan() {
+		rec := &AuditRecord{}
+		if json.Unmarshal(scan.Bytes(), rec) != nil || !af.match(rec) {
+			continue
+		}
+		recs = append(recs, rec)
+		// 只保留最新的记录
+		if len(recs) > n {
+			recs = recs[1:]
+		}
+	}
+	for i, j := 0, len(recs)-1; i < j; i, j = i+1, j-1 {
+		recs[i], recs[j] = recs[j], recs[i]
+	}
+	return recs, scan.Err()
+}
+
+// ViewAuditConfig 查看审计配置，返回json字符串
+func (fw *WMFrameWorkV2) ViewAuditConfig() string {
+	return fw.auditCtl.forshow
+}
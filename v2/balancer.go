@@ -0,0 +1,232 @@
+package wmv2
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// 负载均衡策略
+const (
+	// LBRandom 按权重随机
+	LBRandom = "random"
+	// LBRoundRobin 按权重轮询
+	LBRoundRobin = "roundrobin"
+	// LBLeastInflight 进行中请求最少
+	LBLeastInflight = "leastinflight"
+	// LBHash 按key一致性哈希
+	LBHash = "hash"
+)
+
+// 负载均衡
+type balancer struct {
+	// 默认策略
+	strategy string
+	// 是否优先选择同区域实例
+	preferZone bool
+	// 本实例区域
+	zone string
+	// 轮询的当前权重，服务名-地址-权重
+	locker sync.Mutex
+	rr     map[string]map[string]int
+	// 进行中的请求数，地址-*int64
+	inflight sync.Map
+}
+
+func (b *balancer) counter(addr string) *int64 {
+	x, _ := b.inflight.LoadOrStore(addr, new(int64))
+	return x.(*int64)
+}
+
+// begin 请求开始，返回结束方法
+func (b *balancer) begin(addr string) func() {
+	c := b.counter(addr)
+	atomic.AddInt64(c, 1)
+	return func() {
+		atomic.AddInt64(c, -1)
+	}
+}
+
+// pick 按策略选取实例
+func (b *balancer) pick(svrName string, ins []*Instance, strategy, key string) *Instance {
+	if len(ins) == 0 {
+		return nil
+	}
+	if b.preferZone && b.zone != "" {
+		same := make([]*Instance, 0, len(ins))
+		for _, v := range ins {
+			if v.Zone == b.zone {
+				same = append(same, v)
+			}
+		}
+		if len(same) > 0 {
+			ins = same
+		}
+	}
+	if len(ins) == 1 {
+		return ins[0]
+	}
+	if strategy == "" {
+		strategy = b.strategy
+	}
+	switch strategy {
+	case LBRoundRobin:
+		return b.roundRobin(svrName, ins)
+	case LBLeastInflight:
+		return b.leastInflight(ins)
+	case LBHash:
+		return hashPick(ins, key)
+	default:
+		return randomPick(ins)
+	}
+}
+
+// randomPick 按权重随机
+func randomPick(ins []*Instance) *Instance {
+	total := 0
+	for _, v := range ins {
+		total += v.Weight
+	}
+	n := rand.Intn(total)
+	for _, v := range ins {
+		if n < v.Weight {
+			return v
+		}
+		n -= v.Weight
+	}
+	return ins[len(ins)-1]
+}
+
+// roundRobin 平滑加权轮询
+func (b *balancer) roundRobin(svrName string, ins []*Instance) *Instance {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	cur, ok := b.rr[svrName]
+	if !ok {
+		cur = make(map[string]int)
+		b.rr[svrName] = cur
+	}
+	// 清除已下线的实例
+	if len(cur) > 0 {
+		addrs := make(map[string]bool, len(ins))
+		for _, v := range ins {
+			addrs[v.Addr] = true
+		}
+		for k := range cur {
+			if !addrs[k] {
+				delete(cur, k)
+			}
+		}
+	}
+	var best *Instance
+	total := 0
+	for _, v := range ins {
+		cur[v.Addr] += v.Weight
+		total += v.Weight
+		if best == nil || cur[v.Addr] > cur[best.Addr] {
+			best = v
+		}
+	}
+	cur[best.Addr] -= total
+	return best
+}
+
+// forget 服务没有可用实例时清除轮询状态
+func (b *balancer) forget(svrName string) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	delete(b.rr, svrName)
+}
+
+// leastInflight 进行中请求数/权重最小的实例
+func (b *balancer) leastInflight(ins []*Instance) *Instance {
+	var best *Instance
+	var bestScore float64
+	for _, v := range ins {
+		score := float64(atomic.LoadInt64(b.counter(v.URL()))) / float64(v.Weight)
+		if best == nil || score < bestScore || (score == bestScore && rand.Intn(2) == 0) {
+			best = v
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// hashPick 加权rendezvous哈希，相同key在实例不变时总是选取相同实例
+func hashPick(ins []*Instance, key string) *Instance {
+	var best *Instance
+	var bestScore float64
+	for _, v := range ins {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(v.Addr))
+		// 转换为(0,1)区间
+		f := (float64(h.Sum64()>>11) + 0.5) / float64(1<<53)
+		score := -float64(v.Weight) / math.Log(f)
+		if best == nil || score > bestScore {
+			best = v
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// instancesOf 返回服务的所有实例，未发布实例信息的服务使用旧版注册信息
+func (fw *WMFrameWorkV2) instancesOf(svrName string) ([]*Instance, error) {
+	if ins, err := fw.listInstances(svrName); err == nil && len(ins) > 0 {
+		return ins, nil
+	}
+	if !fw.etcdCtl.enable {
+		return nil, fmt.Errorf("etcd client not ready")
+	}
+	// 发布过实例信息的服务，实例都已撤销时不使用旧版注册信息
+	if fw.snapshot.published(svrName) {
+		fw.lb.forget(svrName)
+		return nil, fmt.Errorf("no available instance of %s", svrName)
+	}
+	ins, err := fw.listLegacyInstances(svrName)
+	if err != nil {
+		return nil, err
+	}
+	if len(ins) == 0 {
+		fw.lb.forget(svrName)
+		return nil, fmt.Errorf("no available instance of %s", svrName)
+	}
+	return ins, nil
+}
+
+// pickInstanceBy 按策略选取服务实例
+func (fw *WMFrameWorkV2) pickInstanceBy(svrName, strategy, key string) (*Instance, error) {
+	ins, err := fw.instancesOf(svrName)
+	if err != nil {
+		return nil, err
+	}
+	return fw.lb.pick(svrName, ins, strategy, key), nil
+}
+
+// PickerWithKey 按key一致性哈希选取服务地址,带http(s)前缀，相同key优先选取相同实例
+func (fw *WMFrameWorkV2) PickerWithKey(svrName, key string) (string, error) {
+	inst, err := fw.pickInstanceBy(svrName, LBHash, key)
+	if err != nil {
+		return "", err
+	}
+	return inst.URL(), nil
+}
+
+// PickerStrategy 按指定策略选取服务地址,带http(s)前缀
+// strategy: random,roundrobin,leastinflight,hash
+func (fw *WMFrameWorkV2) PickerStrategy(svrName, strategy string) (string, error) {
+	inst, err := fw.pickInstanceBy(svrName, strategy, "")
+	if err != nil {
+		return "", err
+	}
+	return inst.URL(), nil
+}
+
+// PickAll 返回服务的所有实例，用于广播调用，未发布实例信息的服务返回旧版注册的所有实例
+func (fw *WMFrameWorkV2) PickAll(svrName string) ([]*Instance, error) {
+	return fw.instancesOf(svrName)
+}
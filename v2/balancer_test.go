@@ -0,0 +1,27 @@
+package wmv2
+
+import "testing"
+
+func TestRoundRobinPrune(t *testing.T) {
+	b := &balancer{rr: make(map[string]map[string]int)}
+	ins := []*Instance{
+		{Addr: "10.0.0.1:80", Weight: 2},
+		{Addr: "10.0.0.2:80", Weight: 1},
+	}
+	count := map[string]int{}
+	for i := 0; i < 6; i++ {
+		count[b.roundRobin("svc", ins).Addr]++
+	}
+	if count["10.0.0.1:80"] != 4 || count["10.0.0.2:80"] != 2 {
+		t.Fatalf("unexpected distribution %v", count)
+	}
+	// 下线的实例从轮询状态中清除
+	b.roundRobin("svc", ins[:1])
+	if _, ok := b.rr["svc"]["10.0.0.2:80"]; ok || len(b.rr["svc"]) != 1 {
+		t.Fatalf("got %v", b.rr["svc"])
+	}
+	b.forget("svc")
+	if _, ok := b.rr["svc"]; ok {
+		t.Fatal("service state should be removed")
+	}
+}
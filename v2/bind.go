@@ -0,0 +1,196 @@
+package wmv2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// FieldError 参数校验失败的字段信息
+type FieldError struct {
+	// 参数名，优先使用json标签，其次form标签
+	Field string `json:"field"`
+	// 校验规则
+	Rule string `json:"rule"`
+	// 规则参数
+	Param string `json:"param,omitempty"`
+	// 提示信息
+	Detail string `json:"detail"`
+}
+
+var (
+	bindOnce    sync.Once
+	regexCache  sync.Map
+	ruleMessage = map[string]map[string]string{
+		"required": {LangZhCN: "不能为空", LangEn: "is required"},
+		"min":      {LangZhCN: "不能小于%s", LangEn: "must be at least %s"},
+		"max":      {LangZhCN: "不能大于%s", LangEn: "must be at most %s"},
+		"gte":      {LangZhCN: "不能小于%s", LangEn: "must be greater than or equal to %s"},
+		"lte":      {LangZhCN: "不能大于%s", LangEn: "must be less than or equal to %s"},
+		"gt":       {LangZhCN: "必须大于%s", LangEn: "must be greater than %s"},
+		"lt":       {LangZhCN: "必须小于%s", LangEn: "must be less than %s"},
+		"len":      {LangZhCN: "长度必须为%s", LangEn: "length must be %s"},
+		"oneof":    {LangZhCN: "必须是[%s]其中之一", LangEn: "must be one of [%s]"},
+		"regex":    {LangZhCN: "格式不正确", LangEn: "has an invalid format"},
+		"email":    {LangZhCN: "不是有效的邮箱地址", LangEn: "must be a valid email address"},
+		"ip":       {LangZhCN: "不是有效的ip地址", LangEn: "must be a valid ip address"},
+	}
+)
+
+// initValidator 设置校验器使用参数名输出错误，并注册regex规则
+// regex规则的表达式中如需使用`,`，请写为`0x2C`
+func initValidator() {
+	bindOnce.Do(func() {
+		v, ok := binding.Validator.Engine().(*validator.Validate)
+		if !ok {
+			return
+		}
+		v.RegisterTagNameFunc(func(f reflect.StructField) string {
+			for _, tag := range []string{"json", "form"} {
+				name := strings.Split(f.Tag.Get(tag), ",")[0]
+				if name == "-" {
+					return ""
+				}
+				if name != "" {
+					return name
+				}
+			}
+			return f.Name
+		})
+		v.RegisterValidation("regex", func(fl validator.FieldLevel) bool {
+			var re *regexp.Regexp
+			if x, ok := regexCache.Load(fl.Param()); ok {
+				re = x.(*regexp.Regexp)
+			} else {
+				var err error
+				re, err = regexp.Compile(fl.Param())
+				if err != nil {
+					return false
+				}
+				regexCache.Store(fl.Param(), re)
+			}
+			return re.MatchString(fmt.Sprintf("%v", fl.Field().Interface()))
+		})
+	})
+}
+
+// bindMaxBody 绑定json和form参数时读取的最大字节数
+const bindMaxBody = 10 << 20
+
+// bindBody 读取body，已由ReadParams读取时使用_body参数
+func bindBody(c *gin.Context) ([]byte, error) {
+	if body, ok := c.Params.Get("_body"); ok {
+		return []byte(body), nil
+	}
+	if c.Request.Body == nil || c.Request.ContentLength == 0 {
+		return nil, nil
+	}
+	// 读取后还原body，后续处理仍可读取
+	b, truncated := peekBody(c.Request, bindMaxBody)
+	if truncated {
+		return nil, fmt.Errorf("request body is larger than %d bytes", bindMaxBody)
+	}
+	return b, nil
+}
+
+// bindParams 依次绑定query参数和body参数，不做校验
+func bindParams(c *gin.Context, req interface{}) error {
+	if err := binding.MapFormWithTag(req, c.Request.URL.Query(), "form"); err != nil {
+		return err
+	}
+	switch c.ContentType() {
+	case binding.MIMEJSON:
+		b, err := bindBody(c)
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(b)) == 0 {
+			return nil
+		}
+		return json.Unmarshal(b, req)
+	case binding.MIMEPOSTForm:
+		b, err := bindBody(c)
+		if err != nil {
+			return err
+		}
+		form, err := url.ParseQuery(string(b))
+		if err != nil {
+			return err
+		}
+		return binding.MapFormWithTag(req, form, "form")
+	case binding.MIMEMultipartPOSTForm:
+		if err := c.Request.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+			return err
+		}
+		return binding.MapFormWithTag(req, c.Request.PostForm, "form")
+	}
+	return nil
+}
+
+// Bind 将query，form，json参数绑定到结构体，并按`binding`标签进行校验
+// 校验失败时返回参数错误，data中列出每个错误的参数，与CheckRequired一样返回400，调用方直接return即可
+// 可以在ReadParams，CheckRequired之后使用，此时从_body参数读取body；json和form的body最大10MB
+// 支持的规则除validator自带的required,min,max,gte,lte,oneof等以外，增加regex=表达式
+// sample：
+//
+//	type req struct {
+//		Name string `form:"name" json:"name" binding:"required"`
+//		Age  int    `form:"age" json:"age" binding:"gte=0,lte=150"`
+//		Sex  string `form:"sex" json:"sex" binding:"omitempty,oneof=male female"`
+//		Tel  string `form:"tel" json:"tel" binding:"omitempty,regex=^1[0-9]{10}$"`
+//	}
+//	var r req
+//	if !fw.Bind(c, &r) {
+//		return
+//	}
+func (fw *WMFrameWorkV2) Bind(c *gin.Context, req interface{}) bool {
+	initValidator()
+	if err := bindParams(c, req); err != nil {
+		fw.Fail(c, ErrParams, err)
+		return false
+	}
+	err := binding.Validator.ValidateStruct(req)
+	if err == nil {
+		return true
+	}
+	errs, ok := err.(validator.ValidationErrors)
+	if !ok {
+		fw.Fail(c, ErrParams, err)
+		return false
+	}
+	lang := requestLang(c)
+	fields := make([]*FieldError, 0, len(errs))
+	details := make([]string, 0, len(errs))
+	for _, v := range errs {
+		fe := &FieldError{
+			Field: v.Field(),
+			Rule:  v.Tag(),
+			Param: v.Param(),
+		}
+		if m, ok := ruleMessage[v.Tag()]; ok {
+			fe.Detail = m[lang]
+			if strings.Contains(fe.Detail, "%s") {
+				fe.Detail = fmt.Sprintf(fe.Detail, v.Param())
+			}
+		} else if lang == LangEn {
+			fe.Detail = "failed on rule " + v.Tag()
+		} else {
+			fe.Detail = "不满足规则" + v.Tag()
+		}
+		fe.Detail = fe.Field + " " + fe.Detail
+		fields = append(fields, fe)
+		details = append(details, fe.Detail)
+	}
+	fw.FailWithData(c, ErrParams, fmt.Errorf("%s", strings.Join(details, "; ")), fields)
+	return false
+}
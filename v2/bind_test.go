@@ -0,0 +1,110 @@
+package wmv2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	ginmiddleware "github.com/xyzj/gopsu/gin-middleware"
+)
+
+type bindReq struct {
+	Name string `form:"name" json:"name" binding:"required"`
+	Age  int    `form:"age" json:"age" binding:"gte=0,lte=150"`
+	Sex  string `form:"sex" json:"sex" binding:"omitempty,oneof=male female"`
+	Tel  string `form:"tel" json:"tel" binding:"omitempty,regex=^1[0-9]{10}$"`
+}
+
+// bindRequest 发送请求，返回绑定结果和返回数据
+func bindRequest(t *testing.T, method, target, ct, body string, hs ...gin.HandlerFunc) (*bindReq, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	fw := &WMFrameWorkV2{}
+	var got *bindReq
+	r := gin.New()
+	hs = append(hs, func(c *gin.Context) {
+		var req bindReq
+		if !fw.Bind(c, &req) {
+			return
+		}
+		got = &req
+		fw.OK(c, nil)
+	})
+	r.Handle(method, "/bind", hs...)
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return got, w
+}
+
+func TestBindJSON(t *testing.T) {
+	got, w := bindRequest(t, "POST", "/bind", "application/json", `{"name":"a","age":10,"sex":"male"}`)
+	if got == nil || got.Name != "a" || got.Age != 10 || got.Sex != "male" {
+		t.Fatalf("got %+v %s", got, w.Body.String())
+	}
+}
+
+func TestBindForm(t *testing.T) {
+	got, w := bindRequest(t, "POST", "/bind?age=20", "application/x-www-form-urlencoded", "name=b&tel=13800000000")
+	if got == nil || got.Name != "b" || got.Age != 20 || got.Tel != "13800000000" {
+		t.Fatalf("got %+v %s", got, w.Body.String())
+	}
+}
+
+func TestBindQuery(t *testing.T) {
+	got, w := bindRequest(t, "GET", "/bind?name=c&age=30", "", "")
+	if got == nil || got.Name != "c" || got.Age != 30 {
+		t.Fatalf("got %+v %s", got, w.Body.String())
+	}
+}
+
+func TestBindFieldErrors(t *testing.T) {
+	got, w := bindRequest(t, "POST", "/bind", "application/json", `{"age":200,"tel":"123"}`)
+	if got != nil || w.Code != http.StatusBadRequest {
+		t.Fatalf("got %+v %d", got, w.Code)
+	}
+	var resp struct {
+		Status int           `json:"status"`
+		Code   int           `json:"code"`
+		Detail string        `json:"detail"`
+		Data   []*FieldError `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != 0 || resp.Code != ErrParams || len(resp.Data) != 3 {
+		t.Fatalf("unexpected response %s", w.Body.String())
+	}
+	rules := map[string]string{}
+	for _, v := range resp.Data {
+		rules[v.Field] = v.Rule
+	}
+	if rules["name"] != "required" || rules["age"] != "lte" || rules["tel"] != "regex" {
+		t.Fatalf("unexpected fields %v", rules)
+	}
+}
+
+func TestBindAfterReadParams(t *testing.T) {
+	got, w := bindRequest(t, "POST", "/bind", "application/json", `{"name":"d","age":40}`,
+		ginmiddleware.ReadParams(), ginmiddleware.CheckRequired("name"))
+	if got == nil || got.Name != "d" || got.Age != 40 {
+		t.Fatalf("got %+v %s", got, w.Body.String())
+	}
+	got, w = bindRequest(t, "POST", "/bind", "application/x-www-form-urlencoded", "name=e&age=50",
+		ginmiddleware.ReadParams())
+	if got == nil || got.Name != "e" || got.Age != 50 {
+		t.Fatalf("got %+v %s", got, w.Body.String())
+	}
+}
+
+func TestBindMaxBody(t *testing.T) {
+	body := `{"name":"` + strings.Repeat("a", bindMaxBody) + `"}`
+	if got, w := bindRequest(t, "POST", "/bind", "application/json", body); got != nil || w.Code != http.StatusBadRequest {
+		t.Fatalf("large body: got %d", w.Code)
+	}
+}
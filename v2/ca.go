@@ -0,0 +1,306 @@
+package wmv2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/xyzj/gopsu"
+)
+
+// CertRequest 证书申请参数
+type CertRequest struct {
+	// 证书名称
+	CommonName string
+	// 域名或ip，写入证书SAN
+	Hosts []string
+	// 是否可用作服务端证书
+	Server bool
+	// 是否可用作客户端证书
+	Client bool
+	// 有效天数，默认397天
+	Days int
+}
+
+// caKeyFile 根证书私钥，仅存在于本地，不随程序分发
+func (fw *WMFrameWorkV2) caKeyFile() string {
+	return filepath.Join(fw.baseCAPath, "ca-key.pem")
+}
+
+// lockCADir 锁定ca目录，多个服务共用ca目录时避免同时生成证书
+// 锁文件超过1分钟视为上次异常退出遗留，直接删除
+func (fw *WMFrameWorkV2) lockCADir() (func(), error) {
+	name := filepath.Join(fw.baseCAPath, "ca.lock")
+	deadline := time.Now().Add(time.Second * 30)
+	for {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(name) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > time.Minute {
+			os.Remove(name)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("ca dir is locked: %s", name)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+// CAInit 生成本站点的根证书，保存为ca目录下的ca.pem和ca-key.pem
+// force: 已存在根证书时是否覆盖，覆盖后需重新签发所有证书
+func (fw *WMFrameWorkV2) CAInit(force bool) error {
+	unlock, err := fw.lockCADir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fw.caInit(force)
+}
+
+func (fw *WMFrameWorkV2) caInit(force bool) error {
+	if (gopsu.IsExist(fw.caKeyFile()) || gopsu.IsExist(fw.tlsRoot)) && !force {
+		return fmt.Errorf("root ca already exists: %s", fw.tlsRoot)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	sn, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          sn,
+		Subject:               pkix.Name{CommonName: fw.rootPath + " root ca " + time.Now().Format("20060102")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	kb, _ := x509.MarshalECPrivateKey(key)
+	if err := writeFileAtomic(fw.caKeyFile(), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(fw.tlsRoot, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// loadCA 读取根证书和私钥
+func (fw *WMFrameWorkV2) loadCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	ca, err := tls.LoadX509KeyPair(fw.tlsRoot, fw.caKeyFile())
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := ca.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported root ca key")
+	}
+	return cert, key, nil
+}
+
+// IssueCert 使用本站点根证书签发证书，保存到certfile和keyfile
+func (fw *WMFrameWorkV2) IssueCert(req *CertRequest, certfile, keyfile string) error {
+	ca, caKey, err := fw.loadCA()
+	if err != nil {
+		return err
+	}
+	if req.Days <= 0 {
+		req.Days = 397
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	sn, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: sn,
+		Subject:      pkix.Name{CommonName: req.CommonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, req.Days),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	if tpl.NotAfter.After(ca.NotAfter) {
+		tpl.NotAfter = ca.NotAfter
+	}
+	if req.Server {
+		tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+	}
+	if req.Client {
+		tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+	}
+	for _, h := range req.Hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else if h != "" {
+			tpl.DNSNames = append(tpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	kb, _ := x509.MarshalECPrivateKey(key)
+	if err := writeFileAtomic(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// localHosts 框架证书的SAN，包含本机地址，etcd_reg和domain_name
+func (fw *WMFrameWorkV2) localHosts(extra ...string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1", gopsu.RealIP(false)}
+	if h, err := os.Hostname(); err == nil {
+		hosts = append(hosts, h)
+	}
+	if s, err := fw.wmConf.GetItem("etcd_reg"); err == nil && s != "" {
+		if h, _, err := net.SplitHostPort(s); err == nil {
+			s = h
+		}
+		hosts = append(hosts, s)
+	}
+	if s, err := fw.wmConf.GetItem("domain_name"); err == nil && s != "" {
+		hosts = append(hosts, s)
+	}
+	hosts = append(hosts, extra...)
+	m := make(map[string]bool)
+	ss := make([]string, 0, len(hosts))
+	for _, v := range hosts {
+		v = strings.TrimSpace(v)
+		if v != "" && !m[v] {
+			m[v] = true
+			ss = append(ss, v)
+		}
+	}
+	return ss
+}
+
+// issueLocalCert 签发框架证书，同时用于https服务和访问其他服务的客户端证书
+func (fw *WMFrameWorkV2) issueLocalCert(extra ...string) error {
+	return fw.IssueCert(&CertRequest{
+		CommonName: fw.serverName,
+		Hosts:      fw.localHosts(extra...),
+		Server:     true,
+		Client:     true,
+	}, fw.tlsCert, fw.tlsKey)
+}
+
+// ensureCerts 首次运行时生成根证书和框架证书，需在创建tls客户端前执行
+// autoInit: 没有根证书时是否生成，多个服务应使用同一根证书，生成的根证书需分发到其他服务的ca目录
+func (fw *WMFrameWorkV2) ensureCerts(autoInit bool) {
+	if gopsu.IsExist(fw.tlsRoot) && gopsu.IsExist(fw.tlsCert) && gopsu.IsExist(fw.tlsKey) {
+		return
+	}
+	unlock, err := fw.lockCADir()
+	if err != nil {
+		fw.WriteError("CA", "Failed lock ca dir|"+err.Error())
+		return
+	}
+	defer unlock()
+	if !gopsu.IsExist(fw.tlsRoot) {
+		if !autoInit {
+			fw.WriteError("CA", "No root ca found, copy the shared ca.pem to "+fw.baseCAPath+" or run with -ca init")
+			return
+		}
+		if err := fw.caInit(false); err != nil {
+			fw.WriteError("CA", "Failed create root ca|"+err.Error())
+			return
+		}
+		fw.WriteWarning("CA", "Create a new root ca "+fw.tlsRoot+", other services must trust the same ca.pem")
+	}
+	if !gopsu.IsExist(fw.tlsCert) || !gopsu.IsExist(fw.tlsKey) {
+		if err := fw.issueLocalCert(); err != nil {
+			fw.WriteError("CA", "Failed issue certificate|"+err.Error())
+			return
+		}
+		fw.WriteSystem("CA", "Success issue certificate "+fw.tlsCert)
+	}
+}
+
+// rotateLocalCert 框架证书由本站点根证书签发且即将到期时重新签发
+func (fw *WMFrameWorkV2) rotateLocalCert(before time.Duration) {
+	if !gopsu.IsExist(fw.caKeyFile()) {
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(fw.tlsCert, fw.tlsKey)
+	if err != nil {
+		return
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || time.Until(leaf.NotAfter) > before {
+		return
+	}
+	ca, _, err := fw.loadCA()
+	if err != nil || leaf.CheckSignatureFrom(ca) != nil {
+		return
+	}
+	unlock, err := fw.lockCADir()
+	if err != nil {
+		fw.WriteError("CA", "Failed lock ca dir|"+err.Error())
+		return
+	}
+	defer unlock()
+	if err := fw.issueLocalCert(); err != nil {
+		fw.WriteError("CA", "Failed rotate certificate|"+err.Error())
+		return
+	}
+	fw.clientCert.Store((*tls.Certificate)(nil))
+	fw.WriteSystem("CA", "Success rotate certificate "+fw.tlsCert)
+}
+
+// caCommand 处理-ca启动参数，执行后退出
+// init: 生成根证书
+// server: 重新签发框架证书，-cahosts追加SAN
+// client: 签发客户端证书，-cacn指定名称，保存为ca目录下的<cn>.pem和<cn>-key.pem
+func (fw *WMFrameWorkV2) caCommand(cmd string) error {
+	extra := splitConfigList(*caHosts)
+	unlock, err := fw.lockCADir()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	switch cmd {
+	case "init":
+		return fw.caInit(false)
+	case "server":
+		return fw.issueLocalCert(extra...)
+	case "client":
+		if *caCN == "" {
+			return fmt.Errorf("-cacn is required")
+		}
+		return fw.IssueCert(&CertRequest{
+			CommonName: *caCN,
+			Hosts:      extra,
+			Client:     true,
+		}, filepath.Join(fw.baseCAPath, *caCN+".pem"), filepath.Join(fw.baseCAPath, *caCN+"-key.pem"))
+	}
+	return fmt.Errorf("unknown ca command %s, should be one of init, server, client", cmd)
+}
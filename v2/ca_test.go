@@ -0,0 +1,37 @@
+package wmv2
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCAInitConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fw := &WMFrameWorkV2{rootPath: "test", baseCAPath: dir, tlsRoot: filepath.Join(dir, "ca.pem")}
+			errs <- fw.CAInit(false)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	n := 0
+	for err := range errs {
+		if err == nil {
+			n++
+		}
+	}
+	// 只有一个能生成根证书
+	if n != 1 {
+		t.Fatalf("%d root ca created", n)
+	}
+	fw := &WMFrameWorkV2{baseCAPath: dir, tlsRoot: filepath.Join(dir, "ca.pem")}
+	if _, _, err := fw.loadCA(); err != nil {
+		t.Fatalf("root ca and key do not match: %v", err)
+	}
+}
@@ -0,0 +1,738 @@
+package wmv2
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/xyzj/gopsu"
+)
+
+// 流量采集输出
+const (
+	// CaptureSinkFile 写入jsonl文件
+	CaptureSinkFile = "file"
+	// CaptureSinkSQL 写入数据库，自动建表
+	CaptureSinkSQL = "sql"
+)
+
+// CaptureRecord 采集的请求和返回
+type CaptureRecord struct {
+	// 采集记录id，由服务端生成
+	ID string `json:"id"`
+	// 请求的X-Request-ID
+	RequestID string `json:"request_id,omitempty"`
+	Time      int64  `json:"time"`
+	// 来源ip
+	From   string `json:"from"`
+	Method string `json:"method"`
+	// 路径，包含query参数
+	URI        string            `json:"uri"`
+	ReqHeader  map[string]string `json:"req_header"`
+	ReqBody    string            `json:"req_body"`
+	Status     int               `json:"status"`
+	RespHeader map[string]string `json:"resp_header"`
+	RespBody   string            `json:"resp_body"`
+	// 处理时长，毫秒
+	Duration int64 `json:"duration"`
+	// body超过capture_max_body，未完整保存，不能回放
+	Truncated bool `json:"truncated"`
+}
+
+// 流量采集配置
+type captureConfigure struct {
+	forshow string
+	// 是否采集，1-采集，可通过/capture/on，/capture/off切换
+	enable int32
+	// 采样率，0-1
+	sample float64
+	// 输出方式
+	sink string
+	// 文件路径
+	file string
+	// 单个文件最大字节数，超过后重命名为<文件名>.<时间>
+	fileMaxSize int64
+	// 重命名后的文件保留天数
+	fileKeepDays int
+	// 数据表名称
+	table string
+	// 采集的路由前缀，为空时采集所有路由
+	paths []string
+	// 不采集的路由前缀
+	exclude []string
+	// 脱敏的请求头和返回头，小写
+	redactHeaders []string
+	// 脱敏的json字段和form参数，小写，部分匹配
+	redactFields []string
+	// 请求和返回body最大保存字节数
+	maxBody int
+	// 允许回放的目标，scheme://host:port格式
+	replayTargets []string
+	chanRecord    chan *CaptureRecord
+	startOnce     sync.Once
+	fileLocker    sync.Mutex
+	// 当前写入的文件，由fileLocker保护
+	fd *os.File
+	// 数据表是否已创建，1-已创建
+	tableReady int32
+}
+
+func (conf *captureConfigure) show() string {
+	conf.forshow, _ = sjson.Set("", "enable", atomic.LoadInt32(&conf.enable) == 1)
+	conf.forshow, _ = sjson.Set(conf.forshow, "sample", conf.sample)
+	conf.forshow, _ = sjson.Set(conf.forshow, "sink", conf.sink)
+	conf.forshow, _ = sjson.Set(conf.forshow, "file", conf.file)
+	conf.forshow, _ = sjson.Set(conf.forshow, "file_maxsize", conf.fileMaxSize)
+	conf.forshow, _ = sjson.Set(conf.forshow, "file_keep_days", conf.fileKeepDays)
+	conf.forshow, _ = sjson.Set(conf.forshow, "table", conf.table)
+	conf.forshow, _ = sjson.Set(conf.forshow, "paths", conf.paths)
+	conf.forshow, _ = sjson.Set(conf.forshow, "exclude", conf.exclude)
+	conf.forshow, _ = sjson.Set(conf.forshow, "redact_headers", conf.redactHeaders)
+	conf.forshow, _ = sjson.Set(conf.forshow, "redact_fields", conf.redactFields)
+	conf.forshow, _ = sjson.Set(conf.forshow, "max_body", conf.maxBody)
+	conf.forshow, _ = sjson.Set(conf.forshow, "replay_targets", conf.replayTargets)
+	return conf.forshow
+}
+
+// setEnable 开始或停止采集
+func (conf *captureConfigure) setEnable(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&conf.enable, v)
+}
+
+// want 检查路由是否需要采集
+func (conf *captureConfigure) want(path string) bool {
+	for _, v := range conf.exclude {
+		if strings.HasPrefix(path, v) {
+			return false
+		}
+	}
+	if len(conf.paths) == 0 {
+		return true
+	}
+	for _, v := range conf.paths {
+		if strings.HasPrefix(path, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fw *WMFrameWorkV2) loadCaptureConfig() {
+	enable, _ := strconv.ParseBool(fw.wmConf.GetItemDefault("capture_enable", "false", "是否采集请求和返回，用于查看和回放，运行中可通过/capture/on，/capture/off切换"))
+	fw.captureCtl.setEnable(enable)
+	fw.captureCtl.sample, _ = strconv.ParseFloat(fw.wmConf.GetItemDefault("capture_sample", "1", "采样率，0-1，1为采集所有请求"), 64)
+	fw.captureCtl.sink = strings.ToLower(fw.wmConf.GetItemDefault("capture_sink", CaptureSinkFile, "采集数据保存方式，file-jsonl文件，sql-数据表"))
+	fw.captureCtl.file = fw.wmConf.GetItemDefault("capture_file", "", "采集数据文件路径，留空时使用docs目录下的capture-<服务名>.jsonl")
+	fw.captureCtl.fileMaxSize = int64(gopsu.String2Int(fw.wmConf.GetItemDefault("capture_file_maxsize", "100", "采集数据文件最大MB，超过后重命名为<文件名>.<时间>并创建新文件"), 10)) * 1024 * 1024
+	fw.captureCtl.fileKeepDays = gopsu.String2Int(fw.wmConf.GetItemDefault("capture_file_keep_days", "7", "重命名后的采集数据文件保留天数"), 10)
+	fw.captureCtl.table = fw.wmConf.GetItemDefault("capture_table", "api_capture", "采集数据表名称，不存在时自动创建")
+	fw.captureCtl.paths = splitConfigList(fw.wmConf.GetItemDefault("capture_paths", "", "采集的路由前缀，用`,`分割多个，留空采集所有路由"))
+	fw.captureCtl.exclude = splitConfigList(fw.wmConf.GetItemDefault("capture_exclude", "/health,/status,/metrics,/capture,/apirecord,/downloadLog,/static,/push", "不采集的路由前缀，用`,`分割多个"))
+	fw.captureCtl.redactHeaders = splitConfigList(strings.ToLower(fw.wmConf.GetItemDefault("capture_redact_headers", "Authorization,Cookie,Set-Cookie,User-Token,Legal-High", "脱敏的请求头和返回头，用`,`分割多个")))
+	fw.captureCtl.redactFields = splitConfigList(strings.ToLower(fw.wmConf.GetItemDefault("capture_redact_fields", "pwd,passwd,password,token,secret", "脱敏的json字段和form参数名，用`,`分割多个，不区分大小写，部分匹配")))
+	fw.captureCtl.maxBody = gopsu.String2Int(fw.wmConf.GetItemDefault("capture_max_body", "65536", "请求和返回body最大保存字节数，超过时截断并且不能回放"), 10)
+	fw.captureCtl.replayTargets = splitConfigList(fw.wmConf.GetItemDefault("capture_replay_targets", "", "允许回放的目标地址，如https://192.168.1.10:6819，用`,`分割多个，留空时不允许回放"))
+	fw.wmConf.Save()
+	if fw.captureCtl.maxBody <= 0 {
+		fw.captureCtl.maxBody = 65536
+	}
+	if fw.captureCtl.fileMaxSize <= 0 {
+		fw.captureCtl.fileMaxSize = 100 * 1024 * 1024
+	}
+	if fw.captureCtl.fileKeepDays <= 0 {
+		fw.captureCtl.fileKeepDays = 7
+	}
+	if fw.captureCtl.file == "" {
+		fw.captureCtl.file = gopsu.JoinPathFromHere("docs", "capture-"+fw.serverName+".jsonl")
+	}
+	os.MkdirAll(filepath.Dir(fw.captureCtl.file), 0755)
+	fw.captureCtl.show()
+	fw.captureCtl.startOnce.Do(func() {
+		fw.captureCtl.chanRecord = make(chan *CaptureRecord, 1000)
+		go fw.captureWriter()
+	})
+}
+
+// captureRoutes 添加采集管理路由，需要管理员或capture_admin接口权限
+//
+//	GET /capture/on|off|reset 开始，停止采集，清空采集数据
+//	GET /capture/list?method=&path=&status=&limit= 按时间倒序列出采集记录，不含body
+//	GET /capture/get?id= 查看采集记录
+//	POST /capture/replay 回放，参数见captureReplay
+func (fw *WMFrameWorkV2) captureRoutes(r *gin.Engine) {
+	fw.loadCaptureConfig()
+	g := r.Group("/capture", fw.PrepareToken(true), fw.Authorize("capture_admin"))
+	g.GET("/:do", fw.captureAdmin)
+	g.POST("/replay", fw.captureReplay)
+	// 兼容原有的/apirecord/on|off|reset
+	r.GET("/apirecord/:do", fw.PrepareToken(true), fw.Authorize("capture_admin"), fw.captureAdmin)
+	fw.DocRoute("GET", "/capture/:do", &RouteDoc{Summary: "流量采集管理", Tags: []string{"framework"}, Token: true})
+	fw.DocRoute("POST", "/capture/replay", &RouteDoc{Summary: "回放采集的请求", Tags: []string{"framework"}, Token: true})
+	fw.DocRoute("GET", "/apirecord/:do", &RouteDoc{Summary: "流量采集管理，兼容原有路由", Tags: []string{"framework"}, Token: true, Deprecated: true})
+}
+
+func (fw *WMFrameWorkV2) captureAdmin(c *gin.Context) {
+	switch c.Param("do") {
+	case "on":
+		fw.captureCtl.setEnable(true)
+		fw.OK(c, nil)
+	case "off":
+		fw.captureCtl.setEnable(false)
+		fw.OK(c, nil)
+	case "reset":
+		if err := fw.captureReset(); err != nil {
+			fw.Fail(c, ErrInternal, err)
+			return
+		}
+		fw.OK(c, nil)
+	case "list":
+		var q captureFilter
+		if !fw.Bind(c, &q) {
+			return
+		}
+		recs, err := fw.captureList(&q, "")
+		if err != nil {
+			fw.Fail(c, ErrInternal, err)
+			return
+		}
+		for _, v := range recs {
+			v.ReqBody, v.RespBody = "", ""
+		}
+		fw.OK(c, recs)
+	case "get":
+		recs, err := fw.captureList(&captureFilter{}, c.Query("id"))
+		if err != nil {
+			fw.Fail(c, ErrInternal, err)
+			return
+		}
+		if len(recs) == 0 {
+			fw.Fail(c, ErrNotFound, nil)
+			return
+		}
+		fw.OK(c, recs[0])
+	default:
+		fw.Fail(c, ErrNotFound, nil)
+	}
+}
+
+// redactHeaders 复制并脱敏http头
+func (fw *WMFrameWorkV2) redactHeaders(h http.Header) map[string]string {
+	m := make(map[string]string, len(h))
+	for k := range h {
+		if containsString(fw.captureCtl.redactHeaders, strings.ToLower(k)) {
+			m[k] = "***"
+			continue
+		}
+		m[k] = h.Get(k)
+	}
+	return m
+}
+
+// redactBody 脱敏json或form数据
+func (fw *WMFrameWorkV2) redactBody(b []byte, contentType string) string {
+	switch {
+	case gjson.ValidBytes(b) && len(bytes.TrimSpace(b)) > 0 && (b[0] == '{' || b[0] == '['):
+		return redactJSON(gjson.ParseBytes(b), fw.captureCtl.redactFields)
+	case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+		ss := strings.Split(string(b), "&")
+		for k, v := range ss {
+			kv := strings.SplitN(v, "=", 2)
+			if len(kv) == 2 && matchField(kv[0], fw.captureCtl.redactFields) {
+				ss[k] = kv[0] + "=***"
+			}
+		}
+		return strings.Join(ss, "&")
+	}
+	return string(b)
+}
+
+// 以=开头的字段名需完全匹配，如=key，其他字段名部分匹配
+func matchField(name string, fields []string) bool {
+	name = strings.ToLower(name)
+	for _, v := range fields {
+		if strings.HasPrefix(v, "=") {
+			if name == v[1:] {
+				return true
+			}
+			continue
+		}
+		if strings.Contains(name, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactJSON 递归替换json中需要脱敏的字段
+func redactJSON(js gjson.Result, fields []string) string {
+	switch {
+	case js.IsObject():
+		ans := "{}"
+		js.ForEach(func(key, value gjson.Result) bool {
+			if matchField(key.String(), fields) {
+				ans, _ = sjson.Set(ans, gjsonEscape(key.String()), "***")
+			} else {
+				ans, _ = sjson.SetRaw(ans, gjsonEscape(key.String()), redactJSON(value, fields))
+			}
+			return true
+		})
+		return ans
+	case js.IsArray():
+		ans := "[]"
+		js.ForEach(func(_, value gjson.Result) bool {
+			ans, _ = sjson.SetRaw(ans, "-1", redactJSON(value, fields))
+			return true
+		})
+		return ans
+	}
+	return js.Raw
+}
+
+// peekBody 读取最多max字节的请求体用于记录，超过时返回truncated，处理方法仍可读取完整的请求体
+func peekBody(r *http.Request, max int) (b []byte, truncated bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, false
+	}
+	body := r.Body
+	b, _ = ioutil.ReadAll(io.LimitReader(body, int64(max)+1))
+	if len(b) <= max {
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		return b, false
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), body), body}
+	return b[:max], true
+}
+
+// newCaptureID 生成采集记录id
+func newCaptureID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Capture 按配置采集请求和返回，NewHTTPEngine已默认添加
+func (fw *WMFrameWorkV2) Capture() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if atomic.LoadInt32(&fw.captureCtl.enable) == 0 ||
+			(fw.captureCtl.sample < 1 && mrand.Float64() >= fw.captureCtl.sample) ||
+			!fw.captureCtl.want(c.Request.URL.Path) ||
+			c.GetHeader("Upgrade") != "" {
+			return
+		}
+		start := time.Now()
+		rec := &CaptureRecord{
+			ID:        newCaptureID(),
+			Time:      start.Unix(),
+			From:      fw.ClientIP(c),
+			Method:    c.Request.Method,
+			URI:       c.Request.URL.RequestURI(),
+			ReqHeader: fw.redactHeaders(c.Request.Header),
+		}
+		if b, truncated := peekBody(c.Request, fw.captureCtl.maxBody); b != nil {
+			rec.Truncated = truncated
+			rec.ReqBody = fw.redactBody(b, c.ContentType())
+		}
+		w := &idempotencyWriter{ResponseWriter: c.Writer, max: fw.captureCtl.maxBody}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+
+		rec.RequestID = c.Param("_requestID")
+		rec.Duration = time.Since(start).Milliseconds()
+		rec.Status = w.Status()
+		rec.RespHeader = fw.redactHeaders(w.Header())
+		rec.RespBody = fw.redactBody(w.buf.Bytes(), w.Header().Get("Content-Type"))
+		rec.Truncated = rec.Truncated || w.overflow
+		select {
+		case fw.captureCtl.chanRecord <- rec:
+		default:
+		}
+	}
+}
+
+// captureWriter 写入采集记录
+func (fw *WMFrameWorkV2) captureWriter() {
+	for rec := range fw.captureCtl.chanRecord {
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					fw.WriteError("CAPTURE", fmt.Sprintf("capture writer crash: %+v", err))
+				}
+			}()
+			b, _ := json.Marshal(rec)
+			if fw.captureCtl.sink == CaptureSinkSQL {
+				if !fw.captureTable() {
+					return
+				}
+				if _, _, err := fw.dbCtl.client.Exec("insert into "+fw.captureCtl.table+" (cid,dt,method,uri,status,data) values (?,?,?,?,?,?)",
+					rec.ID, rec.Time, rec.Method, rec.URI, rec.Status, string(b)); err != nil {
+					fw.WriteError("CAPTURE", "write capture record error: "+err.Error())
+				}
+				return
+			}
+			fw.captureCtl.fileLocker.Lock()
+			defer fw.captureCtl.fileLocker.Unlock()
+			fw.captureCtl.fd = fw.rotateFile("CAPTURE", fw.captureCtl.file, fw.captureCtl.fd, fw.captureCtl.fileMaxSize, fw.captureCtl.fileKeepDays)
+			if fw.captureCtl.fd != nil {
+				fw.captureCtl.fd.Write(append(b, '\n'))
+			}
+		}()
+	}
+}
+
+// captureTable 创建采集数据表
+func (fw *WMFrameWorkV2) captureTable() bool {
+	if atomic.LoadInt32(&fw.captureCtl.tableReady) == 1 {
+		return true
+	}
+	if !fw.MysqlIsReady() {
+		return false
+	}
+	var s string
+	switch fw.dbCtl.driver {
+	case "mssql":
+		s = "IF OBJECT_ID(N'" + fw.captureCtl.table + "', N'U') IS NULL CREATE TABLE " + fw.captureCtl.table + ` (
+id BIGINT IDENTITY(1,1) PRIMARY KEY,
+cid NVARCHAR(50) NOT NULL,
+dt BIGINT NOT NULL,
+method NVARCHAR(10) NOT NULL,
+uri NVARCHAR(2000) NOT NULL,
+status INT NOT NULL,
+data NVARCHAR(MAX) NOT NULL);`
+	default:
+		s = "CREATE TABLE IF NOT EXISTS `" + fw.captureCtl.table + "` (" + `
+id BIGINT NOT NULL AUTO_INCREMENT,
+cid VARCHAR(50) NOT NULL,
+dt BIGINT NOT NULL,
+method VARCHAR(10) NOT NULL,
+uri VARCHAR(2000) NOT NULL,
+status INT NOT NULL,
+data MEDIUMTEXT NOT NULL,
+PRIMARY KEY (id),
+KEY idx_cid (cid),
+KEY idx_dt (dt)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`
+	}
+	if _, _, err := fw.dbCtl.client.Exec(s); err != nil {
+		fw.WriteError("CAPTURE", "create capture table error: "+err.Error())
+		return false
+	}
+	atomic.StoreInt32(&fw.captureCtl.tableReady, 1)
+	return true
+}
+
+// captureReset 清空采集数据
+func (fw *WMFrameWorkV2) captureReset() error {
+	if fw.captureCtl.sink == CaptureSinkSQL {
+		if !fw.captureTable() {
+			return fmt.Errorf("sql is not ready")
+		}
+		_, _, err := fw.dbCtl.client.Exec("delete from " + fw.captureCtl.table)
+		return err
+	}
+	fw.captureCtl.fileLocker.Lock()
+	defer fw.captureCtl.fileLocker.Unlock()
+	if fw.captureCtl.fd != nil {
+		fw.captureCtl.fd.Close()
+		fw.captureCtl.fd = nil
+	}
+	for _, v := range rotatedFiles(fw.captureCtl.file) {
+		if err := os.Remove(v); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// captureFilter 采集记录查询条件
+type captureFilter struct {
+	Method string `form:"method"`
+	// 路径前缀
+	Path   string `form:"path"`
+	Status int    `form:"status"`
+	// 最大返回数量，默认100，最大1000
+	Limit int `form:"limit" binding:"omitempty,gte=1,lte=1000"`
+}
+
+func (cf *captureFilter) match(rec *CaptureRecord) bool {
+	return (cf.Method == "" || strings.EqualFold(cf.Method, rec.Method)) &&
+		(cf.Path == "" || strings.HasPrefix(rec.URI, cf.Path)) &&
+		(cf.Status == 0 || cf.Status == rec.Status)
+}
+
+// captureList 按时间倒序查询采集记录
+// ids: 不为空时只查询指定记录
+func (fw *WMFrameWorkV2) captureList(cf *captureFilter, ids ...string) ([]*CaptureRecord, error) {
+	if len(ids) > 0 {
+		cf.Limit = len(ids)
+	}
+	if cf.Limit <= 0 {
+		cf.Limit = 100
+	}
+	want := make(map[string]bool, len(ids))
+	for _, v := range ids {
+		want[v] = true
+	}
+	recs := make([]*CaptureRecord, 0)
+	if fw.captureCtl.sink == CaptureSinkSQL {
+		if !fw.captureTable() {
+			return nil, fmt.Errorf("sql is not ready")
+		}
+		where := make([]string, 0)
+		params := make([]interface{}, 0)
+		if len(ids) > 0 {
+			where = append(where, "cid in (?"+strings.Repeat(",?", len(ids)-1)+")")
+			for _, v := range ids {
+				params = append(params, v)
+			}
+		}
+		if cf.Method != "" {
+			where = append(where, "method=?")
+			params = append(params, strings.ToUpper(cf.Method))
+		}
+		if cf.Path != "" {
+			where = append(where, "uri like ?")
+			params = append(params, cf.Path+"%")
+		}
+		if cf.Status > 0 {
+			where = append(where, "status=?")
+			params = append(params, cf.Status)
+		}
+		s := "select data from " + fw.captureCtl.table
+		if len(where) > 0 {
+			s += " where " + strings.Join(where, " and ")
+		}
+		ans, err := fw.dbCtl.client.QueryPB2(s+" order by id desc", cf.Limit, params...)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range ans.Rows {
+			rec := &CaptureRecord{}
+			if len(row.Cells) > 0 && json.Unmarshal([]byte(row.Cells[0]), rec) == nil {
+				recs = append(recs, rec)
+			}
+		}
+		return recs, nil
+	}
+	// 当前文件数量不足时继续查询重命名的文件
+	for _, name := range rotatedFiles(fw.captureCtl.file) {
+		ss, err := fw.scanCaptureFile(name, cf, want, cf.Limit-len(recs))
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, ss...)
+		if len(recs) >= cf.Limit {
+			break
+		}
+	}
+	return recs, nil
+}
+
+// scanCaptureFile 返回文件中最新的n条记录，按时间倒序
+func (fw *WMFrameWorkV2) scanCaptureFile(name string, cf *captureFilter, want map[string]bool, n int) ([]*CaptureRecord, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*CaptureRecord{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	recs := make([]*CaptureRecord, 0)
+	scan := bufio.NewScanner(f)
+	scan.Buffer(make([]byte, 64*1024), 4*fw.captureCtl.maxBody+64*1024)
+	for scan.Scan() {
+		rec := &CaptureRecord{}
+		if json.Unmarshal(scan.Bytes(), rec) != nil || (len(want) > 0 && !want[rec.ID]) || !cf.match(rec) {
+			continue
+		}
+		recs = append(recs, rec)
+		if len(recs) > n {
+			recs = recs[1:]
+		}
+	}
+	for i, j := 0, len(recs)-1; i < j; i, j = i+1, j-1 {
+		recs[i], recs[j] = recs[j], recs[i]
+	}
+	return recs, scan.Err()
+}
+
+// replayResult 回放结果
+type replayResult struct {
+	ID     string `json:"id"`
+	Method string `json:"method"`
+	URI    string `json:"uri"`
+	// 采集时的状态码
+	Status int `json:"status"`
+	// 回放的状态码
+	ReplayStatus int `json:"replay_status"`
+	// 状态码和body是否一致
+	Same   bool   `json:"same"`
+	Error  string `json:"error,omitempty"`
+	Replay string `json:"replay,omitempty"`
+}
+
+// replayHeaders 回放时沿用的采集请求头，其他请求头（包括认证信息）需由调用方在headers中指定
+var replayHeaders = []string{"content-type", "accept", "accept-language", "user-agent"}
+
+// replayTarget 检查回放目标是否在capture_replay_targets中
+func (fw *WMFrameWorkV2) replayTarget(target string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.User != nil {
+		return "", fmt.Errorf("target should be scheme://host:port")
+	}
+	target = u.Scheme + "://" + u.Host
+	for _, v := range fw.captureCtl.replayTargets {
+		if strings.EqualFold(strings.TrimSuffix(v, "/"), target) {
+			return target, nil
+		}
+	}
+	return "", fmt.Errorf("target %s is not in capture_replay_targets", target)
+}
+
+// replayClient 回放使用的http客户端，校验服务端证书，不提供框架证书，不跟随跳转
+func (fw *WMFrameWorkV2) replayClient(timeo time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeo,
+		Transport: &http.Transport{
+			DialTLSContext: fw.dialTLS(nil, false, time.Second*5),
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// captureReplay 将采集的请求发送到其他实例，比较状态码和返回body
+// 请求不使用框架证书，只沿用采集的Content-Type等请求头，认证信息需由调用方指定
+// 参数json：
+//
+//	target: 目标地址，需在capture_replay_targets中，如https://192.168.1.10:6819
+//	ids: 回放的采集记录id
+//	headers: 追加的请求头，如User-Token
+//	ignore: 比较json返回时忽略的字段，如request_id
+//	timeout: 单个请求的超时（秒），默认30
+func (fw *WMFrameWorkV2) captureReplay(c *gin.Context) {
+	var req struct {
+		Target  string            `json:"target" binding:"required"`
+		IDs     []string          `json:"ids" binding:"required,min=1,max=500"`
+		Headers map[string]string `json:"headers"`
+		Ignore  []string          `json:"ignore"`
+		Timeout int               `json:"timeout"`
+	}
+	if !fw.Bind(c, &req) {
+		return
+	}
+	target, err := fw.replayTarget(req.Target)
+	if err != nil {
+		fw.Fail(c, ErrForbidden, err)
+		return
+	}
+	timeo := time.Second * time.Duration(req.Timeout)
+	if timeo <= 0 {
+		timeo = trTimeo
+	}
+	recs, err := fw.captureList(&captureFilter{}, req.IDs...)
+	if err != nil {
+		fw.Fail(c, ErrInternal, err)
+		return
+	}
+	found := make(map[string]*CaptureRecord, len(recs))
+	for _, v := range recs {
+		found[v.ID] = v
+	}
+	client := fw.replayClient(timeo)
+	results := make([]*replayResult, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		rec, ok := found[id]
+		if !ok {
+			results = append(results, &replayResult{ID: id, Error: "capture not found"})
+			continue
+		}
+		res := &replayResult{ID: id, Method: rec.Method, URI: rec.URI, Status: rec.Status}
+		results = append(results, res)
+		if rec.Truncated {
+			res.Error = "capture is truncated"
+			continue
+		}
+		r, err := http.NewRequest(rec.Method, target+rec.URI, strings.NewReader(rec.ReqBody))
+		if err != nil {
+			res.Error = err.Error()
+			continue
+		}
+		for k, v := range rec.ReqHeader {
+			if containsString(replayHeaders, strings.ToLower(k)) && v != "***" {
+				r.Header.Set(k, v)
+			}
+		}
+		for k, v := range req.Headers {
+			r.Header.Set(k, v)
+		}
+		sc, b, err := doReplay(client, r)
+		if err != nil {
+			res.Error = err.Error()
+			continue
+		}
+		res.ReplayStatus = sc
+		res.Same = sc == rec.Status && sameBody(rec.RespBody, fw.redactBody(b, http.DetectContentType(b)), req.Ignore)
+		if !res.Same {
+			res.Replay = string(b)
+		}
+	}
+	fw.OK(c, results)
+}
+
+func doReplay(client *http.Client, r *http.Request) (int, []byte, error) {
+	resp, err := client.Do(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, b, err
+}
+
+// sameBody 比较返回body，json按内容比较并忽略指定字段
+func sameBody(a, b string, ignore []string) bool {
+	if !gjson.Valid(a) || !gjson.Valid(b) {
+		return a == b
+	}
+	for _, v := range ignore {
+		a, _ = sjson.Delete(a, v)
+		b, _ = sjson.Delete(b, v)
+	}
+	var x, y interface{}
+	json.Unmarshal([]byte(a), &x)
+	json.Unmarshal([]byte(b), &y)
+	return reflect.DeepEqual(x, y)
+}
+
+// ViewCaptureConfig 查看流量采集配置，返回json字符串
+func (fw *WMFrameWorkV2) ViewCaptureConfig() string {
+	return fw.captureCtl.forshow
+}
@@ -0,0 +1,186 @@
+package wmv2
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/xyzj/gopsu"
+)
+
+func TestSameBody(t *testing.T) {
+	cases := []struct {
+		a, b   string
+		ignore []string
+		want   bool
+	}{
+		{`{"a":1,"b":[1,2]}`, `{"b":[1,2],"a":1}`, nil, true},
+		{`{"a":1,"request_id":"x"}`, `{"a":1,"request_id":"y"}`, []string{"request_id"}, true},
+		{`{"a":1,"request_id":"x"}`, `{"a":1,"request_id":"y"}`, nil, false},
+		{`{"a":{"t":1,"v":2}}`, `{"a":{"t":3,"v":2}}`, []string{"a.t"}, true},
+		{`text`, `text`, nil, true},
+		{`text`, `{"a":1}`, nil, false},
+	}
+	for i, v := range cases {
+		if got := sameBody(v.a, v.b, v.ignore); got != v.want {
+			t.Errorf("case %d: got %v", i, got)
+		}
+	}
+}
+
+func TestPeekBody(t *testing.T) {
+	r, _ := http.NewRequest("POST", "/", ioutil.NopCloser(strings.NewReader("0123456789")))
+	b, truncated := peekBody(r, 4)
+	if string(b) != "0123" || !truncated {
+		t.Fatalf("got %q %v", b, truncated)
+	}
+	if all, _ := ioutil.ReadAll(r.Body); string(all) != "0123456789" {
+		t.Fatalf("body lost, got %q", all)
+	}
+	r, _ = http.NewRequest("POST", "/", strings.NewReader("0123"))
+	if b, truncated := peekBody(r, 4); string(b) != "0123" || truncated {
+		t.Fatalf("got %q %v", b, truncated)
+	}
+}
+
+func TestReplayTarget(t *testing.T) {
+	fw := &WMFrameWorkV2{captureCtl: &captureConfigure{replayTargets: []string{"https://10.0.0.1:6819"}}}
+	if s, err := fw.replayTarget("https://10.0.0.1:6819/"); err != nil || s != "https://10.0.0.1:6819" {
+		t.Fatalf("got %q %v", s, err)
+	}
+	for _, v := range []string{"https://10.0.0.2:6819", "http://10.0.0.1:6819", "https://10.0.0.1:6819/x", "https://u:p@10.0.0.1:6819", "10.0.0.1:6819"} {
+		if _, err := fw.replayTarget(v); err == nil {
+			t.Errorf("%s should be rejected", v)
+		}
+	}
+}
+
+func TestCaptureReplay(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var gotToken, gotAuth string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotToken, gotAuth = r.Header.Get("User-Token"), r.Header.Get("X-Custom-Auth")
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"echo":` + string(b) + `,"request_id":"new"}`))
+	}))
+	defer target.Close()
+	fw := &WMFrameWorkV2{captureCtl: &captureConfigure{
+		file:          filepath.Join(t.TempDir(), "capture.jsonl"),
+		replayTargets: []string{target.URL},
+		maxBody:       1024,
+	}}
+	recs := []*CaptureRecord{
+		{ID: "a", Method: "POST", URI: "/x", Status: 200, ReqHeader: map[string]string{"Content-Type": "application/json", "X-Custom-Auth": "secret"}, ReqBody: `{"n":1}`, RespBody: `{"echo":{"n":1},"request_id":"old"}`},
+		{ID: "b", Method: "POST", URI: "/x", Status: 200, ReqBody: `{"n":2}`, RespBody: `{"echo":{"n":3}}`},
+	}
+	var buf bytes.Buffer
+	for _, v := range recs {
+		b, _ := json.Marshal(v)
+		buf.Write(append(b, '\n'))
+	}
+	ioutil.WriteFile(fw.captureCtl.file, buf.Bytes(), 0644)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest("POST", "/capture/replay", strings.NewReader(`{"target":"`+target.URL+`","ids":["a","b","c"],"headers":{"User-Token":"t"},"ignore":["request_id"]}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+	fw.captureReplay(c)
+	ans := gjson.Parse(w.Body.String())
+	if w.Code != 200 || ans.Get("data.#").Int() != 3 {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+	if !ans.Get("data.0.same").Bool() || ans.Get("data.1.same").Bool() || ans.Get("data.2.error").String() != "capture not found" {
+		t.Fatalf("unexpected results %s", w.Body.String())
+	}
+	// 只发送调用方指定的认证信息
+	if gotToken != "t" || gotAuth != "" {
+		t.Fatalf("unexpected headers %q %q", gotToken, gotAuth)
+	}
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest("POST", "/capture/replay", strings.NewReader(`{"target":"http://127.0.0.1:1","ids":["a"]}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+	fw.captureReplay(c)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("target not in list: got %d", w.Code)
+	}
+}
+
+func TestCaptureFileRotate(t *testing.T) {
+	fw := &WMFrameWorkV2{wmLog: &gopsu.NilLogger{}, captureCtl: &captureConfigure{
+		file:         filepath.Join(t.TempDir(), "capture.jsonl"),
+		fileMaxSize:  200,
+		fileKeepDays: 7,
+		maxBody:      1024,
+		chanRecord:   make(chan *CaptureRecord, 10),
+	}}
+	for i := 0; i < 10; i++ {
+		fw.captureCtl.chanRecord <- &CaptureRecord{ID: "r" + strconv.Itoa(i), Method: "GET", URI: "/x", Status: 200, RespBody: strings.Repeat("x", 40)}
+	}
+	close(fw.captureCtl.chanRecord)
+	fw.captureWriter()
+	if files := rotatedFiles(fw.captureCtl.file); len(files) < 3 {
+		t.Fatalf("file not rotated: %v", files)
+	}
+	recs, err := fw.captureList(&captureFilter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 10 || recs[0].ID != "r9" || recs[9].ID != "r0" {
+		t.Fatalf("unexpected records %d", len(recs))
+	}
+	// 重命名的文件中的记录仍可查看
+	if recs, _ = fw.captureList(&captureFilter{}, "r0"); len(recs) != 1 || recs[0].ID != "r0" {
+		t.Fatalf("get from rotated file: %v", recs)
+	}
+	if err := fw.captureReset(); err != nil {
+		t.Fatal(err)
+	}
+	if recs, _ = fw.captureList(&captureFilter{}); len(recs) != 0 {
+		t.Fatalf("reset should remove rotated files: %d", len(recs))
+	}
+}
+
+func TestCaptureToggle(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fw := &WMFrameWorkV2{captureCtl: &captureConfigure{sample: 1, maxBody: 1024, chanRecord: make(chan *CaptureRecord, 100)}}
+	r := gin.New()
+	r.GET("/capture/:do", fw.captureAdmin)
+	r.GET("/x", fw.Capture(), func(c *gin.Context) {})
+	done := make(chan struct{})
+	go func() {
+		// 切换与采集同时进行，-race时检查数据竞争
+		for i := 0; i < 50; i++ {
+			webGet(r, "/x", nil)
+		}
+		close(done)
+	}()
+	for i := 0; i < 50; i++ {
+		webGet(r, "/capture/on", nil)
+		webGet(r, "/capture/off", nil)
+	}
+	<-done
+	for len(fw.captureCtl.chanRecord) > 0 {
+		<-fw.captureCtl.chanRecord
+	}
+	webGet(r, "/capture/on", nil)
+	webGet(r, "/x", nil)
+	if len(fw.captureCtl.chanRecord) != 1 {
+		t.Fatal("capture on: record not queued")
+	}
+	webGet(r, "/capture/off", nil)
+	webGet(r, "/x", nil)
+	if len(fw.captureCtl.chanRecord) != 1 {
+		t.Fatal("capture off: record queued")
+	}
+}
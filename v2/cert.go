@@ -0,0 +1,435 @@
+package wmv2
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/sjson"
+	"github.com/xyzj/gopsu"
+	"golang.org/x/crypto/acme"
+)
+
+// ACME验证方式
+const (
+	// ACMEHTTP01 http-01验证，需要acme服务能访问本机acme_http_port端口
+	ACMEHTTP01 = "http-01"
+	// ACMEDNS01 dns-01验证，需要通过RegisterDNSProvider注册对应的dns服务
+	ACMEDNS01 = "dns-01"
+)
+
+// DNSProvider dns-01验证使用的dns服务，负责添加和删除TXT记录
+type DNSProvider interface {
+	// Present 添加TXT记录，fqdn格式如_acme-challenge.example.com.
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp 删除TXT记录
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+var (
+	dnsProviders       = make(map[string]DNSProvider)
+	dnsProvidersLocker sync.RWMutex
+)
+
+// RegisterDNSProvider 注册dns服务，配置acme_dns_provider为name时使用
+func RegisterDNSProvider(name string, p DNSProvider) {
+	dnsProvidersLocker.Lock()
+	defer dnsProvidersLocker.Unlock()
+	dnsProviders[name] = p
+}
+
+// 证书配置
+type certConfigure struct {
+	forshow string
+	// 证书文件
+	certfile string
+	keyfile  string
+	// 当前使用的证书，*tls.Certificate
+	cert atomic.Value
+	// 是否启用acme
+	acme bool
+	// 申请证书的域名
+	domains []string
+	// 账号邮箱
+	email string
+	// acme服务目录地址
+	directory string
+	// acme服务的根证书，用于测试环境，如pebble
+	caRoot string
+	// 验证方式
+	challenge string
+	// dns服务名称
+	dnsProvider string
+	// dns记录生效等待时长
+	dnsWait time.Duration
+	// http-01验证端口
+	httpPort int
+	// http-01验证的token-keyAuth
+	tokens sync.Map
+	// 到期前多久更新证书并告警
+	renewBefore time.Duration
+	// 申请证书中
+	obtaining int32
+}
+
+func (conf *certConfigure) show() string {
+	conf.forshow, _ = sjson.Set("", "acme", conf.acme)
+	conf.forshow, _ = sjson.Set(conf.forshow, "domains", conf.domains)
+	conf.forshow, _ = sjson.Set(conf.forshow, "directory", conf.directory)
+	conf.forshow, _ = sjson.Set(conf.forshow, "challenge", conf.challenge)
+	conf.forshow, _ = sjson.Set(conf.forshow, "dns_provider", conf.dnsProvider)
+	conf.forshow, _ = sjson.Set(conf.forshow, "renew_before", conf.renewBefore.String())
+	return conf.forshow
+}
+
+// getCertificate 用于tls.Config.GetCertificate，返回当前证书
+func (conf *certConfigure) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c, ok := conf.cert.Load().(*tls.Certificate); ok && c != nil {
+		return c, nil
+	}
+	return nil, fmt.Errorf("no certificate available")
+}
+
+// notAfter 当前证书到期时间
+func (conf *certConfigure) notAfter() time.Time {
+	c, ok := conf.cert.Load().(*tls.Certificate)
+	if !ok || c == nil || c.Leaf == nil {
+		return time.Time{}
+	}
+	return c.Leaf.NotAfter
+}
+
+// loadCert 读取证书文件，成功后替换当前证书
+func (conf *certConfigure) loadCert() error {
+	cert, err := tls.LoadX509KeyPair(conf.certfile, conf.keyfile)
+	if err != nil {
+		return err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	conf.cert.Store(&cert)
+	return nil
+}
+
+func (fw *WMFrameWorkV2) loadCertConfig(certfile, keyfile string) {
+	fw.certCtl.certfile = certfile
+	fw.certCtl.keyfile = keyfile
+	fw.certCtl.acme, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("acme_enable", "false", "是否使用acme自动申请https证书"))
+	domainName, _ := fw.wmConf.GetItem("domain_name")
+	fw.certCtl.domains = splitConfigList(fw.wmConf.GetItemDefault("acme_domains", domainName, "申请证书的域名，用`,`分割多个域名，默认使用domain_name"))
+	fw.certCtl.email = fw.wmConf.GetItemDefault("acme_email", "", "acme账号邮箱，用于接收证书到期通知")
+	fw.certCtl.directory = fw.wmConf.GetItemDefault("acme_directory", acme.LetsEncryptURL, "acme服务目录地址，测试时可使用pebble等服务")
+	fw.certCtl.caRoot = fw.wmConf.GetItemDefault("acme_ca_root", "", "acme服务的根证书文件，acme服务使用自签名证书时设置")
+	fw.certCtl.challenge = fw.wmConf.GetItemDefault("acme_challenge", ACMEHTTP01, "acme验证方式，http-01或dns-01")
+	fw.certCtl.dnsProvider = fw.wmConf.GetItemDefault("acme_dns_provider", "", "dns-01验证使用的dns服务名称，需通过RegisterDNSProvider注册")
+	fw.certCtl.dnsWait = time.Second * time.Duration(gopsu.String2Int(fw.wmConf.GetItemDefault("acme_dns_wait", "30", "dns-01验证添加记录后等待生效的时长（秒）"), 10))
+	fw.certCtl.httpPort = gopsu.String2Int(fw.wmConf.GetItemDefault("acme_http_port", "80", "http-01验证的监听端口"), 10)
+	fw.certCtl.renewBefore = time.Hour * 24 * time.Duration(gopsu.String2Int(fw.wmConf.GetItemDefault("cert_renew_days", "30", "证书到期前多少天开始告警，启用acme时自动更新"), 10))
+	fw.wmConf.Save()
+	if fw.certCtl.acme && len(fw.certCtl.domains) > 0 && domainName == "" {
+		// 未设置domain_name时，证书保存为第一个域名
+		name := strings.TrimPrefix(fw.certCtl.domains[0], "*.")
+		fw.certCtl.certfile = filepath.Join(fw.baseCAPath, name+".crt")
+		fw.certCtl.keyfile = filepath.Join(fw.baseCAPath, name+".key")
+	}
+	fw.certCtl.show()
+}
+
+// acmeClient 创建acme客户端，账号密钥保存在ca目录
+func (fw *WMFrameWorkV2) acmeClient(ctx context.Context) (*acme.Client, error) {
+	keyfile := filepath.Join(fw.baseCAPath, "acme-account.key")
+	var key crypto.Signer
+	if b, err := ioutil.ReadFile(keyfile); err == nil {
+		if p, _ := pem.Decode(b); p != nil {
+			key, _ = x509.ParseECPrivateKey(p.Bytes)
+		}
+	}
+	if key == nil {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		b, _ := x509.MarshalECPrivateKey(k)
+		if err := ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600); err != nil {
+			return nil, err
+		}
+		key = k
+	}
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: fw.certCtl.directory,
+		UserAgent:    "wlstmicro/" + fw.serverName,
+	}
+	if fw.certCtl.caRoot != "" {
+		pool := fw.rootCAPool()
+		b, err := ioutil.ReadFile(fw.certCtl.caRoot)
+		if err != nil {
+			return nil, err
+		}
+		pool.AppendCertsFromPEM(b)
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		}
+	}
+	acct := &acme.Account{}
+	if fw.certCtl.email != "" {
+		acct.Contact = []string{"mailto:" + fw.certCtl.email}
+	}
+	if _, err := client.Register(ctx, acct, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, err
+	}
+	return client, nil
+}
+
+// presentChallenge 准备验证，返回清理方法
+func (fw *WMFrameWorkV2) presentChallenge(ctx context.Context, client *acme.Client, domain string, chal *acme.Challenge) (func(), error) {
+	switch chal.Type {
+	case ACMEHTTP01:
+		resp, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+		fw.certCtl.tokens.Store(chal.Token, resp)
+		return func() { fw.certCtl.tokens.Delete(chal.Token) }, nil
+	case ACMEDNS01:
+		dnsProvidersLocker.RLock()
+		p, ok := dnsProviders[fw.certCtl.dnsProvider]
+		dnsProvidersLocker.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("dns provider %s not registered", fw.certCtl.dnsProvider)
+		}
+		value, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+		fqdn := "_acme-challenge." + strings.TrimPrefix(domain, "*.") + "."
+		if err := p.Present(ctx, fqdn, value); err != nil {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(fw.certCtl.dnsWait):
+		}
+		return func() {
+			cctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+			defer cancel()
+			p.CleanUp(cctx, fqdn, value)
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported challenge %s", chal.Type)
+}
+
+// obtainCert 通过acme申请证书，保存到证书文件并替换当前证书
+func (fw *WMFrameWorkV2) obtainCert() error {
+	if !atomic.CompareAndSwapInt32(&fw.certCtl.obtaining, 0, 1) {
+		return fmt.Errorf("certificate is being obtained")
+	}
+	defer atomic.StoreInt32(&fw.certCtl.obtaining, 0)
+	if len(fw.certCtl.domains) == 0 {
+		return fmt.Errorf("acme_domains is not configured")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+	defer cancel()
+	client, err := fw.acmeClient(ctx)
+	if err != nil {
+		return err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(fw.certCtl.domains...))
+	if err != nil {
+		return err
+	}
+	for _, u := range order.AuthzURLs {
+		z, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			return err
+		}
+		if z.Status == acme.StatusValid {
+			continue
+		}
+		var chal *acme.Challenge
+		for _, c := range z.Challenges {
+			if c.Type == fw.certCtl.challenge {
+				chal = c
+				break
+			}
+		}
+		if chal == nil {
+			return fmt.Errorf("no %s challenge for %s", fw.certCtl.challenge, z.Identifier.Value)
+		}
+		cleanup, err := fw.presentChallenge(ctx, client, z.Identifier.Value, chal)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		if _, err := client.Accept(ctx, chal); err != nil {
+			return err
+		}
+		if _, err := client.WaitAuthorization(ctx, z.URI); err != nil {
+			return err
+		}
+	}
+	orderURI := order.URI
+	if order, err = client.WaitOrder(ctx, orderURI); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: fw.certCtl.domains[0]},
+		DNSNames: fw.certCtl.domains,
+	}, key)
+	if err != nil {
+		return err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		// 部分acme服务（如pebble）签发中的订单不返回Location，使用原订单地址等待签发
+		o, e := client.WaitOrder(ctx, orderURI)
+		if e != nil || o.CertURL == "" {
+			return err
+		}
+		if der, err = client.FetchCert(ctx, o.CertURL, true); err != nil {
+			return err
+		}
+	}
+	var certPEM []byte
+	for _, b := range der {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	kb, _ := x509.MarshalECPrivateKey(key)
+	if err := writeFileAtomic(fw.certCtl.keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(fw.certCtl.certfile, certPEM, 0644); err != nil {
+		return err
+	}
+	return fw.certCtl.loadCert()
+}
+
+// writeFileAtomic 先写临时文件再重命名，避免读取到不完整的文件
+func writeFileAtomic(name string, b []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// acmeHTTPServer http-01验证服务
+func (fw *WMFrameWorkV2) acmeHTTPServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/acme-challenge/", func(w http.ResponseWriter, r *http.Request) {
+		if v, ok := fw.certCtl.tokens.Load(strings.TrimPrefix(r.URL.Path, "/.well-known/acme-challenge/")); ok {
+			w.Write([]byte(v.(string)))
+			return
+		}
+		http.NotFound(w, r)
+	})
+	s := &http.Server{
+		Addr:         fmt.Sprintf(":%d", fw.certCtl.httpPort),
+		Handler:      mux,
+		ReadTimeout:  time.Second * 10,
+		WriteTimeout: time.Second * 10,
+	}
+	if err := s.ListenAndServe(); err != nil {
+		fw.WriteError("ACME", "Failed start http-01 server at :"+strconv.Itoa(fw.certCtl.httpPort)+"|"+err.Error())
+	}
+}
+
+// initCert 读取证书，启用acme且证书不可用或即将到期时申请证书
+func (fw *WMFrameWorkV2) initCert() error {
+	err := fw.certCtl.loadCert()
+	if !fw.certCtl.acme {
+		return err
+	}
+	if fw.certCtl.challenge == ACMEHTTP01 {
+		go fw.acmeHTTPServer()
+	}
+	if err == nil && time.Until(fw.certCtl.notAfter()) > fw.certCtl.renewBefore {
+		return nil
+	}
+	if e := fw.obtainCert(); e != nil {
+		fw.WriteError("ACME", "Failed obtain certificate|"+e.Error())
+		// 已有证书时继续使用，由后台重试
+		return err
+	}
+	fw.WriteSystem("ACME", "Success obtain certificate for "+strings.Join(fw.certCtl.domains, ","))
+	return nil
+}
+
+// checkCert 检查证书有效期，即将到期时告警，启用acme时更新证书
+func (fw *WMFrameWorkV2) checkCert() {
+	na := fw.certCtl.notAfter()
+	if na.IsZero() {
+		return
+	}
+	left := time.Until(na)
+	switch {
+	case left <= 0:
+		fw.WriteError("CERT", "certificate expired at "+na.Format(gopsu.LongTimeFormat))
+	case left < fw.certCtl.renewBefore:
+		fw.WriteWarning("CERT", fmt.Sprintf("certificate will expire at %s, %d days left", na.Format(gopsu.LongTimeFormat), int(left.Hours()/24)))
+	default:
+		return
+	}
+	if !fw.certCtl.acme {
+		return
+	}
+	if err := fw.obtainCert(); err != nil {
+		fw.WriteError("ACME", "Failed renew certificate|"+err.Error())
+		return
+	}
+	fw.WriteSystem("ACME", "Success renew certificate for "+strings.Join(fw.certCtl.domains, ","))
+}
+
+// certMetrics 证书到期时间，prometheus文本格式
+func (fw *WMFrameWorkV2) certMetrics(c *gin.Context) {
+	var expiry int64
+	if na := fw.certCtl.notAfter(); !na.IsZero() {
+		expiry = na.Unix()
+	}
+	c.String(http.StatusOK, "# HELP wlst_cert_expiry_timestamp_seconds https certificate not after time\n# TYPE wlst_cert_expiry_timestamp_seconds gauge\nwlst_cert_expiry_timestamp_seconds{server=%q} %d\n", fw.serverName, expiry)
+}
+
+// CertExpireAt 返回https证书到期时间，未使用证书时返回零值
+func (fw *WMFrameWorkV2) CertExpireAt() time.Time {
+	return fw.certCtl.notAfter()
+}
+
+// ViewCertConfig 查看证书配置,返回json字符串
+func (fw *WMFrameWorkV2) ViewCertConfig() string {
+	return fw.certCtl.forshow
+}
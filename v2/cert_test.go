@@ -0,0 +1,62 @@
+package wmv2
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestObtainCertPebble 使用pebble测试acme申请证书
+// pebble需设置PEBBLE_VA_ALWAYS_VALID=1跳过验证，如：
+//
+//	PEBBLE_VA_ALWAYS_VALID=1 pebble -config test/config/pebble-config.json
+//	WMV2_ACME_DIRECTORY=https://127.0.0.1:14000/dir WMV2_ACME_CA_ROOT=test/certs/pebble.minica.pem go test -run Pebble
+func TestObtainCertPebble(t *testing.T) {
+	directory := os.Getenv("WMV2_ACME_DIRECTORY")
+	if directory == "" {
+		t.Skip("WMV2_ACME_DIRECTORY is not set")
+	}
+	dir := t.TempDir()
+	fw := &WMFrameWorkV2{
+		serverName: "acme-test",
+		baseCAPath: dir,
+		certCtl: &certConfigure{
+			certfile:    filepath.Join(dir, "test.crt"),
+			keyfile:     filepath.Join(dir, "test.key"),
+			acme:        true,
+			domains:     []string{"acme-test.example.com"},
+			directory:   directory,
+			caRoot:      os.Getenv("WMV2_ACME_CA_ROOT"),
+			challenge:   ACMEHTTP01,
+			renewBefore: time.Hour * 24 * 30,
+		},
+	}
+	if err := fw.obtainCert(); err != nil {
+		t.Fatal(err)
+	}
+	na := fw.CertExpireAt()
+	if na.IsZero() || time.Until(na) < time.Hour {
+		t.Fatalf("unexpected not after %v", na)
+	}
+	if err := fw.certCtl.loadCert(); err != nil {
+		t.Fatalf("saved certificate is invalid: %v", err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "a.pem")
+	if err := writeFileAtomic(name, []byte("1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(name, []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(name)
+	if string(b) != "2" {
+		t.Fatalf("got %q", b)
+	}
+	if _, err := os.Stat(name + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("temp file should be renamed")
+	}
+}
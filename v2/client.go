@@ -0,0 +1,333 @@
+package wmv2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tidwall/sjson"
+	"github.com/xyzj/gopsu"
+)
+
+// CallErrKind 服务调用错误类型
+type CallErrKind string
+
+const (
+	// CallErrTimeout 超时
+	CallErrTimeout CallErrKind = "timeout"
+	// CallErrRefused 连接被拒绝
+	CallErrRefused CallErrKind = "refused"
+	// CallErrUpstream 上游服务返回5xx
+	CallErrUpstream CallErrKind = "upstream"
+	// CallErrCircuitOpen 熔断中
+	CallErrCircuitOpen CallErrKind = "circuit_open"
+	// CallErrNoInstance 找不到可用的服务实例
+	CallErrNoInstance CallErrKind = "no_instance"
+	// CallErrOther 其他错误
+	CallErrOther CallErrKind = "other"
+)
+
+// CallError 服务调用错误
+type CallError struct {
+	// 错误类型
+	Kind CallErrKind
+	// 服务名称
+	Service string
+	// 最后一次请求的实例地址
+	Target string
+	// 上游返回的状态码，5xx时有效
+	StatusCode int
+	// 原始错误
+	Err error
+}
+
+func (e *CallError) Error() string {
+	s := "call " + e.Service + " " + string(e.Kind)
+	if e.Target != "" {
+		s += " at " + e.Target
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+// Unwrap 返回原始错误
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+// CallOption 服务调用参数
+type CallOption struct {
+	// 额外请求头
+	Header http.Header
+	// 单次请求超时，默认使用tr_timeo
+	Timeout time.Duration
+	// 最大重试次数，<0不重试，0使用配置值
+	Retry int
+	// 非幂等请求是否也在5xx或超时时重试，默认仅在连接被拒绝时重试
+	RetryNonIdempotent bool
+}
+
+// 服务调用配置
+type serviceClientConfigure struct {
+	forshow string
+	// 默认重试次数
+	retry int
+	// 退避基础时长
+	backoffBase time.Duration
+	// 退避最大时长
+	backoffMax time.Duration
+	// 连续失败多少次后熔断
+	cbFailures int
+	// 熔断时长
+	cbOpen time.Duration
+	// 各实例的熔断器
+	breakers sync.Map
+}
+
+func (conf *serviceClientConfigure) show() string {
+	conf.forshow, _ = sjson.Set("", "retry", conf.retry)
+	conf.forshow, _ = sjson.Set(conf.forshow, "backoff_base", conf.backoffBase.String())
+	conf.forshow, _ = sjson.Set(conf.forshow, "backoff_max", conf.backoffMax.String())
+	conf.forshow, _ = sjson.Set(conf.forshow, "cb_failures", conf.cbFailures)
+	conf.forshow, _ = sjson.Set(conf.forshow, "cb_open", conf.cbOpen.String())
+	return conf.forshow
+}
+
+// 熔断器
+type circuitBreaker struct {
+	locker   sync.Mutex
+	failures int
+	openAt   time.Time
+	// 半开状态下是否已有探测请求
+	probing bool
+}
+
+// allow 判断是否允许请求，熔断时长过后放行一个探测请求
+func (b *circuitBreaker) allow(threshold int, open time.Duration) bool {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	if b.failures < threshold {
+		return true
+	}
+	if time.Since(b.openAt) < open || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) done(success bool, threshold int) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	b.probing = false
+	if success {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= threshold {
+		b.openAt = time.Now()
+	}
+}
+
+func (fw *WMFrameWorkV2) loadServiceClientConfig() {
+	fw.svcCtl.retry = gopsu.String2Int(fw.wmConf.GetItemDefault("svc_retry", "2", "服务间调用失败时的最大重试次数"), 10)
+	fw.svcCtl.backoffBase = time.Millisecond * time.Duration(gopsu.String2Int(fw.wmConf.GetItemDefault("svc_backoff_base", "100", "服务间调用重试退避基础时长（毫秒）"), 10))
+	fw.svcCtl.backoffMax = time.Millisecond * time.Duration(gopsu.String2Int(fw.wmConf.GetItemDefault("svc_backoff_max", "2000", "服务间调用重试退避最大时长（毫秒）"), 10))
+	fw.svcCtl.cbFailures = gopsu.String2Int(fw.wmConf.GetItemDefault("svc_cb_failures", "5", "单个服务实例连续失败多少次后熔断"), 10)
+	fw.svcCtl.cbOpen = time.Second * time.Duration(gopsu.String2Int(fw.wmConf.GetItemDefault("svc_cb_open", "30", "服务实例熔断时长（秒）"), 10))
+	fw.wmConf.Save()
+	if fw.svcCtl.cbFailures < 1 {
+		fw.svcCtl.cbFailures = 5
+	}
+	fw.svcCtl.show()
+}
+
+func (fw *WMFrameWorkV2) breaker(target string) *circuitBreaker {
+	b, _ := fw.svcCtl.breakers.LoadOrStore(target, &circuitBreaker{})
+	return b.(*circuitBreaker)
+}
+
+// backoff 指数退避，带随机抖动
+func (fw *WMFrameWorkV2) backoff(ctx context.Context, attempt int) error {
+	d := fw.svcCtl.backoffBase << uint(attempt)
+	if d <= 0 || d > fw.svcCtl.backoffMax {
+		d = fw.svcCtl.backoffMax
+	}
+	if d > 0 {
+		d = d/2 + time.Duration(rand.Int63n(int64(d)/2+1))
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func isIdempotent(method string) bool {
+	switch strings.ToUpper(method) {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE", "TRACE":
+		return true
+	}
+	return false
+}
+
+// classifyError 区分超时和连接被拒绝
+func classifyError(err error) CallErrKind {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return CallErrTimeout
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return CallErrTimeout
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return CallErrRefused
+	}
+	return CallErrOther
+}
+
+// pickInstance 优先选取未尝试过的服务实例
+func (fw *WMFrameWorkV2) pickInstance(svrName string, tried map[string]bool) (string, error) {
+	ins, err := fw.PickAll(svrName)
+	if err != nil {
+		return "", err
+	}
+	fresh := make([]*Instance, 0, len(ins))
+	for _, v := range ins {
+		if !tried[v.URL()] {
+			fresh = append(fresh, v)
+		}
+	}
+	// 没有新实例时仍在所有实例中选取
+	if len(fresh) == 0 {
+		fresh = ins
+	}
+	return fw.lb.pick(svrName, fresh, "", "").URL(), nil
+}
+
+// CallService 调用其他服务，通过etcd选取实例，失败时更换实例进行重试，并对失败实例进行熔断
+// ctx: 整体超时控制，到期后不再重试
+// svrName: 服务名称
+// method: http方法
+// path: 请求路径，包含query参数，如/usermanager/v1/user?id=1
+// body: 请求内容，可为nil
+// opt: 调用参数，可为nil
+// 返回statusCode, body, headers, error，error为*CallError
+func (fw *WMFrameWorkV2) CallService(ctx context.Context, svrName, method, path string, body []byte, opt *CallOption) (int, []byte, http.Header, error) {
+	if opt == nil {
+		opt = &CallOption{}
+	}
+	retry := opt.Retry
+	if retry == 0 {
+		retry = fw.svcCtl.retry
+	}
+	if retry < 0 {
+		retry = 0
+	}
+	timeo := opt.Timeout
+	if timeo <= 0 {
+		timeo = trTimeo
+	}
+	idempotent := isIdempotent(method) || opt.RetryNonIdempotent
+	tried := make(map[string]bool)
+	var lastErr *CallError
+	for attempt := 0; attempt <= retry; attempt++ {
+		if attempt > 0 {
+			if err := fw.backoff(ctx, attempt-1); err != nil {
+				break
+			}
+		}
+		addr, err := fw.pickInstance(svrName, tried)
+		if err != nil {
+			lastErr = &CallError{Kind: CallErrNoInstance, Service: svrName, Err: err}
+			continue
+		}
+		tried[addr] = true
+		b := fw.breaker(addr)
+		if !b.allow(fw.svcCtl.cbFailures, fw.svcCtl.cbOpen) {
+			lastErr = &CallError{Kind: CallErrCircuitOpen, Service: svrName, Target: addr}
+			continue
+		}
+		sc, rb, h, err := fw.callOnce(ctx, addr, method, path, body, opt.Header, timeo)
+		if err == nil && sc < 500 {
+			b.done(true, fw.svcCtl.cbFailures)
+			return sc, rb, h, nil
+		}
+		b.done(false, fw.svcCtl.cbFailures)
+		if err != nil {
+			lastErr = &CallError{Kind: classifyError(err), Service: svrName, Target: addr, Err: err}
+		} else {
+			lastErr = &CallError{Kind: CallErrUpstream, Service: svrName, Target: addr, StatusCode: sc}
+		}
+		fw.WriteWarning("HTTP SVC", lastErr.Error())
+		if ctx.Err() != nil {
+			break
+		}
+		// 非幂等请求只有在连接被拒绝，即请求未发出时才重试
+		if !idempotent && lastErr.Kind != CallErrRefused {
+			if err == nil {
+				return sc, rb, h, lastErr
+			}
+			break
+		}
+		if attempt == retry && err == nil {
+			return sc, rb, h, lastErr
+		}
+	}
+	if lastErr == nil {
+		lastErr = &CallError{Kind: CallErrTimeout, Service: svrName, Err: ctx.Err()}
+	}
+	if ctx.Err() != nil && lastErr.Kind != CallErrUpstream {
+		lastErr.Kind = CallErrTimeout
+		lastErr.Err = ctx.Err()
+	}
+	return 502, nil, nil, lastErr
+}
+
+func (fw *WMFrameWorkV2) callOnce(ctx context.Context, addr, method, path string, body []byte, header http.Header, timeo time.Duration) (int, []byte, http.Header, error) {
+	defer fw.lb.begin(addr)()
+	ctx, cancel := context.WithTimeout(ctx, timeo)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(addr, "/")+"/"+strings.TrimPrefix(path, "/"), bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for k, v := range header {
+		for _, vv := range v {
+			req.Header.Add(k, vv)
+		}
+	}
+	if len(body) > 0 && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := fw.httpClientPool.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if fw.Debug() {
+		fw.WriteDebug("HTTP SVC", method+" response "+resp.Status+" from "+req.URL.String()+"|"+string(b))
+	}
+	return resp.StatusCode, b, resp.Header, nil
+}
+
+// ViewServiceClientConfig 查看服务调用配置,返回json字符串
+func (fw *WMFrameWorkV2) ViewServiceClientConfig() string {
+	return fw.svcCtl.forshow
+}
@@ -0,0 +1,301 @@
+package wmv2
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/sjson"
+	"github.com/xyzj/gopsu"
+)
+
+// 压缩配置
+type compressConfigure struct {
+	forshow string
+	// 压缩级别，0-不压缩
+	level int
+	// 是否启用brotli
+	brotli bool
+	// brotli压缩级别
+	brotliLevel int
+	// 最小压缩字节数
+	minSize int
+	// 不压缩的路由前缀
+	excludePaths []string
+	// 不压缩的文件后缀
+	excludeExts []string
+	// 不压缩的Content-Type前缀
+	excludeTypes []string
+	// 压缩器缓存
+	gzPool sync.Pool
+	brPool sync.Pool
+}
+
+func (conf *compressConfigure) show() string {
+	conf.forshow, _ = sjson.Set("", "level", conf.level)
+	conf.forshow, _ = sjson.Set(conf.forshow, "brotli", conf.brotli)
+	conf.forshow, _ = sjson.Set(conf.forshow, "brotli_level", conf.brotliLevel)
+	conf.forshow, _ = sjson.Set(conf.forshow, "min_size", conf.minSize)
+	conf.forshow, _ = sjson.Set(conf.forshow, "exclude_paths", conf.excludePaths)
+	conf.forshow, _ = sjson.Set(conf.forshow, "exclude_exts", conf.excludeExts)
+	conf.forshow, _ = sjson.Set(conf.forshow, "exclude_types", conf.excludeTypes)
+	return conf.forshow
+}
+
+func splitConfigList(s string) []string {
+	ss := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			ss = append(ss, v)
+		}
+	}
+	return ss
+}
+
+func (fw *WMFrameWorkV2) loadCompressConfig() {
+	fw.compressCtl.level = gopsu.String2Int(fw.wmConf.GetItemDefault("compress_level", "6", "http数据压缩级别，1-9，0-不压缩"), 10)
+	fw.compressCtl.brotli, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("compress_brotli", "true", "客户端支持时是否优先使用brotli压缩"))
+	fw.compressCtl.brotliLevel = gopsu.String2Int(fw.wmConf.GetItemDefault("compress_brotli_level", "4", "brotli压缩级别，0-11，级别越高cpu占用越高"), 10)
+	fw.compressCtl.minSize = gopsu.String2Int(fw.wmConf.GetItemDefault("compress_minsize", "1024", "小于该字节数的数据不压缩"), 10)
+	fw.compressCtl.excludePaths = splitConfigList(fw.wmConf.GetItemDefault("compress_exclude_paths", "/downloadLog", "不压缩的路由前缀，用`,`分割多个路由"))
+	fw.compressCtl.excludeExts = splitConfigList(fw.wmConf.GetItemDefault("compress_exclude_exts", ".png,.jpg,.jpeg,.gif,.zip,.gz,.br,.7z,.rar,.xlsx,.docx,.mp4", "不压缩的文件后缀，用`,`分割多个后缀"))
+	fw.compressCtl.excludeTypes = splitConfigList(fw.wmConf.GetItemDefault("compress_exclude_types", "image/,video/,audio/,application/zip,application/gzip,application/octet-stream,application/vnd.openxmlformats,text/event-stream", "不压缩的Content-Type前缀，用`,`分割多个类型"))
+	fw.wmConf.Save()
+	if fw.compressCtl.level > 9 {
+		fw.compressCtl.level = 9
+	}
+	if fw.compressCtl.brotliLevel < brotli.BestSpeed || fw.compressCtl.brotliLevel > brotli.BestCompression {
+		fw.compressCtl.brotliLevel = 4
+	}
+	if fw.compressCtl.minSize < 0 {
+		fw.compressCtl.minSize = 0
+	}
+	level := fw.compressCtl.level
+	fw.compressCtl.gzPool.New = func() interface{} {
+		w, _ := gzip.NewWriterLevel(io.Discard, level)
+		return w
+	}
+	brLevel := fw.compressCtl.brotliLevel
+	fw.compressCtl.brPool.New = func() interface{} {
+		return brotli.NewWriterLevel(io.Discard, brLevel)
+	}
+	fw.compressCtl.show()
+}
+
+// negotiate 根据Accept-Encoding选择压缩方式
+func (conf *compressConfigure) negotiate(accept string) string {
+	var gz, br bool
+	for _, v := range strings.Split(accept, ",") {
+		ss := strings.Split(strings.TrimSpace(v), ";")
+		if len(ss) > 1 {
+			q := strings.TrimSpace(ss[1])
+			if q == "q=0" || q == "q=0.0" || q == "q=0.00" || q == "q=0.000" {
+				continue
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(ss[0])) {
+		case "br":
+			br = true
+		case "gzip", "*":
+			gz = true
+		}
+	}
+	switch {
+	case br && conf.brotli:
+		return "br"
+	case gz:
+		return "gzip"
+	}
+	return ""
+}
+
+func (conf *compressConfigure) skipPath(p string) bool {
+	for _, v := range conf.excludePaths {
+		if strings.HasPrefix(p, v) {
+			return true
+		}
+	}
+	ext := strings.ToLower(filepath.Ext(p))
+	if ext == "" {
+		return false
+	}
+	for _, v := range conf.excludeExts {
+		if ext == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (conf *compressConfigure) skipType(t string) bool {
+	t = strings.ToLower(t)
+	for _, v := range conf.excludeTypes {
+		if strings.HasPrefix(t, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// addVary 添加Vary，已存在时不重复添加
+func addVary(h http.Header, v string) {
+	for _, x := range h.Values("Vary") {
+		for _, y := range strings.Split(x, ",") {
+			if y = strings.TrimSpace(y); y == "*" || strings.EqualFold(y, v) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", v)
+}
+
+// compressWriter 缓存开始的数据，达到最小压缩字节数后再根据Content-Type决定是否压缩
+type compressWriter struct {
+	gin.ResponseWriter
+	conf     *compressConfigure
+	encoding string
+	buf      bytes.Buffer
+	decided  bool
+	cw       io.WriteCloser
+}
+
+func (w *compressWriter) decide() {
+	w.decided = true
+	h := w.ResponseWriter.Header()
+	ct := h.Get("Content-Type")
+	if ct == "" {
+		ct = http.DetectContentType(w.buf.Bytes())
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" || w.buf.Len() < w.conf.minSize || w.conf.skipType(ct) {
+		w.encoding = ""
+	}
+	// 是否压缩取决于Accept-Encoding，不压缩时也需要告知缓存
+	addVary(h, "Accept-Encoding")
+	if w.encoding != "" {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		// 压缩后内容与原ETag对应的内容不再逐字节相同，改为弱校验
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		switch w.encoding {
+		case "br":
+			bw := w.conf.brPool.Get().(*brotli.Writer)
+			bw.Reset(w.ResponseWriter)
+			w.cw = bw
+		default:
+			gw := w.conf.gzPool.Get().(*gzip.Writer)
+			gw.Reset(w.ResponseWriter)
+			w.cw = gw
+		}
+	}
+	if w.buf.Len() > 0 {
+		if w.cw != nil {
+			w.cw.Write(w.buf.Bytes())
+		} else {
+			w.ResponseWriter.Write(w.buf.Bytes())
+		}
+		w.buf.Reset()
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.buf.Write(b)
+		if w.buf.Len() >= w.conf.minSize {
+			w.decide()
+		}
+		return len(b), nil
+	}
+	if w.cw != nil {
+		return w.cw.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Written 有缓存数据时视为已写入
+func (w *compressWriter) Written() bool {
+	return w.buf.Len() > 0 || w.ResponseWriter.Written()
+}
+
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide()
+	}
+	if f, ok := w.cw.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.Hijack()
+}
+
+func (w *compressWriter) close() {
+	if !w.decided {
+		if w.buf.Len() == 0 {
+			return
+		}
+		w.decide()
+	}
+	if w.cw == nil {
+		return
+	}
+	w.cw.Close()
+	switch x := w.cw.(type) {
+	case *gzip.Writer:
+		x.Reset(io.Discard)
+		w.conf.gzPool.Put(x)
+	case *brotli.Writer:
+		x.Reset(io.Discard)
+		w.conf.brPool.Put(x)
+	}
+	w.cw = nil
+}
+
+// Compress 按配置对http返回数据进行gzip或brotli压缩
+func (fw *WMFrameWorkV2) Compress() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if fw.compressCtl.level <= 0 ||
+			c.Request.Method == http.MethodHead ||
+			c.GetHeader("Upgrade") != "" ||
+			c.GetHeader("Range") != "" ||
+			fw.compressCtl.skipPath(c.Request.URL.Path) {
+			return
+		}
+		encoding := fw.compressCtl.negotiate(c.GetHeader("Accept-Encoding"))
+		if encoding == "" {
+			return
+		}
+		w := &compressWriter{
+			ResponseWriter: c.Writer,
+			conf:           fw.compressCtl,
+			encoding:       encoding,
+		}
+		c.Writer = w
+		defer func() {
+			w.close()
+			c.Writer = w.ResponseWriter
+		}()
+		c.Next()
+	}
+}
+
+// ViewCompressConfig 查看压缩配置,返回json字符串
+func (fw *WMFrameWorkV2) ViewCompressConfig() string {
+	return fw.compressCtl.forshow
+}
@@ -0,0 +1,41 @@
+package wmv2
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xyzj/gopsu"
+)
+
+func TestCompressHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf, err := gopsu.LoadConfig(filepath.Join(t.TempDir(), "test.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw := &WMFrameWorkV2{wmConf: conf, compressCtl: &compressConfigure{}}
+	fw.loadCompressConfig()
+	r := gin.New()
+	r.Use(fw.Compress())
+	r.GET("/big", func(c *gin.Context) {
+		c.Header("ETag", `"abc"`)
+		c.String(http.StatusOK, strings.Repeat("a", 2048))
+	})
+	r.GET("/small", func(c *gin.Context) {
+		c.Header("ETag", `"abc"`)
+		c.String(http.StatusOK, "a")
+	})
+	ae := map[string]string{"Accept-Encoding": "gzip"}
+	w := webGet(r, "/big", ae)
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Vary") != "Accept-Encoding" || w.Header().Get("ETag") != `W/"abc"` {
+		t.Fatalf("compressed: %v", w.Header())
+	}
+	// 未压缩时保留强ETag，仍需Vary
+	w = webGet(r, "/small", ae)
+	if w.Header().Get("Content-Encoding") != "" || w.Header().Get("Vary") != "Accept-Encoding" || w.Header().Get("ETag") != `"abc"` {
+		t.Fatalf("uncompressed: %v", w.Header())
+	}
+}
@@ -0,0 +1,301 @@
+package wmv2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xyzj/gopsu"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// 服务实例本地快照
+type serviceSnapshot struct {
+	locker sync.RWMutex
+	// 服务名-注册key-实例
+	services map[string]map[string]*Instance
+	// 服务名-变化通知
+	watchers map[string][]func([]*Instance)
+	// 发布过实例信息的服务
+	known map[string]bool
+	// 是否已与etcd同步，未同步时的数据来自缓存文件
+	synced bool
+	// 是否已启动watch
+	watching bool
+	// 缓存文件，为空时不缓存
+	cacheFile string
+}
+
+func newServiceSnapshot() *serviceSnapshot {
+	return &serviceSnapshot{
+		services: make(map[string]map[string]*Instance),
+		watchers: make(map[string][]func([]*Instance)),
+		known:    make(map[string]bool),
+	}
+}
+
+// published 服务是否发布过实例信息
+func (s *serviceSnapshot) published(svrName string) bool {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	return s.known[svrName]
+}
+
+// list 返回服务实例，按地址排序
+func (s *serviceSnapshot) list(svrName string) []*Instance {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+	return s.listNoLock(svrName)
+}
+
+func (s *serviceSnapshot) listNoLock(svrName string) []*Instance {
+	ins := make([]*Instance, 0, len(s.services[svrName]))
+	for _, v := range s.services[svrName] {
+		ins = append(ins, v)
+	}
+	sort.Slice(ins, func(i, j int) bool {
+		return ins[i].Addr < ins[j].Addr
+	})
+	return ins
+}
+
+// replace 使用etcd的完整数据替换快照，返回有变化的服务
+func (s *serviceSnapshot) replace(all map[string]map[string]*Instance) []string {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	changed := make([]string, 0)
+	for k := range s.services {
+		if _, ok := all[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	for k, v := range all {
+		if old, ok := s.services[k]; !ok || len(old) != len(v) {
+			changed = append(changed, k)
+			continue
+		}
+		for kk, vv := range v {
+			if o, ok := s.services[k][kk]; !ok || !reflect.DeepEqual(o, vv) {
+				changed = append(changed, k)
+				break
+			}
+		}
+	}
+	for k := range all {
+		s.known[k] = true
+	}
+	s.services = all
+	s.synced = true
+	return changed
+}
+
+// apply 更新单个实例，inst为nil时删除
+func (s *serviceSnapshot) apply(svrName, key string, inst *Instance) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if inst == nil {
+		delete(s.services[svrName], key)
+		if len(s.services[svrName]) == 0 {
+			delete(s.services, svrName)
+		}
+		return
+	}
+	if _, ok := s.services[svrName]; !ok {
+		s.services[svrName] = make(map[string]*Instance)
+	}
+	s.services[svrName][key] = inst
+	s.known[svrName] = true
+}
+
+// notify 通知服务实例变化
+func (s *serviceSnapshot) notify(svrNames ...string) {
+	s.locker.RLock()
+	calls := make([]func(), 0)
+	for _, name := range svrNames {
+		ins := s.listNoLock(name)
+		for _, f := range s.watchers[name] {
+			f := f
+			calls = append(calls, func() { f(ins) })
+		}
+	}
+	s.locker.RUnlock()
+	for _, f := range calls {
+		func() {
+			defer func() { recover() }()
+			f()
+		}()
+	}
+}
+
+// save 写入缓存文件，保留注册key，以便etcd的删除事件能够移除缓存的实例
+func (s *serviceSnapshot) save() error {
+	if s.cacheFile == "" {
+		return nil
+	}
+	s.locker.RLock()
+	b, err := json.Marshal(s.services)
+	s.locker.RUnlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.cacheFile, b, 0644)
+}
+
+// load 读取缓存文件
+func (s *serviceSnapshot) load() error {
+	if s.cacheFile == "" || !gopsu.IsExist(s.cacheFile) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(s.cacheFile)
+	if err != nil {
+		return err
+	}
+	all := make(map[string]map[string]*Instance)
+	if err := json.Unmarshal(b, &all); err != nil {
+		return err
+	}
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.synced {
+		return nil
+	}
+	for k, v := range all {
+		s.services[k] = v
+		s.known[k] = true
+	}
+	return nil
+}
+
+// parseInstance 解析注册信息，返回服务名和实例
+func (fw *WMFrameWorkV2) parseInstance(key string, value []byte) (string, *Instance) {
+	name := strings.Split(strings.TrimPrefix(key, fw.registryPrefix("")), "/")[0]
+	if value == nil {
+		return name, nil
+	}
+	inst := &Instance{}
+	if err := json.Unmarshal(value, inst); err != nil || inst.Addr == "" {
+		return name, nil
+	}
+	if inst.Name == "" {
+		inst.Name = name
+	}
+	if inst.Weight < 1 {
+		inst.Weight = 1
+	}
+	return name, inst
+}
+
+// startWatch 启动服务实例监视，读取缓存文件作为初始快照
+func (fw *WMFrameWorkV2) startWatch() {
+	fw.snapshot.locker.Lock()
+	if fw.snapshot.watching {
+		fw.snapshot.locker.Unlock()
+		return
+	}
+	fw.snapshot.watching = true
+	fw.snapshot.locker.Unlock()
+	go fw.watchRegistry(fw.etcdCtl.ctx)
+}
+
+// watchRegistry 同步所有服务实例，并监视变化，ctx结束（框架停止）时退出
+func (fw *WMFrameWorkV2) watchRegistry(ctx context.Context) {
+	defer func() {
+		fw.snapshot.locker.Lock()
+		fw.snapshot.watching = false
+		fw.snapshot.locker.Unlock()
+	}()
+RUN:
+	func() {
+		defer func() {
+			if err := recover(); err != nil {
+				fw.WriteError("ETCD", fmt.Sprintf("registry watch crash: %+v", errors.WithStack(err.(error))))
+			}
+		}()
+		if fw.etcdCtl.cli == nil {
+			return
+		}
+		prefix := fw.registryPrefix("")
+		tctx, cancel := context.WithTimeout(ctx, time.Second*5)
+		resp, err := fw.etcdCtl.cli.Get(tctx, prefix, clientv3.WithPrefix())
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil {
+				fw.WriteError("ETCD", "Failed sync registry|"+err.Error())
+			}
+			return
+		}
+		all := make(map[string]map[string]*Instance)
+		for _, kv := range resp.Kvs {
+			name, inst := fw.parseInstance(string(kv.Key), kv.Value)
+			if inst == nil {
+				continue
+			}
+			if _, ok := all[name]; !ok {
+				all[name] = make(map[string]*Instance)
+			}
+			all[name][string(kv.Key)] = inst
+		}
+		fw.snapshot.notify(fw.snapshot.replace(all)...)
+		fw.snapshot.save()
+		wctx, wcancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+		defer wcancel()
+		for wresp := range fw.etcdCtl.cli.Watch(wctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1)) {
+			if err := wresp.Err(); err != nil {
+				fw.WriteError("ETCD", "registry watch error|"+err.Error())
+				return
+			}
+			changed := make(map[string]bool)
+			for _, ev := range wresp.Events {
+				var name string
+				var inst *Instance
+				if ev.Type == clientv3.EventTypePut {
+					name, inst = fw.parseInstance(string(ev.Kv.Key), ev.Kv.Value)
+				} else {
+					name, _ = fw.parseInstance(string(ev.Kv.Key), nil)
+				}
+				fw.snapshot.apply(name, string(ev.Kv.Key), inst)
+				changed[name] = true
+			}
+			names := make([]string, 0, len(changed))
+			for k := range changed {
+				names = append(names, k)
+			}
+			fw.snapshot.notify(names...)
+			fw.snapshot.save()
+		}
+	}()
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Second * 3):
+	}
+	goto RUN
+}
+
+// WatchService 监视服务实例变化，注册时立即回调一次当前实例
+// f: 实例变化时的回调，不要阻塞
+func (fw *WMFrameWorkV2) WatchService(svrName string, f func([]*Instance)) {
+	fw.snapshot.locker.Lock()
+	fw.snapshot.watchers[svrName] = append(fw.snapshot.watchers[svrName], f)
+	fw.snapshot.locker.Unlock()
+	fw.snapshot.notify(svrName)
+}
+
+// loadDiscoveryCache 读取服务实例缓存配置
+func (fw *WMFrameWorkV2) loadDiscoveryCache(enable bool) {
+	if !enable {
+		return
+	}
+	fw.snapshot.cacheFile = filepath.Join(gopsu.DefaultCacheDir, "registry-"+fw.rootPath+".json")
+	if err := fw.snapshot.load(); err != nil {
+		fw.WriteError("ETCD", "Failed load registry cache|"+err.Error())
+	}
+}
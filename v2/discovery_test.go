@@ -0,0 +1,28 @@
+package wmv2
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xyzj/gopsu"
+)
+
+func TestWatchRegistryStop(t *testing.T) {
+	fw := &WMFrameWorkV2{wmLog: &gopsu.NilLogger{}, etcdCtl: &etcdConfigure{}, snapshot: newServiceSnapshot()}
+	fw.etcdCtl.ctx, fw.etcdCtl.cancel = context.WithCancel(context.Background())
+	fw.startWatch()
+	time.Sleep(time.Millisecond * 50)
+	fw.etcdCtl.cancel()
+	// 停止后监视退出，再次启动时可重新监视
+	for i := 0; i < 100; i++ {
+		fw.snapshot.locker.Lock()
+		watching := fw.snapshot.watching
+		fw.snapshot.locker.Unlock()
+		if !watching {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("registry watch is still running after stop")
+}
@@ -1,16 +1,18 @@
 package wmv2
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/tidwall/sjson"
 	"github.com/xyzj/gopsu"
-	"github.com/xyzj/gopsu/microgo"
+	"go.etcd.io/etcd/clientv3"
 )
 
 // etcd配置
@@ -32,8 +34,30 @@ type etcdConfigure struct {
 	username string
 	// passwd
 	password string
-	// Client
-	client *microgo.Etcdv3Client
+	// 配置的用户名和密码，useauth为true时使用
+	user string
+	pwd  string
+	// 区域
+	zone string
+	// 权重
+	weight int
+	// 服务实例注册和发现
+	cli       *clientv3.Client
+	cliLocker sync.Mutex
+	// 当前注册使用的租约
+	leaseID     clientv3.LeaseID
+	leaseLocker sync.Mutex
+	// 旧版注册key，与实例信息使用相同租约
+	legacyKey string
+	// 租约时长，秒
+	ttl int64
+	// 模块不可用时是否撤销注册
+	readiness bool
+	// 模块检查间隔
+	checkInterval time.Duration
+	// 停止注册
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (conf *etcdConfigure) show(rootPath string) string {
@@ -51,6 +75,24 @@ func (fw *WMFrameWorkV2) newETCDClient() {
 	fw.etcdCtl.useauth, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("etcd_auth", "true", "连接etcd时是否需要认证"))
 	fw.etcdCtl.usetls, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("etcd_tls", "true", "是否使用证书连接etcd服务"))
 	fw.etcdCtl.v6, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("etcd_v6", "false", "是否优先使用v6地址"))
+	fw.etcdCtl.zone = fw.wmConf.GetItemDefault("etcd_zone", "", "本实例所在区域，用于同区域优先选取")
+	fw.etcdCtl.weight = gopsu.String2Int(fw.wmConf.GetItemDefault("etcd_weight", "1", "本实例权重，1-100"), 10)
+	fw.lb.strategy = fw.wmConf.GetItemDefault("etcd_lb", LBRandom, "选取其他服务实例的默认策略，random-按权重随机，roundrobin-按权重轮询，leastinflight-进行中请求最少")
+	fw.lb.preferZone, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("etcd_lb_zone", "false", "选取其他服务实例时是否优先选择同区域实例"))
+	fw.lb.zone = fw.etcdCtl.zone
+	fw.etcdCtl.ttl = int64(gopsu.String2Int(fw.wmConf.GetItemDefault("etcd_ttl", "15", "注册信息租约时长（秒），实例异常退出后超过该时长会被移除"), 10))
+	fw.etcdCtl.readiness, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("etcd_readiness", "true", "依赖的模块（sql，redis，mq）不可用时是否撤销注册，恢复后重新注册"))
+	fw.etcdCtl.checkInterval = time.Second * time.Duration(gopsu.String2Int(fw.wmConf.GetItemDefault("etcd_check", "5", "依赖模块检查间隔（秒）"), 10))
+	cache, _ := strconv.ParseBool(fw.wmConf.GetItemDefault("etcd_cache", "true", "是否缓存其他服务的实例信息到本地，etcd不可用时使用缓存访问其他服务"))
+	if fw.etcdCtl.weight < 1 || fw.etcdCtl.weight > 100 {
+		fw.etcdCtl.weight = 1
+	}
+	if fw.etcdCtl.ttl < 5 {
+		fw.etcdCtl.ttl = 5
+	}
+	if fw.etcdCtl.checkInterval <= 0 {
+		fw.etcdCtl.checkInterval = time.Second * 5
+	}
 	if !fw.etcdCtl.usetls {
 		fw.etcdCtl.addr = strings.Replace(fw.etcdCtl.addr, "2378", "2379", 1)
 	}
@@ -58,65 +100,94 @@ func (fw *WMFrameWorkV2) newETCDClient() {
 		fw.etcdCtl.regAddr = gopsu.RealIP(fw.etcdCtl.v6)
 		// fw.wmConf.UpdateItem("etcd_reg", fw.etcdCtl.regAddr)
 	}
+	fw.etcdCtl.user = fw.wmConf.GetItemDefault("etcd_user", "", "etcd用户名，etcd_auth为true时必须设置")
+	fw.etcdCtl.pwd = fw.readSecret("etcd_pwd", "etcd密码，etcd_auth为true时必须设置")
 	fw.wmConf.Save()
 	fw.etcdCtl.show(fw.rootPath)
 	if !fw.etcdCtl.enable {
 		return
 	}
+	if fw.etcdCtl.useauth && (fw.etcdCtl.user == "" || fw.etcdCtl.pwd == "") {
+		if fw.production() {
+			fw.etcdCtl.enable = false
+			fw.WriteError("ETCD", "etcd_user or etcd_pwd is not configured, etcd disabled")
+			return
+		}
+		fw.WriteWarning("ETCD", "etcd_user or etcd_pwd is not configured, connect without auth")
+		fw.etcdCtl.useauth = false
+	}
+	fw.loadDiscoveryCache(cache)
 	var httpType = "https"
 	if *debug || *forceHTTP {
 		httpType = "http"
 	}
-RUN:
-	if fw.etcdCtl.useauth {
-		fw.etcdCtl.username = "root"
-		fw.etcdCtl.password = gopsu.DecodeString("wMQLEoOHM2eOF6O7Ho8MH74jZ1vMs5i1B+VL+ozl")
-	}
-	func() {
-		defer func() {
-			if err := recover(); err != nil {
-				fw.WriteError("ETCD", fmt.Sprintf("etcd register crash: %+v", errors.WithStack(err.(error))))
-			}
-		}()
-		var err error
-		if fw.etcdCtl.usetls {
-			fw.etcdCtl.client, err = microgo.NewEtcdv3ClientTLS([]string{fw.etcdCtl.addr}, fw.tlsCert, fw.tlsKey, fw.tlsRoot, fw.etcdCtl.username, fw.etcdCtl.password)
-		} else {
-			fw.etcdCtl.client, err = microgo.NewEtcdv3Client([]string{fw.etcdCtl.addr}, fw.etcdCtl.username, fw.etcdCtl.password)
+	fw.etcdCtl.ctx, fw.etcdCtl.cancel = context.WithCancel(context.Background())
+	// 失败时按1,2,4...60秒退避重连，注册保持超过1分钟后重置
+	var attempt uint
+	for fw.etcdCtl.ctx.Err() == nil {
+		t := time.Now()
+		if err := fw.runETCD(httpType); err != nil {
+			fw.WriteError("ETCD", err.Error())
 		}
-		if err != nil {
-			fw.etcdCtl.enable = false
-			fw.WriteError("ETCD", "Failed connect to "+fw.etcdCtl.addr+"|"+err.Error())
-			return
-		}
-		fw.etcdCtl.client.SetLogger(&StdLogger{
-			Name:        "ETCD",
-			LogReplacer: strings.NewReplacer("[", "", "]", ""),
-			LogWriter:   fw.wmLog,
-		})
-
-		// 注册自身
-		if len(fw.rootPath) > 0 {
-			fw.etcdCtl.client.SetRoot(fw.rootPath)
+		if time.Since(t) > time.Minute {
+			attempt = 0
 		}
-		a, b, err := net.SplitHostPort(fw.etcdCtl.regAddr)
-		if err != nil {
-			a = fw.etcdCtl.regAddr
+		d := time.Second << attempt
+		if d > time.Minute {
+			d = time.Minute
+		} else {
+			attempt++
 		}
-		if b == "" {
-			b = strconv.Itoa(*webPort)
+		select {
+		case <-fw.etcdCtl.ctx.Done():
+		case <-time.After(d):
 		}
-		if err := fw.etcdCtl.client.Register(fw.serverName, a, b, httpType, "json"); err != nil {
-			switch {
-			case strings.Contains(err.Error(), "user name is empty"):
-				fw.etcdCtl.useauth = true
-			case strings.Contains(err.Error(), "authentication is not enabled"):
-				fw.etcdCtl.useauth = false
-			}
+	}
+}
+
+// runETCD 连接etcd并注册自身，阻塞直到注册失效或框架停止
+func (fw *WMFrameWorkV2) runETCD(httpType string) (err error) {
+	defer func() {
+		if ex := recover(); ex != nil {
+			err = fmt.Errorf("etcd register crash: %+v", errors.WithStack(ex.(error)))
 		}
 	}()
-	time.Sleep(time.Second * 3)
-	goto RUN
+	a, b, ex := net.SplitHostPort(fw.etcdCtl.regAddr)
+	if ex != nil {
+		a = fw.etcdCtl.regAddr
+	}
+	if b == "" {
+		b = strconv.Itoa(*webPort)
+	}
+	inst := fw.localInstance(net.JoinHostPort(a, b), httpType)
+	fw.etcdCtl.username, fw.etcdCtl.password = fw.etcdCtl.user, fw.etcdCtl.pwd
+	if !fw.etcdCtl.useauth {
+		fw.etcdCtl.username, fw.etcdCtl.password = "", ""
+	}
+	if err := fw.newRegistryClient(); err != nil {
+		switch {
+		case strings.Contains(err.Error(), "user name is empty"):
+			fw.etcdCtl.useauth = true
+		case strings.Contains(err.Error(), "authentication is not enabled"):
+			fw.etcdCtl.useauth = false
+		}
+		return fmt.Errorf("Failed connect to %s|%s", fw.etcdCtl.addr, err.Error())
+	}
+	fw.startWatch()
+	// 发布实例信息，用于负载均衡
+	if err := fw.keepInstance(inst); err != nil {
+		return fmt.Errorf("Failed register instance|%s", err.Error())
+	}
+	return nil
+}
+
+// stopETCD 停止注册，删除本实例的注册信息
+func (fw *WMFrameWorkV2) stopETCD() {
+	if fw.etcdCtl.cancel == nil {
+		return
+	}
+	fw.etcdCtl.cancel()
+	fw.revokeInstance()
 }
 
 // ETCDIsReady 返回ETCD可用状态
@@ -124,35 +195,30 @@ func (fw *WMFrameWorkV2) ETCDIsReady() bool {
 	return fw.etcdCtl.enable
 }
 
-// Picker 选取服务地址
+// Picker 选取服务地址，按etcd_lb配置的策略选取
 func (fw *WMFrameWorkV2) Picker(svrName string) (string, error) {
-	if !fw.etcdCtl.enable {
-		return "", fmt.Errorf("etcd client not ready")
-	}
-	addr, err := fw.etcdCtl.client.Picker(svrName)
+	inst, err := fw.pickInstanceBy(svrName, "", "")
 	if err != nil {
 		return "", err
 	}
-	return addr, nil
+	return inst.Addr, nil
 }
 
-func (fw *WMFrameWorkV2) AllServices() (string, error) {
+// AllServices 返回所有已注册的服务实例，按服务名称和地址排序
+func (fw *WMFrameWorkV2) AllServices() ([]*Instance, error) {
 	if !fw.etcdCtl.enable {
-		return "", fmt.Errorf("etcd client not ready")
+		return nil, fmt.Errorf("etcd client not ready")
 	}
-	return fw.etcdCtl.client.AllServices(), nil
+	return fw.listAllInstances()
 }
 
-// PickerDetail 选取服务地址,带http(s)前缀
+// PickerDetail 选取服务地址,带http(s)前缀，按etcd_lb配置的策略选取
 func (fw *WMFrameWorkV2) PickerDetail(svrName string) (string, error) {
-	if !fw.etcdCtl.enable {
-		return "", fmt.Errorf("etcd client not ready")
-	}
-	addr, err := fw.etcdCtl.client.PickerDetail(svrName)
+	inst, err := fw.pickInstanceBy(svrName, "", "")
 	if err != nil {
 		return "", err
 	}
-	return addr, nil
+	return inst.URL(), nil
 }
 
 // ViewETCDConfig 查看ETCD配置,返回json字符串
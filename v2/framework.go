@@ -1,17 +1,17 @@
 package wmv2
 
 import (
-	"crypto/tls"
-	_ "embed"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/tidwall/gjson"
@@ -25,18 +25,6 @@ import (
 	msgctl "github.com/xyzj/proto/msgjk"
 )
 
-//go:embed ca/ca.pem
-var ca []byte
-
-//go:embed ca/localhost.pem
-var caCert []byte
-
-//go:embed ca/localhost-key.pem
-var caKey []byte
-
-//go:embed ca/localhost.pfx
-var caPfx []byte
-
 // NewFrameWorkV2 初始化一个新的framework
 func NewFrameWorkV2(versionInfo string) *WMFrameWorkV2 {
 	if !flag.Parsed() {
@@ -65,6 +53,21 @@ func NewFrameWorkV2(versionInfo string) *WMFrameWorkV2 {
 		dbCtl:         &dbConfigure{},
 		rmqCtl:        &rabbitConfigure{},
 		tcpCtl:        &tcpConfigure{},
+		rateCtl:       &rateLimitConfigure{memBuckets: make(map[string]*memBucket)},
+		compressCtl:   &compressConfigure{},
+		apiDocs:       &apiDocs{},
+		gatewayCtl:    &gatewayConfigure{},
+		lb:            &balancer{rr: make(map[string]map[string]int)},
+		snapshot:      newServiceSnapshot(),
+		certCtl:       &certConfigure{},
+		serverCtl:     &serverConfigure{},
+		pushCtl:       &pushConfigure{clients: make(map[*pushClient]struct{})},
+		idemCtl:       &idempotencyConfigure{},
+		auditCtl:      &auditConfigure{},
+		captureCtl:    &captureConfigure{},
+		webCtl:        &webConfigure{},
+		mtlsCtl:       &mtlsConfigure{},
+		caPool:        &caPoolCache{},
 		chanTCPWorker: make(chan interface{}, 5000),
 		JSON:          jsoniter.Config{}.Froze(),
 		httpClientPool: &http.Client{
@@ -74,12 +77,16 @@ func NewFrameWorkV2(versionInfo string) *WMFrameWorkV2 {
 				MaxConnsPerHost:     100,
 				MaxIdleConns:        1,
 				MaxIdleConnsPerHost: 1,
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true,
-				},
 			},
 		},
 		chanSSLRenew: make(chan int, 2),
+		svcCtl: &serviceClientConfigure{
+			retry:       2,
+			backoffBase: time.Millisecond * 100,
+			backoffMax:  time.Second * 2,
+			cbFailures:  5,
+			cbOpen:      time.Second * 30,
+		},
 	}
 	// 处置版本，检查机器码
 	fw.checkMachine()
@@ -114,18 +121,6 @@ func NewFrameWorkV2(versionInfo string) *WMFrameWorkV2 {
 	fw.tlsRoot = filepath.Join(fw.baseCAPath, "ca.pem")
 	fw.httpCert = filepath.Join(fw.baseCAPath, "localhost.pem")
 	fw.httpKey = filepath.Join(fw.baseCAPath, "localhost-key.pem")
-	if !gopsu.IsExist(fw.tlsRoot) {
-		ioutil.WriteFile(fw.tlsRoot, ca, 0644)
-	}
-	if !gopsu.IsExist(fw.tlsCert) {
-		ioutil.WriteFile(fw.tlsCert, caCert, 0644)
-	}
-	if !gopsu.IsExist(fw.tlsKey) {
-		ioutil.WriteFile(fw.tlsKey, caKey, 0644)
-	}
-	if !gopsu.IsExist(filepath.Join(fw.baseCAPath, "localhost.pfx")) {
-		ioutil.WriteFile(filepath.Join(fw.baseCAPath, "localhost.pfx"), caPfx, 0644)
-	}
 	return fw
 }
 
@@ -166,10 +161,38 @@ func (fw *WMFrameWorkV2) Start(opv2 *OptionFrameWorkV2) {
 		}
 		fw.loadConfigure(cfpath)
 	}
+	// 证书管理，执行后退出
+	if *caCmd != "" {
+		if err := fw.caCommand(*caCmd); err != nil {
+			println("ca " + *caCmd + " error: " + err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	// 前置处理方法，用于预初始化某些内容
 	if opv2.FrontFunc != nil {
 		opv2.FrontFunc()
 	}
+	// 内嵌的web页面
+	if opv2.UseHTTP != nil && opv2.UseHTTP.WebUI != nil {
+		if err := fw.SetWebUI(opv2.UseHTTP.WebUI, opv2.UseHTTP.WebUIRoot); err != nil {
+			fw.WriteError("WEB", "Failed load web ui|"+err.Error())
+		}
+	}
+	// 输出api文档后退出
+	if *openapiOut != "" {
+		var r *gin.Engine
+		if opv2.UseHTTP != nil && opv2.UseHTTP.EngineFunc != nil {
+			r = opv2.UseHTTP.EngineFunc()
+		} else {
+			r = fw.NewHTTPEngine()
+		}
+		if err := fw.WriteOpenAPI(r, *openapiOut); err != nil {
+			println("write openapi error: " + err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	// etcd
 	if opv2.UseETCD != nil {
 		if opv2.UseETCD.Activation {
@@ -247,21 +270,33 @@ func (fw *WMFrameWorkV2) Start(opv2 *OptionFrameWorkV2) {
 	}
 	// 启用性能调试，仅可用于开发过程中
 	if *pyroscope {
-		profiler.Start(profiler.Config{
-			ApplicationName: fw.serverName + "_" + gopsu.RealIP(false) + "_" + gopsu.GetUUID1(),
-			ServerAddress:   "http://office.shwlst.com:10097",
-		})
+		if addr := fw.wmConf.GetItemDefault("pyroscope_addr", "", "pyroscope服务地址，如http://127.0.0.1:4040，使用-pyroscope启动时必须设置"); addr != "" {
+			profiler.Start(profiler.Config{
+				ApplicationName: fw.serverName + "_" + gopsu.RealIP(false) + "_" + gopsu.GetUUID1(),
+				ServerAddress:   addr,
+			})
+		} else {
+			fw.WriteError("CORE", "pyroscope_addr is not configured, profiler disabled")
+		}
 	}
 	fw.WriteSystem("", "Service start:"+fw.verJSON)
 }
 
 // Run 运行框架
-// 启动模组，阻塞
+// 启动模组，阻塞，收到SIGINT或SIGTERM后撤销注册并返回
 func (fw *WMFrameWorkV2) Run(opv2 *OptionFrameWorkV2) {
 	fw.Start(opv2)
-	for {
-		time.Sleep(time.Hour)
-	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+	fw.WriteSystem("", "Service stop:"+s.String())
+	fw.Stop()
+}
+
+// Stop 停止框架，撤销etcd注册，使其他服务不再访问本实例
+// 使用Start启动时，应在退出前调用
+func (fw *WMFrameWorkV2) Stop() {
+	fw.stopETCD()
 }
 
 // LoadConfigure 初始化配置
@@ -292,20 +327,26 @@ func (fw *WMFrameWorkV2) loadConfigure(f string) {
 			trTimeo = time.Second * time.Duration(gopsu.String2Int(s, 10))
 		}
 	}
+	fw.loadServiceClientConfig()
+	fw.loadSecretConfig()
+	// 首次运行时生成本站点的根证书和框架证书，需在创建tls客户端前执行，-ca命令自行处理
+	caAutoInit, _ := strconv.ParseBool(fw.wmConf.GetItemDefault("ca_auto_init", "false", "ca目录没有根证书时是否自动生成，相互访问的服务必须使用同一根证书，通常使用-ca init生成后复制ca.pem到各服务的ca目录，单独部署的服务可设为true，-debug时总是自动生成"))
+	if *caCmd == "" {
+		fw.ensureCerts(caAutoInit || !fw.production())
+	}
+	insecureTargets := splitConfigList(fw.wmConf.GetItemDefault("tls_insecure_targets", "", "访问其他服务时不校验证书的目标ip，域名或ip:端口，用`,`分割多个目标，仅在目标无法使用有效证书时设置"))
+	fw.wmConf.Save()
 	fw.httpClientPool = &http.Client{
 		Timeout: trTimeo,
 		Transport: &http.Transport{
 			DialContext: (&net.Dialer{
 				Timeout: time.Second,
 			}).DialContext,
-			TLSHandshakeTimeout: time.Second,
+			DialTLSContext:      fw.dialTLS(insecureTargets, true, time.Second),
 			IdleConnTimeout:     time.Second * 10,
 			MaxConnsPerHost:     777,
 			MaxIdleConns:        1,
 			MaxIdleConnsPerHost: 1,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
 		},
 	}
 }
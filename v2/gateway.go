@@ -0,0 +1,152 @@
+package wmv2
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/sjson"
+	"github.com/xyzj/gopsu"
+)
+
+// 网关配置
+type gatewayConfigure struct {
+	forshow string
+	// 是否启用网关
+	enable bool
+	// 网关路由前缀，留空时使用/<服务名>/...
+	prefix string
+	// 转发超时，websocket不受限制
+	timeout time.Duration
+	// 允许转发的服务和路由前缀，*表示所有路由
+	allow map[string][]string
+	// 转发时移除的请求头
+	removeHeaders []string
+}
+
+func (conf *gatewayConfigure) show() string {
+	conf.forshow, _ = sjson.Set("", "enable", conf.enable)
+	conf.forshow, _ = sjson.Set(conf.forshow, "prefix", conf.prefix)
+	conf.forshow, _ = sjson.Set(conf.forshow, "timeout", conf.timeout.String())
+	conf.forshow, _ = sjson.Set(conf.forshow, "allow", conf.allow)
+	conf.forshow, _ = sjson.Set(conf.forshow, "remove_headers", conf.removeHeaders)
+	return conf.forshow
+}
+
+// allowed 检查服务和路由是否允许转发，path需已清理
+// 路由前缀按`/`分段匹配，/svc/api允许/svc/api和/svc/api/...，不允许/svc/apiadmin
+func (conf *gatewayConfigure) allowed(svrName, p string) bool {
+	ss, ok := conf.allow[svrName]
+	if !ok {
+		return false
+	}
+	for _, v := range ss {
+		if v == "*" || p == v || strings.HasPrefix(p, strings.TrimSuffix(v, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanPath 清理路由中的`.`，`..`和重复的`/`，保留结尾的`/`
+func cleanPath(p string) string {
+	cp := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cp != "/" {
+		cp += "/"
+	}
+	return cp
+}
+
+func (fw *WMFrameWorkV2) loadGatewayConfig() {
+	fw.gatewayCtl.enable, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("gateway_enable", "false", "是否启用网关，将/<服务名>/...请求转发到etcd中注册的服务"))
+	fw.gatewayCtl.prefix = strings.TrimSuffix(fw.wmConf.GetItemDefault("gateway_prefix", "", "网关路由前缀，如/proxy，转发时去除前缀，留空时直接使用/<服务名>/..."), "/")
+	fw.gatewayCtl.timeout = time.Second * time.Duration(gopsu.String2Int(fw.wmConf.GetItemDefault("gateway_timeout", "60", "网关转发超时（秒），0-不限制，websocket不受限制"), 10))
+	allow := fw.wmConf.GetItemDefault("gateway_allow", "", "允许转发的服务和路由前缀，格式：服务名:路由前缀|路由前缀，用`,`分割多个服务，路由前缀为*时允许所有路由")
+	fw.gatewayCtl.removeHeaders = splitConfigList(fw.wmConf.GetItemDefault("gateway_remove_headers", "Cookie", "转发时移除的请求头，用`,`分割多个请求头"))
+	fw.wmConf.Save()
+	fw.gatewayCtl.allow = make(map[string][]string)
+	for _, v := range splitConfigList(allow) {
+		ss := strings.SplitN(v, ":", 2)
+		if len(ss) != 2 {
+			continue
+		}
+		name := strings.TrimSpace(ss[0])
+		for _, p := range strings.Split(ss[1], "|") {
+			if p = strings.TrimSpace(p); p != "" {
+				fw.gatewayCtl.allow[name] = append(fw.gatewayCtl.allow[name], p)
+			}
+		}
+	}
+	fw.gatewayCtl.show()
+}
+
+// gatewayRoutes 添加网关路由
+func (fw *WMFrameWorkV2) gatewayRoutes(r *gin.Engine) {
+	fw.loadGatewayConfig()
+	if !fw.gatewayCtl.enable {
+		return
+	}
+	if fw.gatewayCtl.prefix == "" {
+		// 没有前缀时，所有未匹配的路由由noRoute尝试转发
+		return
+	}
+	r.Any(fw.gatewayCtl.prefix+"/:svrname/*path", func(c *gin.Context) {
+		fw.gateway(c, c.Param("svrname"), "/"+c.Param("svrname")+c.Param("path"))
+	})
+}
+
+// gatewayNoRoute 没有前缀时，转发未匹配路由中服务名在允许列表中的请求，返回是否已处理
+func (fw *WMFrameWorkV2) gatewayNoRoute(c *gin.Context) bool {
+	if !fw.gatewayCtl.enable || fw.gatewayCtl.prefix != "" {
+		return false
+	}
+	ss := strings.SplitN(strings.TrimPrefix(c.Request.URL.Path, "/"), "/", 2)
+	if _, ok := fw.gatewayCtl.allow[ss[0]]; !ok {
+		return false
+	}
+	fw.gateway(c, ss[0], c.Request.URL.Path)
+	return true
+}
+
+// gateway 转发请求
+// p: 转发到目标服务的路径，清理后检查并转发
+func (fw *WMFrameWorkV2) gateway(c *gin.Context, svrName, p string) {
+	p = cleanPath(p)
+	// 清理后仍需以服务名开头，避免通过..访问其他服务
+	if svrName == fw.serverName || !(p == "/"+svrName || strings.HasPrefix(p, "/"+svrName+"/")) || !fw.gatewayCtl.allowed(svrName, p) {
+		fw.Fail(c, ErrForbidden, nil)
+		return
+	}
+	addr, err := fw.PickerDetail(svrName)
+	if err != nil {
+		fw.Fail(c, ErrUpstream, err)
+		return
+	}
+	if fw.gatewayCtl.timeout > 0 && !strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), fw.gatewayCtl.timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+	}
+	fw.proxyTo(c, addr, p, func(req *http.Request) {
+		for _, v := range fw.gatewayCtl.removeHeaders {
+			// User-Token始终透传
+			if strings.EqualFold(v, "User-Token") {
+				continue
+			}
+			req.Header.Del(v)
+		}
+		req.Header.Set("X-Real-IP", fw.ClientIP(c))
+		if fw.gatewayCtl.prefix != "" {
+			req.Header.Set("X-Forwarded-Prefix", fw.gatewayCtl.prefix)
+		}
+	})
+}
+
+// ViewGatewayConfig 查看网关配置,返回json字符串
+func (fw *WMFrameWorkV2) ViewGatewayConfig() string {
+	return fw.gatewayCtl.forshow
+}
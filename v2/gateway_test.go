@@ -0,0 +1,63 @@
+package wmv2
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xyzj/gopsu"
+)
+
+func TestGatewayAllowed(t *testing.T) {
+	conf := &gatewayConfigure{allow: map[string][]string{
+		"svc": {"/svc/api"},
+		"all": {"*"},
+	}}
+	for p, want := range map[string]bool{
+		"/svc/api":      true,
+		"/svc/api/":     true,
+		"/svc/api/user": true,
+		"/svc/apiadmin": false,
+		"/svc/admin":    false,
+	} {
+		if conf.allowed("svc", p) != want {
+			t.Fatalf("%s: want %v", p, want)
+		}
+	}
+	if !conf.allowed("all", "/all/x") || conf.allowed("other", "/other/x") {
+		t.Fatal("unexpected result")
+	}
+	for p, want := range map[string]string{
+		"/svc/api/../admin": "/svc/admin",
+		"//svc/./api/":      "/svc/api/",
+		"/":                 "/",
+		"/svc/..":           "/",
+	} {
+		if got := cleanPath(p); got != want {
+			t.Fatalf("%s: got %s", p, got)
+		}
+	}
+}
+
+func TestGatewayTraversal(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fw := &WMFrameWorkV2{
+		serverName: "gw",
+		wmLog:      &gopsu.NilLogger{},
+		gatewayCtl: &gatewayConfigure{
+			enable: true,
+			allow:  map[string][]string{"svc": {"/svc/api"}},
+		},
+	}
+	r := gin.New()
+	r.NoRoute(func(c *gin.Context) {
+		if !fw.gatewayNoRoute(c) {
+			c.Status(http.StatusNotFound)
+		}
+	})
+	for _, p := range []string{"/svc/api/../admin", "/svc/apiadmin", "/svc/api/../../other/x"} {
+		if w := webGet(r, p, nil); w.Code != http.StatusForbidden {
+			t.Fatalf("%s: got %d", p, w.Code)
+		}
+	}
+}
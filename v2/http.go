@@ -4,14 +4,12 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"embed"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
-	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -23,7 +21,6 @@ import (
 	"github.com/tidwall/sjson"
 
 	"github.com/gin-contrib/cors"
-	gingzip "github.com/gin-contrib/gzip"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/render"
@@ -31,8 +28,6 @@ import (
 	"github.com/xyzj/gopsu"
 	game "github.com/xyzj/gopsu/games"
 	ginmiddleware "github.com/xyzj/gopsu/gin-middleware"
-	yaaggin "github.com/xyzj/yaag/gin"
-	"github.com/xyzj/yaag/yaag"
 )
 
 const (
@@ -109,38 +104,144 @@ table {
 {{end}}`
 )
 
-//go:embed yaag
-var apirec embed.FS
-
 var (
-	apidocPath = "docs/apidoc.html"
-	yaagConfig *yaag.Config
-	rever      = strings.NewReplacer("{\n", "", "}", "", `"`, "", ",", "")
-	trTimeo    = time.Second * 30
+	rever   = strings.NewReplacer("{\n", "", "}", "", `"`, "", ",", "")
+	trTimeo = time.Second * 30
 )
 
-func apidoc(c *gin.Context) {
-	switch c.Param("switch") {
-	case "on":
-		yaagConfig.On = true
-		c.String(200, "API record is set to on.")
-	case "off":
-		yaagConfig.On = false
-		c.String(200, "API record is set to off.")
-	case "reset":
-		yaagConfig.ResetDoc()
-		c.String(200, "API record reset done.")
-	default:
-		p := gopsu.JoinPathFromHere("docs", "apirecord-"+c.Param("switch")+".html")
-		if gopsu.IsExist(p) {
-			b, _ := ioutil.ReadFile(p)
-			c.Header("Content-Type", "text/html")
-			c.Status(http.StatusOK)
-			c.Writer.Write(b)
-		} else {
-			c.String(200, "The API record file was not found, you may not have the API record function turned on.")
+// loadClientIPConfig 读取可信代理配置
+func (fw *WMFrameWorkV2) loadClientIPConfig() {
+	ss := splitConfigList(fw.wmConf.GetItemDefault("http_trusted_proxies", "", "可信的反向代理ip或网段，如127.0.0.1,10.0.0.0/8，用`,`分割多个，只有来自这些地址的请求才使用X-Forwarded-For，X-Real-IP作为客户端ip"))
+	fw.wmConf.Save()
+	fw.trustedProxies = make([]*net.IPNet, 0, len(ss))
+	for _, v := range ss {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil {
+				bits := 128
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				fw.trustedProxies = append(fw.trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			fw.WriteError("HTTP", "invalid http_trusted_proxies item "+v)
+			continue
+		}
+		fw.trustedProxies = append(fw.trustedProxies, n)
+	}
+}
+
+// trustedProxy 检查地址是否为可信代理
+func (fw *WMFrameWorkV2) trustedProxy(s string) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+	for _, v := range fw.trustedProxies {
+		if v.Contains(ip) {
+			return true
 		}
 	}
+	return false
+}
+
+// ClientIP 获取客户端ip，只有直接连接的地址是可信代理时才使用X-Forwarded-For，X-Real-IP
+// 用于限流，审计等场景，不要使用可被客户端伪造的c.ClientIP()
+func (fw *WMFrameWorkV2) ClientIP(c *gin.Context) string {
+	ip, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+	if err != nil {
+		ip = strings.TrimSpace(c.Request.RemoteAddr)
+	}
+	if !fw.trustedProxy(ip) {
+		return ip
+	}
+	if xff := c.GetHeader("X-Forwarded-For"); xff != "" {
+		// 从右向左跳过可信代理，第一个不可信的地址为客户端ip
+		ss := strings.Split(xff, ",")
+		for i := len(ss) - 1; i >= 0; i-- {
+			v := strings.TrimSpace(ss[i])
+			if net.ParseIP(v) == nil {
+				break
+			}
+			ip = v
+			if !fw.trustedProxy(v) {
+				break
+			}
+		}
+		return ip
+	}
+	if v := strings.TrimSpace(c.GetHeader("X-Real-IP")); net.ParseIP(v) != nil {
+		return v
+	}
+	return ip
+}
+
+// loadCORSConfig 读取跨域配置
+func (fw *WMFrameWorkV2) loadCORSConfig() cors.Config {
+	origins := splitConfigList(fw.wmConf.GetItemDefault("cors_origins", "*", "允许跨域访问的来源，如https://a.com，用`,`分割多个来源，*-允许所有来源"))
+	methods := splitConfigList(fw.wmConf.GetItemDefault("cors_methods", "*", "允许跨域访问的方法，用`,`分割多个方法"))
+	headers := splitConfigList(fw.wmConf.GetItemDefault("cors_headers", "*", "允许跨域访问携带的请求头，用`,`分割多个请求头"))
+	expose := splitConfigList(fw.wmConf.GetItemDefault("cors_expose_headers", "", "允许跨域访问读取的返回头，用`,`分割多个返回头"))
+	credentials, _ := strconv.ParseBool(fw.wmConf.GetItemDefault("cors_credentials", "true", "是否允许跨域访问携带cookie等认证信息"))
+	maxage := gopsu.String2Int(fw.wmConf.GetItemDefault("cors_maxage", "86400", "跨域预检结果缓存时长（秒）"), 10)
+	fw.wmConf.Save()
+	conf := cors.Config{
+		MaxAge:           time.Second * time.Duration(maxage),
+		AllowCredentials: credentials,
+		AllowWildcard:    true,
+		AllowMethods:     methods,
+		AllowHeaders:     headers,
+		ExposeHeaders:    expose,
+	}
+	if len(conf.AllowMethods) == 0 {
+		conf.AllowMethods = []string{"*"}
+	}
+	if len(conf.AllowHeaders) == 0 {
+		conf.AllowHeaders = []string{"*"}
+	}
+	if len(origins) == 0 {
+		conf.AllowAllOrigins = true
+		return conf
+	}
+	allow := make([]string, 0, len(origins))
+	for _, v := range origins {
+		if v == "*" {
+			conf.AllowAllOrigins = true
+			return conf
+		}
+		// 格式错误时cors.New会panic
+		if !validCORSOrigin(v) {
+			fw.WriteError("CORS", "invalid cors_origins item, must start with http:// or https:// and contain at most one *: "+v)
+			continue
+		}
+		allow = append(allow, v)
+	}
+	if len(allow) == 0 {
+		// 没有有效的来源时禁止所有跨域访问
+		conf.AllowOriginFunc = func(string) bool { return false }
+		return conf
+	}
+	conf.AllowOrigins = allow
+	return conf
+}
+
+// validCORSOrigin 检查跨域来源格式
+func validCORSOrigin(origin string) bool {
+	if !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+		return false
+	}
+	return strings.Count(origin, "*") <= 1
+}
+
+// noRoute 未匹配的路由依次由网关和web页面处理，都不处理时返回404
+func (fw *WMFrameWorkV2) noRoute(c *gin.Context) {
+	if fw.gatewayNoRoute(c) || fw.webNoRoute(c) {
+		return
+	}
+	ginmiddleware.Page404(c)
 }
 
 // NewHTTPEngine 创建gin引擎
@@ -149,19 +250,16 @@ func (fw *WMFrameWorkV2) NewHTTPEngine(f ...gin.HandlerFunc) *gin.Engine {
 		gin.SetMode(gin.ReleaseMode)
 	}
 	r := gin.New()
+	fw.httpEngine = r
+	fw.loadAPIConfig()
 	// 中间件
 	//cors
-	r.Use(cors.New(cors.Config{
-		MaxAge:           time.Hour * 24,
-		AllowAllOrigins:  true,
-		AllowCredentials: true,
-		AllowWildcard:    true,
-		AllowMethods:     []string{"*"},
-		AllowHeaders:     []string{"*"},
-	}))
+	corsConf := fw.loadCORSConfig()
+	r.Use(cors.New(corsConf))
 
 	// 数据压缩
-	r.Use(gingzip.Gzip(9))
+	fw.loadCompressConfig()
+	r.Use(fw.Compress())
 	// 日志
 	logName := ""
 	if *logLevel > 1 {
@@ -170,6 +268,18 @@ func (fw *WMFrameWorkV2) NewHTTPEngine(f ...gin.HandlerFunc) *gin.Engine {
 	r.Use(ginmiddleware.LoggerWithRolling(gopsu.DefaultLogDir, logName, *logDays))
 	// 错误恢复
 	r.Use(ginmiddleware.Recovery())
+	// 客户端ip
+	fw.loadClientIPConfig()
+	// 请求id
+	fw.loadResponseConfig()
+	r.Use(fw.RequestID())
+	// 限流
+	fw.loadRateLimitConfig()
+	r.Use(fw.RateLimiter())
+	// 幂等
+	fw.loadIdempotencyConfig()
+	// 流量采集
+	r.Use(fw.Capture())
 	// 其他中间件
 	if f != nil {
 		r.Use(f...)
@@ -178,9 +288,15 @@ func (fw *WMFrameWorkV2) NewHTTPEngine(f ...gin.HandlerFunc) *gin.Engine {
 	// 404,405
 	r.HandleMethodNotAllowed = true
 	r.NoMethod(ginmiddleware.Page405)
-	r.NoRoute(ginmiddleware.Page404)
+	r.NoRoute(fw.noRoute)
+	// 网关
+	fw.gatewayRoutes(r)
+	// 推送
+	fw.pushRoutes(r, corsConf)
+	// 审计
+	fw.auditRoutes(r)
 	r.GET("/whoami", func(c *gin.Context) {
-		c.String(200, c.ClientIP())
+		c.String(200, fw.ClientIP(c))
 	})
 	r.GET("/devquotes", ginmiddleware.Page500)
 	r.GET("/health", ginmiddleware.PageDefault)
@@ -208,30 +324,18 @@ func (fw *WMFrameWorkV2) NewHTTPEngine(f ...gin.HandlerFunc) *gin.Engine {
 		h.Render(c.Writer)
 	})
 	r.Static("/static", gopsu.JoinPathFromHere("static"))
-	// apirecord
-	r.StaticFS("/apirec", http.FS(apirec))
-	r.GET("/apirecord/:switch", apidoc)
-	// 生成api访问文档
-	apidocPath = gopsu.JoinPathFromHere("docs", "apirecord-"+fw.serverName+".html")
-	os.MkdirAll(gopsu.JoinPathFromHere("docs"), 0755)
-	yaagConfig = &yaag.Config{
-		On:       false,
-		DocTitle: "Gin Web Framework API Record",
-		DocPath:  apidocPath,
-		BaseUrls: map[string]string{
-			"Server Name": fw.serverName,
-			"Core Author": "X.Yuan",
-			"Last Update": time.Now().Format(gopsu.LongTimeFormat),
-		},
-	}
-	yaag.Init(yaagConfig)
-	r.Use(yaaggin.Document())
+	// web页面
+	fw.webRoutes(r)
+	// 流量采集
+	fw.captureRoutes(r)
 	r.GET("/game/:game", game.GameGroup)
 	return r
 }
 
 // NewHTTPService 启动HTTP服务
 func (fw *WMFrameWorkV2) newHTTPService(r *gin.Engine) {
+	// api文档
+	fw.openapiRoutes(r)
 	var sss string
 	var findRoot bool
 	for _, v := range r.Routes() {
@@ -251,14 +355,20 @@ func (fw *WMFrameWorkV2) newHTTPService(r *gin.Engine) {
 		r.GET("/", ginmiddleware.PageDefault)
 	}
 	if sss != "" {
-		r.GET("/showroutes", gin.BasicAuth(gin.Accounts{
-			"whowants2seethis?": "iam,yourcreator.",
-		}),
-			func(c *gin.Context) {
-				c.Header("Content-Type", "text/html")
-				c.Status(http.StatusOK)
-				render.WriteString(c.Writer, sss, nil)
-			})
+		showRoutes := func(c *gin.Context) {
+			c.Header("Content-Type", "text/html")
+			c.Status(http.StatusOK)
+			render.WriteString(c.Writer, sss, nil)
+		}
+		user := fw.wmConf.GetItemDefault("showroutes_user", "", "/showroutes的访问用户名，留空时生产模式下不提供该页面")
+		pwd := fw.readSecret("showroutes_pwd", "/showroutes的访问密码")
+		fw.wmConf.Save()
+		switch {
+		case user != "" && pwd != "":
+			r.GET("/showroutes", gin.BasicAuth(gin.Accounts{user: pwd}), showRoutes)
+		case !fw.production():
+			r.GET("/showroutes", showRoutes)
+		}
 	}
 
 	var err error
@@ -285,16 +395,9 @@ func (fw *WMFrameWorkV2) listenAndServeTLS(port int, h *gin.Engine, certfile, ke
 	if !findRoot {
 		h.GET("/", ginmiddleware.PageDefault)
 	}
-	// 设置全局超时
-	st := ginmiddleware.GetSocketTimeout()
-	// 初始化
-	s := &http.Server{
-		Addr:         fmt.Sprintf(":%d", port),
-		Handler:      h,
-		ReadTimeout:  st,
-		WriteTimeout: st,
-		IdleTimeout:  st,
-	}
+	// 初始化，超时，监听地址等按配置设置
+	fw.loadServerConfig(port)
+	s := fw.newHTTPServer(h)
 	// 设置日志
 	var writer io.Writer
 	if gin.Mode() == gin.ReleaseMode {
@@ -304,30 +407,40 @@ func (fw *WMFrameWorkV2) listenAndServeTLS(port int, h *gin.Engine, certfile, ke
 	}
 	// 启动http服务
 	if strings.TrimSpace(certfile)+strings.TrimSpace(keyfile) == "" {
-		fmt.Fprintf(writer, "%s [90] [%s] %s\n", time.Now().Format(gopsu.ShortTimeFormat), "HTTP", "Success start HTTP server at :"+strconv.Itoa(port))
-		return s.ListenAndServe()
+		fmt.Fprintf(writer, "%s [90] [%s] %s\n", time.Now().Format(gopsu.ShortTimeFormat), "HTTP", "Success start HTTP server at "+strings.Join(fw.serverCtl.listens, ","))
+		return fw.serve(s, false)
+	}
+	// 初始化证书，通过GetCertificate读取，更新证书时原子替换
+	fw.loadCertConfig(certfile, keyfile)
+	if err := fw.initCert(); err != nil {
+		return err
 	}
-	// 初始化证书
 	var tc = &tls.Config{
-		Certificates: make([]tls.Certificate, 1),
+		GetCertificate: fw.certCtl.getCertificate,
 	}
-	var err error
-	tc.Certificates[0], err = tls.LoadX509KeyPair(certfile, keyfile)
-	if err != nil {
+	// 客户端证书校验
+	fw.loadMTLSConfig()
+	if err := fw.applyMTLS(tc, clientca); err != nil {
 		return err
 	}
-	if len(clientca) > 0 {
-		pool := x509.NewCertPool()
-		caCrt, err := ioutil.ReadFile(clientca)
-		if err == nil {
-			pool.AppendCertsFromPEM(caCrt)
-			tc.ClientCAs = pool
-			tc.ClientAuth = tls.RequireAndVerifyClientCert
-		}
-	}
 	s.TLSConfig = tc
 	// 添加手动更新路由
-	h.GET("/cert/:do", func(c *gin.Context) {
+	h.GET("/metrics/cert", fw.certMetrics)
+	fw.DocRoute("GET", "/cert/:do", &RouteDoc{Summary: "更新证书", Tags: []string{"framework"}, Token: true})
+	h.GET("/cert/:do", fw.PrepareToken(true), fw.Authorize("cert_admin"), func(c *gin.Context) {
+		if do, ok := c.Params.Get("do"); ok && do == "renew" && fw.certCtl.acme {
+			// 未到更新时间时不申请，避免触发acme服务的频率限制
+			if na := fw.certCtl.notAfter(); time.Until(na) > fw.certCtl.renewBefore {
+				c.String(200, "the certificate is valid until "+na.Format(gopsu.LongTimeFormat)+", no need to renew")
+				return
+			}
+			if err := fw.obtainCert(); err != nil {
+				c.String(400, err.Error())
+				return
+			}
+			c.String(200, "the certificate has been renewed")
+			return
+		}
 		if do, ok := c.Params.Get("do"); ok && do == "renew" {
 			var spath = gopsu.JoinPathFromHere("sslrenew")
 			if gopsu.OSNAME == "windows" {
@@ -352,10 +465,10 @@ func (fw *WMFrameWorkV2) listenAndServeTLS(port int, h *gin.Engine, certfile, ke
 		c.String(200, "the certificate file has been reloaded")
 	})
 	// 启动证书维护线程
-	go fw.renewCA(s, certfile, keyfile)
+	go fw.renewCA()
 	// 启动https
-	fmt.Fprintf(writer, "%s [90] [%s] %s\n", time.Now().Format(gopsu.ShortTimeFormat), "HTTP", "Success start HTTPS server at :"+strconv.Itoa(port))
-	return s.ListenAndServeTLS("", "")
+	fmt.Fprintf(writer, "%s [90] [%s] %s\n", time.Now().Format(gopsu.ShortTimeFormat), "HTTP", "Success start HTTPS server at "+strings.Join(fw.serverCtl.listens, ","))
+	return fw.serve(s, true)
 }
 
 func (fw *WMFrameWorkV2) RenewCA() bool {
@@ -363,8 +476,8 @@ func (fw *WMFrameWorkV2) RenewCA() bool {
 	return true
 }
 
-// 后台更新证书
-func (fw *WMFrameWorkV2) renewCA(s *http.Server, certfile, keyfile string) {
+// 后台更新证书，定时重新读取证书文件并检查有效期
+func (fw *WMFrameWorkV2) renewCA() {
 RUN:
 	func() {
 		defer func() {
@@ -375,12 +488,13 @@ RUN:
 		for {
 			select {
 			case <-fw.chanSSLRenew:
-				newcert, err := tls.LoadX509KeyPair(certfile, keyfile)
-				if err == nil {
-					s.TLSConfig.Certificates[0] = newcert
+				if err := fw.certCtl.loadCert(); err != nil {
+					fw.WriteError("CERT", "Failed reload certificate|"+err.Error())
 				}
-			case <-time.After(time.Hour * time.Duration(1+rand.Int31n(5))):
-				fw.chanSSLRenew <- 1
+			case <-time.After(time.Hour):
+				fw.rotateLocalCert(fw.certCtl.renewBefore)
+				fw.certCtl.loadCert()
+				fw.checkCert()
 			}
 		}
 	}()
@@ -552,6 +666,9 @@ func (fw *WMFrameWorkV2) pageStatus(c *gin.Context) {
 		c.Set("server_time", statusInfo["timer"].(string))
 		c.Set("start_at", statusInfo["startat"].(string))
 		c.Set("ver", gjson.Parse(fw.verJSON).Value())
+		if na := fw.CertExpireAt(); !na.IsZero() {
+			c.Set("cert_expire", na.Format(gopsu.LongTimeFormat))
+		}
 		c.Set("conf", gjson.Parse(fw.wmConf.GetAll()).Value())
 		c.PureJSON(200, c.Keys)
 	}
@@ -566,6 +683,24 @@ func (fw *WMFrameWorkV2) PrepareToken(forceAbort ...bool) gin.HandlerFunc {
 	}
 	return func(c *gin.Context) {
 		uuid := c.GetHeader("User-Token")
+		// 服务间调用使用已配置身份的客户端证书时，不需要User-Token
+		if id, mapped := fw.clientIdentity(c); uuid == "" && mapped {
+			c.Params = append(c.Params, gin.Param{
+				Key:   "_clientIdentity",
+				Value: id,
+			})
+			c.Params = append(c.Params, gin.Param{
+				Key:   "_userTokenName",
+				Value: id,
+			})
+			if fw.mtlsCtl.admins[id] {
+				c.Params = append(c.Params, gin.Param{
+					Key:   "_userAsAdmin",
+					Value: "1",
+				})
+			}
+			return
+		}
 		if len(uuid) != 36 {
 			if shouldAbort {
 				c.Set("status", 0)
@@ -685,7 +820,15 @@ func (fw *WMFrameWorkV2) GoUUID(uuid, username string) (string, bool) {
 	var req *http.Request
 	req, _ = http.NewRequest("GET", addr+"/usermanager/v1/user/fixed/login?user_name="+username, strings.NewReader(""))
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Legal-High", gopsu.CalculateSecurityCode("m", time.Now().Month().String(), 0)[0])
+	switch {
+	case fw.legalHigh != "":
+		req.Header.Add("Legal-High", fw.legalHigh)
+	case fw.legalHighLegacy:
+		req.Header.Add("Legal-High", gopsu.CalculateSecurityCode("m", time.Now().Month().String(), 0)[0])
+	case fw.production():
+		fw.WriteError("CORE", "get uuid error: uuid_legal is not configured")
+		return "", false
+	}
 	resp, err := fw.httpClientPool.Do(req)
 	if err != nil {
 		fw.WriteError("CORE", "get uuid error:"+err.Error())
@@ -705,10 +848,7 @@ func (fw *WMFrameWorkV2) GoUUID(uuid, username string) (string, bool) {
 func (fw *WMFrameWorkV2) DealWithSQLError(c *gin.Context, err error) bool {
 	if err != nil {
 		fw.WriteError("SQL", c.Request.RequestURI+"|"+err.Error())
-		c.Set("status", 0)
-		c.Set("detail", "sql error")
-		c.Set("xfile", 3)
-		c.PureJSON(500, c.Keys)
+		fw.Fail(c, ErrSQL, nil)
 		return true
 	}
 	return false
@@ -0,0 +1,247 @@
+package wmv2
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/xyzj/gopsu"
+)
+
+// 幂等配置
+type idempotencyConfigure struct {
+	forshow string
+	// 返回结果保存时长
+	ttl time.Duration
+	// 处理中标记的最长时长，超过后允许重新执行
+	lockTTL time.Duration
+	// 保存的返回数据最大字节数，超过时不保存
+	maxBody int
+	// 保存处理状态和结果，为nil时使用redis
+	store idempotencyStore
+}
+
+// idempotencyStore 幂等数据存储，不存在时get返回redis.Nil
+type idempotencyStore interface {
+	setNX(key, value string, ttl time.Duration) (bool, error)
+	get(key string) (string, error)
+	set(key, value string, ttl time.Duration) error
+	del(key string)
+}
+
+// redisIdempotencyStore 使用redis保存，多个实例共享
+type redisIdempotencyStore struct {
+	cli *redis.Client
+}
+
+func (s *redisIdempotencyStore) setNX(key, value string, ttl time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisCtxTimeo)
+	defer cancel()
+	return s.cli.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (s *redisIdempotencyStore) get(key string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisCtxTimeo)
+	defer cancel()
+	return s.cli.Get(ctx, key).Result()
+}
+
+func (s *redisIdempotencyStore) set(key, value string, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisCtxTimeo)
+	defer cancel()
+	return s.cli.Set(ctx, key, value, ttl).Err()
+}
+
+func (s *redisIdempotencyStore) del(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisCtxTimeo)
+	defer cancel()
+	s.cli.Del(ctx, key)
+}
+
+// idempotencyStore 返回可用的存储，redis未启用时返回nil
+func (fw *WMFrameWorkV2) idempotencyStore() idempotencyStore {
+	if fw.idemCtl.store != nil {
+		return fw.idemCtl.store
+	}
+	if !fw.redisCtl.enable || fw.redisCtl.client == nil {
+		return nil
+	}
+	return &redisIdempotencyStore{cli: fw.redisCtl.client}
+}
+
+func (conf *idempotencyConfigure) show() string {
+	conf.forshow, _ = sjson.Set("", "ttl", conf.ttl.String())
+	conf.forshow, _ = sjson.Set(conf.forshow, "lock_ttl", conf.lockTTL.String())
+	conf.forshow, _ = sjson.Set(conf.forshow, "max_body", conf.maxBody)
+	return conf.forshow
+}
+
+func (fw *WMFrameWorkV2) loadIdempotencyConfig() {
+	fw.idemCtl.ttl = time.Second * time.Duration(gopsu.String2Int(fw.wmConf.GetItemDefault("idempotency_ttl", "86400", "Idempotency-Key对应的返回结果保存时长（秒）"), 10))
+	fw.idemCtl.lockTTL = time.Second * time.Duration(gopsu.String2Int(fw.wmConf.GetItemDefault("idempotency_lock_ttl", "60", "相同Idempotency-Key的请求处理中时拒绝重复请求的最长时长（秒），应大于接口的最长处理时间"), 10))
+	fw.idemCtl.maxBody = gopsu.String2Int(fw.wmConf.GetItemDefault("idempotency_max_body", "1048576", "保存的返回数据最大字节数，超过时不保存，重复请求会再次执行"), 10)
+	fw.wmConf.Save()
+	if fw.idemCtl.ttl <= 0 {
+		fw.idemCtl.ttl = time.Hour * 24
+	}
+	if fw.idemCtl.lockTTL <= 0 {
+		fw.idemCtl.lockTTL = time.Minute
+	}
+	fw.idemCtl.show()
+}
+
+// idempotencyWriter 记录返回数据
+type idempotencyWriter struct {
+	gin.ResponseWriter
+	buf      bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (w *idempotencyWriter) Write(b []byte) (int, error) {
+	if !w.overflow {
+		if w.buf.Len()+len(b) > w.max {
+			w.overflow = true
+			w.buf.Reset()
+		} else {
+			w.buf.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *idempotencyWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Idempotency 按Idempotency-Key请求头保证POST等修改类接口只执行一次，需启用redis
+// 首次请求的返回结果保存到redis，相同key的重复请求直接返回保存的结果，并设置Idempotent-Replayed头，
+// 首次请求处理中时，重复请求返回409，相同key的请求参数不同时返回参数错误，
+// 返回5xx时不保存结果，允许客户端重试；提供了Idempotency-Key但redis不可用时返回503，不执行请求
+// required: 是否必须提供Idempotency-Key，默认false，未提供时正常执行
+func (fw *WMFrameWorkV2) Idempotency(required ...bool) gin.HandlerFunc {
+	mustHave := len(required) > 0 && required[0]
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+		idemKey := c.GetHeader("Idempotency-Key")
+		if idemKey == "" {
+			if mustHave {
+				fw.Fail(c, ErrParams, fmt.Errorf("Idempotency-Key is required"))
+			}
+			return
+		}
+		if len(idemKey) > 255 {
+			fw.Fail(c, ErrParams, fmt.Errorf("Idempotency-Key is too long"))
+			return
+		}
+		store := fw.idempotencyStore()
+		if store == nil {
+			fw.Fail(c, ErrUnavailable, fmt.Errorf("redis is not ready, can not check Idempotency-Key"))
+			return
+		}
+		// 按用户隔离，避免不同用户使用相同的key
+		owner := c.GetHeader("User-Token")
+		if owner == "" {
+			owner = fw.ClientIP(c)
+		}
+		key := fw.AppendRootPathRedis("idempotency/" + MD5Worker.Hash([]byte(owner+"|"+c.Request.Method+"|"+c.Request.URL.Path+"|"+idemKey)))
+		// 请求参数指纹
+		var body []byte
+		if c.Request.Body != nil {
+			body, _ = ioutil.ReadAll(c.Request.Body)
+			c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		fingerprint := MD5Worker.Hash(append([]byte(c.Request.URL.RawQuery+"|"), body...))
+
+		processing, _ := sjson.Set("", "fingerprint", fingerprint)
+		// 其他请求的结果在SetNX和Get之间过期或被删除时重试
+		for i := 0; ; i++ {
+			ok, err := store.setNX(key, processing, fw.idemCtl.lockTTL)
+			if err != nil {
+				fw.WriteError("IDEM", "Failed write redis data: "+key+"|"+err.Error())
+				fw.Fail(c, ErrUnavailable, fmt.Errorf("can not check Idempotency-Key"))
+				return
+			}
+			if ok {
+				break
+			}
+			s, err := store.get(key)
+			if err == redis.Nil && i < 2 {
+				continue
+			}
+			if err != nil {
+				fw.Fail(c, ErrConflict, fmt.Errorf("request with the same Idempotency-Key is in progress"))
+				return
+			}
+			fw.replayIdempotency(c, gjson.Parse(s), fingerprint)
+			return
+		}
+
+		w := &idempotencyWriter{ResponseWriter: c.Writer, max: fw.idemCtl.maxBody}
+		c.Writer = w
+		finished := false
+		defer func() {
+			c.Writer = w.ResponseWriter
+			if finished {
+				return
+			}
+			// 处理方法panic时删除处理中标记，允许客户端重试
+			store.del(key)
+		}()
+		c.Next()
+		finished = true
+
+		status := w.Status()
+		if status >= 500 || w.overflow {
+			store.del(key)
+			return
+		}
+		done, _ := sjson.Set(processing, "done", true)
+		done, _ = sjson.Set(done, "status", status)
+		done, _ = sjson.Set(done, "content_type", w.Header().Get("Content-Type"))
+		done, _ = sjson.Set(done, "body", base64.StdEncoding.EncodeToString(w.buf.Bytes()))
+		if err := store.set(key, done, fw.idemCtl.ttl); err != nil {
+			fw.WriteError("IDEM", "Failed write redis data: "+key+"|"+err.Error())
+		}
+	}
+}
+
+// replayIdempotency 返回保存的结果
+func (fw *WMFrameWorkV2) replayIdempotency(c *gin.Context, saved gjson.Result, fingerprint string) {
+	if saved.Get("fingerprint").String() != fingerprint {
+		fw.Fail(c, ErrParams, fmt.Errorf("Idempotency-Key has been used with different parameters"))
+		return
+	}
+	if !saved.Get("done").Bool() {
+		fw.Fail(c, ErrConflict, fmt.Errorf("request with the same Idempotency-Key is in progress"))
+		return
+	}
+	b, _ := base64.StdEncoding.DecodeString(saved.Get("body").String())
+	c.Header("Idempotent-Replayed", "true")
+	c.Abort()
+	c.Data(int(saved.Get("status").Int()), saved.Get("content_type").String(), b)
+}
+
+// WithIdempotency 使用Idempotency中间件
+func WithIdempotency(required ...bool) APIOption {
+	return func(r *apiRoute) {
+		r.idempotent = true
+		r.idemMust = len(required) > 0 && required[0]
+	}
+}
+
+// ViewIdempotencyConfig 查看幂等配置，返回json字符串
+func (fw *WMFrameWorkV2) ViewIdempotencyConfig() string {
+	return fw.idemCtl.forshow
+}
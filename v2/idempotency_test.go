@@ -0,0 +1,177 @@
+package wmv2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/tidwall/gjson"
+	"github.com/xyzj/gopsu"
+)
+
+// memIdempotencyStore 测试使用的内存存储，不处理过期
+type memIdempotencyStore struct {
+	locker sync.Mutex
+	data   map[string]string
+}
+
+func (s *memIdempotencyStore) setNX(key, value string, ttl time.Duration) (bool, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if _, ok := s.data[key]; ok {
+		return false, nil
+	}
+	s.data[key] = value
+	return true, nil
+}
+
+func (s *memIdempotencyStore) get(key string) (string, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if v, ok := s.data[key]; ok {
+		return v, nil
+	}
+	return "", redis.Nil
+}
+
+func (s *memIdempotencyStore) set(key, value string, ttl time.Duration) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.data[key] = value
+	return nil
+}
+
+func (s *memIdempotencyStore) del(key string) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	delete(s.data, key)
+}
+
+func newIdempotencyTestFW(store idempotencyStore) *WMFrameWorkV2 {
+	return &WMFrameWorkV2{
+		wmLog:    &gopsu.NilLogger{},
+		redisCtl: &redisConfigure{},
+		idemCtl: &idempotencyConfigure{
+			ttl:     time.Hour,
+			lockTTL: time.Minute,
+			maxBody: 1024,
+			store:   store,
+		},
+	}
+}
+
+func idempotencyPost(r *gin.Engine, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/cmd", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fw := newIdempotencyTestFW(&memIdempotencyStore{data: make(map[string]string)})
+	var runs int
+	hold := make(chan struct{})
+	entered := make(chan struct{})
+	r := gin.New()
+	r.POST("/cmd", fw.Idempotency(), func(c *gin.Context) {
+		runs++
+		if c.GetHeader("Idempotency-Key") == "slow" {
+			entered <- struct{}{}
+			<-hold
+		}
+		c.String(201, "done")
+	})
+	// 首次请求执行，重复请求返回保存的结果
+	if w := idempotencyPost(r, "k1", `{"a":1}`); w.Code != 201 || w.Body.String() != "done" {
+		t.Fatalf("first: %d %s", w.Code, w.Body.String())
+	}
+	w := idempotencyPost(r, "k1", `{"a":1}`)
+	if w.Code != 201 || w.Header().Get("Idempotent-Replayed") != "true" || runs != 1 {
+		t.Fatalf("replay: %d %v runs=%d", w.Code, w.Header(), runs)
+	}
+	// 参数不同
+	if w := idempotencyPost(r, "k1", `{"a":2}`); w.Code != http.StatusBadRequest || runs != 1 {
+		t.Fatalf("fingerprint: %d runs=%d", w.Code, runs)
+	}
+	// 处理中的重复请求
+	done := make(chan struct{})
+	go func() {
+		idempotencyPost(r, "slow", "")
+		close(done)
+	}()
+	<-entered
+	if w := idempotencyPost(r, "slow", ""); w.Code != http.StatusConflict {
+		t.Fatalf("in progress: %d", w.Code)
+	}
+	close(hold)
+	<-done
+}
+
+func TestIdempotencyPanic(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := &memIdempotencyStore{data: make(map[string]string)}
+	fw := newIdempotencyTestFW(store)
+	r := gin.New()
+	r.Use(gin.CustomRecovery(func(c *gin.Context, err interface{}) {
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}))
+	r.POST("/cmd", fw.Idempotency(), func(c *gin.Context) {
+		panic("boom")
+	})
+	if w := idempotencyPost(r, "k", ""); w.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d", w.Code)
+	}
+	// 处理中标记已删除，允许重试
+	if len(store.data) != 0 {
+		t.Fatalf("marker should be removed: %v", store.data)
+	}
+}
+
+func TestIdempotencyWithoutStore(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fw := newIdempotencyTestFW(nil)
+	var runs int
+	r := gin.New()
+	r.POST("/cmd", fw.Idempotency(), func(c *gin.Context) {
+		runs++
+	})
+	if w := idempotencyPost(r, "k", ""); w.Code != http.StatusServiceUnavailable || runs != 0 {
+		t.Fatalf("got %d runs=%d", w.Code, runs)
+	}
+}
+
+func TestReplayIdempotency(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fw := &WMFrameWorkV2{}
+	replay := func(saved string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request, _ = http.NewRequest("POST", "/", nil)
+		fw.replayIdempotency(c, gjson.Parse(saved), "fp")
+		return w
+	}
+	// 保存的结果
+	w := replay(`{"fingerprint":"fp","done":true,"status":201,"content_type":"application/json","body":"eyJpZCI6MX0="}`)
+	if w.Code != 201 || w.Body.String() != `{"id":1}` || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("unexpected replay %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("content type %q", ct)
+	}
+	// 处理中
+	if w := replay(`{"fingerprint":"fp"}`); w.Code != http.StatusConflict {
+		t.Fatalf("in progress: got %d", w.Code)
+	}
+	// 参数不同
+	if w := replay(`{"fingerprint":"other","done":true,"status":200}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("different params: got %d", w.Code)
+	}
+}
@@ -0,0 +1,327 @@
+package wmv2
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/xyzj/gopsu"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// ErrLockUnavailable etcd和redis均未启用，无法使用分布式锁
+var ErrLockUnavailable = fmt.Errorf("neither etcd nor redis is enabled")
+
+// 锁租约时长，持有者异常退出后超过该时长自动释放
+const lockTTL = 15
+
+var (
+	// 续期，仅持有者可续期
+	luaLockRenew = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0`)
+	// 释放，仅持有者可释放
+	luaLockRelease = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`)
+)
+
+// heldLock 已获取的锁
+type heldLock struct {
+	// 锁丢失时关闭，如租约过期或连接断开
+	lost <-chan struct{}
+	// 释放锁
+	release func()
+}
+
+// useETCDLock 启用etcd时使用etcd，否则使用redis
+// 按配置而非连接状态选择，避免多实例使用不同的实现
+func (fw *WMFrameWorkV2) useETCDLock() (bool, error) {
+	if fw.cnf.UseETCD != nil && fw.cnf.UseETCD.Activation && fw.etcdCtl.enable {
+		return true, fw.newRegistryClient()
+	}
+	if fw.redisCtl.enable {
+		return false, nil
+	}
+	return false, ErrLockUnavailable
+}
+
+// lockInstanceID 本实例标识，记录在锁和选举信息中
+func (fw *WMFrameWorkV2) lockInstanceID() string {
+	return fw.serverName + "-" + gopsu.RealIP(fw.etcdCtl.v6) + "-" + gopsu.GetUUID1()
+}
+
+// tryETCD 使用etcd租约尝试获取一次锁，已被其他实例持有时返回nil
+// 未使用concurrency包，go.etcd.io/etcd v3.3的concurrency依赖github.com/coreos/etcd/clientv3
+func (fw *WMFrameWorkV2) tryETCD(ctx context.Context, key, value string) (*heldLock, error) {
+	cli := fw.etcdCtl.cli
+	lease, err := cli.Grant(ctx, lockTTL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value, clientv3.WithLease(lease.ID))).
+		Commit()
+	if err != nil || !resp.Succeeded {
+		rctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		cli.Revoke(rctx, lease.ID)
+		cancel()
+		return nil, err
+	}
+	kctx, kcancel := context.WithCancel(context.Background())
+	ka, err := cli.KeepAlive(kctx, lease.ID)
+	if err != nil {
+		kcancel()
+		rctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		cli.Revoke(rctx, lease.ID)
+		cancel()
+		return nil, err
+	}
+	lost := make(chan struct{})
+	go func() {
+		defer close(lost)
+		for range ka {
+		}
+	}()
+	return &heldLock{
+		lost: lost,
+		release: func() {
+			kcancel()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+			defer cancel()
+			// 撤销租约同时删除锁
+			cli.Revoke(ctx, lease.ID)
+		},
+	}, nil
+}
+
+// acquireETCD 使用etcd获取锁，阻塞直到获取成功或ctx结束
+func (fw *WMFrameWorkV2) acquireETCD(ctx context.Context, name string) (*heldLock, error) {
+	key := "/" + fw.rootPath + "/locks/" + name
+	value := fw.lockInstanceID()
+	for {
+		l, err := fw.tryETCD(ctx, key, value)
+		if l != nil {
+			return l, nil
+		}
+		if err != nil && ctx.Err() == nil {
+			fw.WriteWarning("LOCK", "etcd lock "+name+" error|"+err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond * 200):
+		}
+	}
+}
+
+// tryRedis 使用redis尝试获取一次锁，已被其他实例持有时返回nil
+func (fw *WMFrameWorkV2) tryRedis(ctx context.Context, name string) (*heldLock, error) {
+	key := fw.AppendRootPathRedis("locks/" + name)
+	token := fw.lockInstanceID()
+	ok, err := fw.redisCtl.client.SetNX(ctx, key, token, time.Second*lockTTL).Result()
+	if err != nil || !ok {
+		return nil, err
+	}
+	lost := make(chan struct{})
+	stop := make(chan struct{})
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				fw.WriteError("LOCK", fmt.Sprintf("redis lock renew crash: %+v", errors.WithStack(err.(error))))
+			}
+		}()
+		defer close(lost)
+		t := time.NewTicker(time.Second * lockTTL / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				rctx, cancel := context.WithTimeout(context.Background(), redisCtxTimeo)
+				n, err := luaLockRenew.Run(rctx, fw.redisCtl.client, []string{key}, token, lockTTL*1000).Int()
+				cancel()
+				if err != nil || n == 0 {
+					return
+				}
+			}
+		}
+	}()
+	return &heldLock{
+		lost: lost,
+		release: func() {
+			close(stop)
+			ctx, cancel := context.WithTimeout(context.Background(), redisCtxTimeo)
+			defer cancel()
+			luaLockRelease.Run(ctx, fw.redisCtl.client, []string{key}, token)
+		},
+	}, nil
+}
+
+// acquireRedis 使用redis获取锁，阻塞直到获取成功或ctx结束，持有期间定时续期
+func (fw *WMFrameWorkV2) acquireRedis(ctx context.Context, name string) (*heldLock, error) {
+	for {
+		if l, err := fw.tryRedis(ctx, name); l != nil {
+			return l, nil
+		} else if err != nil && ctx.Err() == nil {
+			fw.WriteWarning("LOCK", "redis lock "+name+" error|"+err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond * 200):
+		}
+	}
+}
+
+func (fw *WMFrameWorkV2) acquireLock(ctx context.Context, name string) (*heldLock, error) {
+	useETCD, err := fw.useETCDLock()
+	if err != nil {
+		return nil, err
+	}
+	if useETCD {
+		return fw.acquireETCD(ctx, name)
+	}
+	return fw.acquireRedis(ctx, name)
+}
+
+// Lock 获取分布式锁，阻塞直到获取成功或ctx结束
+// 启用etcd时使用etcd，否则使用redis，均未启用时返回ErrLockUnavailable
+// 返回释放锁的方法，使用完毕后必须调用
+func (fw *WMFrameWorkV2) Lock(ctx context.Context, name string) (func(), error) {
+	l, err := fw.acquireLock(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return l.release, nil
+}
+
+// TryLock 尝试获取分布式锁，不等待，已被其他实例持有时ok为false
+// 获取成功时返回释放锁的方法，使用完毕后必须调用
+func (fw *WMFrameWorkV2) TryLock(name string) (release func(), ok bool, err error) {
+	useETCD, err := fw.useETCDLock()
+	if err != nil {
+		return nil, false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	var l *heldLock
+	if useETCD {
+		l, err = fw.tryETCD(ctx, "/"+fw.rootPath+"/locks/"+name, fw.lockInstanceID())
+	} else {
+		l, err = fw.tryRedis(ctx, name)
+	}
+	if l == nil {
+		return nil, false, err
+	}
+	return l.release, true, nil
+}
+
+// RunOncePerDay 多实例中每天仅由一个实例执行f
+// 获取不到锁时直接返回，不等待；执行后记录当天日期，其他实例当天不再执行
+// etcd和redis均未启用时直接执行
+func (fw *WMFrameWorkV2) RunOncePerDay(name string, f func()) error {
+	release, ok, err := fw.TryLock(name)
+	if err == ErrLockUnavailable {
+		f()
+		return nil
+	}
+	if err != nil || !ok {
+		return err
+	}
+	defer release()
+	today := time.Now().Format("2006-01-02")
+	if fw.readLockMark(name) == today {
+		return nil
+	}
+	f()
+	return fw.writeLockMark(name, today)
+}
+
+// readLockMark 读取执行标记，与锁使用相同的存储
+func (fw *WMFrameWorkV2) readLockMark(name string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if useETCD, _ := fw.useETCDLock(); useETCD {
+		resp, err := fw.etcdCtl.cli.Get(ctx, "/"+fw.rootPath+"/locks-done/"+name)
+		if err != nil || len(resp.Kvs) == 0 {
+			return ""
+		}
+		return string(resp.Kvs[0].Value)
+	}
+	s, _ := fw.redisCtl.client.Get(ctx, fw.AppendRootPathRedis("locks-done/"+name)).Result()
+	return s
+}
+
+// writeLockMark 记录执行标记
+func (fw *WMFrameWorkV2) writeLockMark(name, mark string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if useETCD, _ := fw.useETCDLock(); useETCD {
+		_, err := fw.etcdCtl.cli.Put(ctx, "/"+fw.rootPath+"/locks-done/"+name, mark)
+		return err
+	}
+	return fw.redisCtl.client.Set(ctx, fw.AppendRootPathRedis("locks-done/"+name), mark, time.Hour*48).Err()
+}
+
+// Campaign 参与选举，多实例中仅有一个实例成为leader，用于执行单例任务
+// 后台运行，ctx结束时退出选举
+// onElected: 成为leader时调用，参数ctx在失去leader身份时结束，任务应在ctx结束后退出
+// onRevoked: 失去leader身份时调用，可为nil
+func (fw *WMFrameWorkV2) Campaign(ctx context.Context, name string, onElected func(context.Context), onRevoked func()) {
+	go func() {
+		for ctx.Err() == nil {
+			func() {
+				defer func() {
+					if err := recover(); err != nil {
+						fw.WriteError("LOCK", fmt.Sprintf("campaign crash: %+v", errors.WithStack(err.(error))))
+					}
+				}()
+				l, err := fw.campaign(ctx, name)
+				if err != nil {
+					if ctx.Err() == nil {
+						fw.WriteError("LOCK", "campaign "+name+" error|"+err.Error())
+					}
+					return
+				}
+				defer l.release()
+				fw.WriteInfo("LOCK", "elected as leader of "+name)
+				lctx, cancel := context.WithCancel(ctx)
+				go onElected(lctx)
+				select {
+				case <-ctx.Done():
+				case <-l.lost:
+				}
+				cancel()
+				fw.WriteInfo("LOCK", "revoked from leader of "+name)
+				if onRevoked != nil {
+					onRevoked()
+				}
+			}()
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second * 3):
+			}
+		}
+	}()
+}
+
+// campaign 参与一次选举，阻塞直到成为leader
+func (fw *WMFrameWorkV2) campaign(ctx context.Context, name string) (*heldLock, error) {
+	useETCD, err := fw.useETCDLock()
+	if err != nil {
+		return nil, err
+	}
+	if !useETCD {
+		return fw.acquireRedis(ctx, "election/"+name)
+	}
+	return fw.acquireETCD(ctx, "election/"+name)
+}
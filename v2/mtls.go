@@ -0,0 +1,164 @@
+package wmv2
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/sjson"
+)
+
+// mTLS模式
+const (
+	// MTLSOff 不要求客户端证书
+	MTLSOff = "off"
+	// MTLSOptional 客户端提供证书时校验
+	MTLSOptional = "optional"
+	// MTLSRequired 必须提供有效的客户端证书
+	MTLSRequired = "required"
+)
+
+// mTLS配置
+type mtlsConfigure struct {
+	forshow string
+	// 模式
+	mode string
+	// 客户端证书的ca文件
+	clientCA string
+	// 证书主体-身份，主体格式为cn:xxx，dns:xxx，uri:xxx，email:xxx
+	identities map[string]string
+	// 视为管理员的身份
+	admins map[string]bool
+}
+
+func (conf *mtlsConfigure) show() string {
+	conf.forshow, _ = sjson.Set("", "mode", conf.mode)
+	conf.forshow, _ = sjson.Set(conf.forshow, "client_ca", conf.clientCA)
+	conf.forshow, _ = sjson.Set(conf.forshow, "identities", conf.identities)
+	conf.forshow, _ = sjson.Set(conf.forshow, "admin_identities", conf.admins)
+	return conf.forshow
+}
+
+func (fw *WMFrameWorkV2) loadMTLSConfig() {
+	fw.mtlsCtl.mode = strings.ToLower(fw.wmConf.GetItemDefault("http_mtls", MTLSOff, "https服务是否校验客户端证书，off-不校验，optional-提供证书时校验，required-必须提供证书"))
+	fw.mtlsCtl.clientCA = fw.wmConf.GetItemDefault("http_client_ca", "", "校验客户端证书的ca文件，可包含多个ca，留空使用框架ca")
+	ids := splitConfigList(fw.wmConf.GetItemDefault("http_mtls_identities", "", "客户端证书与身份的对应关系，格式为主体=身份，用`,`分割多个，主体可以是cn:xxx，dns:xxx，uri:xxx，email:xxx"))
+	admins := splitConfigList(fw.wmConf.GetItemDefault("http_mtls_admin_identities", "", "视为管理员的客户端证书身份，用`,`分割多个，其他身份不能访问需要接口权限的路由"))
+	fw.wmConf.Save()
+	fw.mtlsCtl.admins = make(map[string]bool)
+	for _, v := range admins {
+		fw.mtlsCtl.admins[v] = true
+	}
+	fw.mtlsCtl.identities = make(map[string]string)
+	for _, v := range ids {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) == 2 {
+			fw.mtlsCtl.identities[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+		}
+	}
+	switch fw.mtlsCtl.mode {
+	case MTLSOptional, MTLSRequired:
+	default:
+		fw.mtlsCtl.mode = MTLSOff
+	}
+	if fw.mtlsCtl.clientCA == "" {
+		fw.mtlsCtl.clientCA = fw.tlsRoot
+	}
+	fw.mtlsCtl.show()
+}
+
+// applyMTLS 设置https服务的客户端证书校验
+func (fw *WMFrameWorkV2) applyMTLS(tc *tls.Config, clientca string) error {
+	mode := fw.mtlsCtl.mode
+	if clientca == "" {
+		clientca = fw.mtlsCtl.clientCA
+	} else if mode == MTLSOff {
+		// 兼容直接指定clientca的调用
+		mode = MTLSRequired
+	}
+	if mode == MTLSOff {
+		return nil
+	}
+	b, err := ioutil.ReadFile(clientca)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(b)
+	tc.ClientCAs = pool
+	if mode == MTLSRequired {
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return nil
+}
+
+// certSubjects 证书的所有主体
+func certSubjects(cert *x509.Certificate) []string {
+	ss := make([]string, 0, 1+len(cert.DNSNames)+len(cert.URIs)+len(cert.EmailAddresses))
+	if cert.Subject.CommonName != "" {
+		ss = append(ss, "cn:"+cert.Subject.CommonName)
+	}
+	for _, v := range cert.URIs {
+		ss = append(ss, "uri:"+v.String())
+	}
+	for _, v := range cert.DNSNames {
+		ss = append(ss, "dns:"+v)
+	}
+	for _, v := range cert.EmailAddresses {
+		ss = append(ss, "email:"+v)
+	}
+	return ss
+}
+
+// clientIdentity 从已校验的客户端证书获取身份，返回身份和是否为配置的身份
+// 未配置对应关系时使用证书cn
+func (fw *WMFrameWorkV2) clientIdentity(c *gin.Context) (string, bool) {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 || len(c.Request.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	cert := c.Request.TLS.VerifiedChains[0][0]
+	for _, s := range certSubjects(cert) {
+		if id, ok := fw.mtlsCtl.identities[strings.ToLower(s)]; ok {
+			return id, true
+		}
+	}
+	return cert.Subject.CommonName, false
+}
+
+// ClientIdentity 返回客户端证书对应的身份，未提供有效客户端证书时返回false
+func (fw *WMFrameWorkV2) ClientIdentity(c *gin.Context) (string, bool) {
+	if id, ok := c.Params.Get("_clientIdentity"); ok {
+		return id, true
+	}
+	id, _ := fw.clientIdentity(c)
+	return id, id != ""
+}
+
+// RequireClientCert 要求客户端提供有效证书，并且身份在指定列表中
+// identities: 允许的身份，为空时允许所有配置了对应关系的身份
+func (fw *WMFrameWorkV2) RequireClientCert(identities ...string) gin.HandlerFunc {
+	allow := make(map[string]bool)
+	for _, v := range identities {
+		allow[v] = true
+	}
+	return func(c *gin.Context) {
+		id, mapped := fw.clientIdentity(c)
+		if id == "" {
+			fw.Fail(c, ErrUnauthorized, nil)
+			return
+		}
+		if (len(allow) == 0 && !mapped) || (len(allow) > 0 && !allow[id]) {
+			fw.Fail(c, ErrForbidden, nil)
+			return
+		}
+		c.Params = append(c.Params, gin.Param{
+			Key:   "_clientIdentity",
+			Value: id,
+		})
+		c.Next()
+	}
+}
@@ -0,0 +1,453 @@
+package wmv2
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+)
+
+const tplOpenAPIUI = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8"/>
+<title>{{TITLE}} API</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<style>body{margin:0;padding:0;}</style>
+</head>
+<body>
+<div id="redoc"></div>
+<script src="{{JS}}"></script>
+<script>
+function load(token) {
+  fetch("{{SPEC}}", {headers: token ? {"User-Token": token} : {}}).then(function (r) {
+    if (r.status == 401 || r.status == 403) {
+      sessionStorage.removeItem("User-Token");
+      var t = prompt("User-Token");
+      if (t) {
+        sessionStorage.setItem("User-Token", t);
+        load(t);
+      }
+      return;
+    }
+    return r.json().then(function (spec) {
+      Redoc.init(spec, {}, document.getElementById("redoc"));
+    });
+  }).catch(function (e) {
+    document.getElementById("redoc").innerText = "load api document error: " + e;
+  });
+}
+load(sessionStorage.getItem("User-Token"));
+</script>
+</body>
+</html>`
+
+// 内嵌的redoc脚本，见openapi_ui/README.md
+//
+//go:embed openapi_ui
+var openapiUI embed.FS
+
+const (
+	openapiUIJS = "openapi_ui/redoc.standalone.js"
+	// 未内嵌脚本时使用的地址
+	openapiCDN = "https://cdn.jsdelivr.net/npm/redoc@2/bundles/redoc.standalone.js"
+)
+
+// 文档自身的路由，不写入文档
+var openapiDocPaths = map[string]bool{
+	"/openapi":                     true,
+	"/openapi.json":                true,
+	"/openapi/redoc.standalone.js": true,
+}
+
+// RouteDoc 路由文档信息
+type RouteDoc struct {
+	// 摘要
+	Summary string
+	// 详细说明
+	Description string
+	// 分组标签
+	Tags []string
+	// 请求参数结构体实例，GET/DELETE作为query参数，其他作为json body
+	Request interface{}
+	// 返回的data结构体实例
+	Response interface{}
+	// 是否已弃用
+	Deprecated bool
+	// 是否需要User-Token，fw.API中使用WithToken的路由自动设置
+	Token bool
+}
+
+// 路由文档
+type apiDocs struct {
+	locker sync.RWMutex
+	docs   map[string]*RouteDoc
+}
+
+func (d *apiDocs) set(method, path string, doc *RouteDoc) {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	if d.docs == nil {
+		d.docs = make(map[string]*RouteDoc)
+	}
+	d.docs[strings.ToUpper(method)+" "+path] = doc
+}
+
+func (d *apiDocs) get(method, path string) *RouteDoc {
+	d.locker.RLock()
+	defer d.locker.RUnlock()
+	return d.docs[strings.ToUpper(method)+" "+path]
+}
+
+// DocRoute 为路由添加文档信息，用于生成OpenAPI 3文档
+// method: http方法
+// path: gin的路由路径，如/user/:id
+func (fw *WMFrameWorkV2) DocRoute(method, path string, doc *RouteDoc) {
+	fw.apiDocs.set(method, path, doc)
+}
+
+// OpenAPI 根据gin引擎的已注册路由生成OpenAPI 3文档
+func (fw *WMFrameWorkV2) OpenAPI(r *gin.Engine) map[string]interface{} {
+	schemas := make(map[string]interface{})
+	paths := make(map[string]map[string]interface{})
+	for _, v := range r.Routes() {
+		if v.Method == "HEAD" || v.Method == "OPTIONS" || openapiDocPaths[v.Path] {
+			continue
+		}
+		p, params := openapiPath(v.Path)
+		op := map[string]interface{}{
+			"operationId": strings.ToLower(v.Method) + strings.NewReplacer("/", "_", ":", "", "*", "").Replace(v.Path),
+		}
+		parameters := make([]interface{}, 0)
+		for _, pp := range params {
+			parameters = append(parameters, map[string]interface{}{
+				"name":     pp,
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		var data map[string]interface{}
+		if doc := fw.apiDocs.get(v.Method, v.Path); doc != nil {
+			if doc.Summary != "" {
+				op["summary"] = doc.Summary
+			}
+			if doc.Description != "" {
+				op["description"] = doc.Description
+			}
+			if len(doc.Tags) > 0 {
+				op["tags"] = doc.Tags
+			}
+			if doc.Deprecated {
+				op["deprecated"] = true
+			}
+			if doc.Token {
+				op["security"] = []interface{}{map[string]interface{}{"UserToken": []string{}}}
+			}
+			if doc.Request != nil {
+				switch v.Method {
+				case "GET", "DELETE":
+					parameters = append(parameters, openapiQuery(doc.Request)...)
+				default:
+					op["requestBody"] = map[string]interface{}{
+						"content": map[string]interface{}{
+							"application/json": map[string]interface{}{
+								"schema": openapiSchema(reflect.TypeOf(doc.Request), schemas, 0),
+							},
+						},
+					}
+				}
+			}
+			if doc.Response != nil {
+				data = openapiSchema(reflect.TypeOf(doc.Response), schemas, 0)
+			}
+		}
+		if len(parameters) > 0 {
+			op["parameters"] = parameters
+		}
+		resp := map[string]interface{}{"$ref": "#/components/schemas/" + openapiSchemaName(reflect.TypeOf(Response{}))}
+		if data != nil {
+			resp = map[string]interface{}{
+				"allOf": []interface{}{
+					resp,
+					map[string]interface{}{
+						"type":       "object",
+						"properties": map[string]interface{}{"data": data},
+					},
+				},
+			}
+		}
+		op["responses"] = map[string]interface{}{
+			"200": map[string]interface{}{
+				"description": "OK",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": resp},
+				},
+			},
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": map[string]interface{}{"$ref": "#/components/schemas/" + openapiSchemaName(reflect.TypeOf(Response{}))},
+					},
+				},
+			},
+		}
+		if _, ok := paths[p]; !ok {
+			paths[p] = make(map[string]interface{})
+		}
+		paths[p][strings.ToLower(v.Method)] = op
+	}
+	openapiSchema(reflect.TypeOf(Response{}), schemas, 0)
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   fw.serverName,
+			"version": fw.Tag(),
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"UserToken": map[string]interface{}{
+					"type": "apiKey",
+					"in":   "header",
+					"name": "User-Token",
+				},
+			},
+		},
+	}
+}
+
+// WriteOpenAPI 将OpenAPI 3文档写入文件
+func (fw *WMFrameWorkV2) WriteOpenAPI(r *gin.Engine, f string) error {
+	b, err := json.MarshalIndent(fw.OpenAPI(r), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f, b, 0644)
+}
+
+// openapiRoutes 添加文档路由
+func (fw *WMFrameWorkV2) openapiRoutes(r *gin.Engine) {
+	enable, _ := strconv.ParseBool(fw.wmConf.GetItemDefault("openapi_enable", "false", "是否提供/openapi接口文档，文档数据需要管理员或api_doc接口权限"))
+	js := fw.wmConf.GetItemDefault("openapi_ui_js", "", "api文档页面使用的redoc脚本地址，留空时使用内嵌的脚本，未内嵌时使用cdn，内网部署时可改为本地/static路径")
+	fw.wmConf.Save()
+	if !enable {
+		return
+	}
+	redoc, _ := fs.ReadFile(openapiUI, openapiUIJS)
+	if js == "" {
+		js = openapiCDN
+		if len(redoc) > 0 {
+			js = "openapi/redoc.standalone.js"
+		}
+	}
+	r.GET("/openapi.json", fw.PrepareToken(true), fw.Authorize("api_doc"), func(c *gin.Context) {
+		c.PureJSON(http.StatusOK, fw.OpenAPI(r))
+	})
+	r.GET("/openapi", func(c *gin.Context) {
+		c.Header("Content-Type", "text/html")
+		c.Status(http.StatusOK)
+		render.WriteString(c.Writer, strings.NewReplacer("{{TITLE}}", fw.serverName, "{{SPEC}}", "openapi.json", "{{JS}}", js).Replace(tplOpenAPIUI), nil)
+	})
+	if len(redoc) > 0 {
+		r.GET("/openapi/redoc.standalone.js", func(c *gin.Context) {
+			c.Header("Cache-Control", "public, max-age=86400")
+			c.Data(http.StatusOK, "application/javascript", redoc)
+		})
+	}
+}
+
+var openapiNameReplacer = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// openapiSchemaName 使用包路径和类型名作为结构名称，避免不同包的同名结构冲突
+func openapiSchemaName(t reflect.Type) string {
+	if t.PkgPath() == "" {
+		return t.Name()
+	}
+	return openapiNameReplacer.ReplaceAllString(t.PkgPath(), "_") + "." + t.Name()
+}
+
+// openapiPath 转换gin路由为OpenAPI路径，返回路径和路径参数
+func openapiPath(p string) (string, []string) {
+	params := make([]string, 0)
+	ss := strings.Split(p, "/")
+	for k, v := range ss {
+		if strings.HasPrefix(v, ":") || strings.HasPrefix(v, "*") {
+			params = append(params, v[1:])
+			ss[k] = "{" + v[1:] + "}"
+		}
+	}
+	return strings.Join(ss, "/"), params
+}
+
+// fieldName 返回字段的参数名
+func fieldName(f reflect.StructField, tags ...string) string {
+	for _, tag := range tags {
+		name := strings.Split(f.Tag.Get(tag), ",")[0]
+		if name == "-" {
+			return ""
+		}
+		if name != "" {
+			return name
+		}
+	}
+	return f.Name
+}
+
+// openapiRules 将binding标签转换为schema限制，返回是否必填
+func openapiRules(f reflect.StructField, schema map[string]interface{}) bool {
+	var required bool
+	for _, rule := range strings.Split(f.Tag.Get("binding"), ",") {
+		kv := strings.SplitN(rule, "=", 2)
+		var param string
+		if len(kv) == 2 {
+			param = strings.ReplaceAll(kv[1], "0x2C", ",")
+		}
+		isString := schema["type"] == "string"
+		switch kv[0] {
+		case "required":
+			required = true
+		case "oneof":
+			enum := make([]interface{}, 0)
+			for _, v := range strings.Fields(param) {
+				enum = append(enum, v)
+			}
+			schema["enum"] = enum
+		case "min", "gte":
+			if n, err := strconv.ParseFloat(param, 64); err == nil {
+				if isString {
+					schema["minLength"] = int(n)
+				} else {
+					schema["minimum"] = n
+				}
+			}
+		case "max", "lte":
+			if n, err := strconv.ParseFloat(param, 64); err == nil {
+				if isString {
+					schema["maxLength"] = int(n)
+				} else {
+					schema["maximum"] = n
+				}
+			}
+		case "regex":
+			schema["pattern"] = param
+		}
+	}
+	return required
+}
+
+// openapiQuery 将结构体转换为query参数
+func openapiQuery(v interface{}) []interface{} {
+	params := make([]interface{}, 0)
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return params
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := fieldName(f, "form", "json")
+		if name == "" {
+			continue
+		}
+		schema := openapiSchema(f.Type, nil, 0)
+		params = append(params, map[string]interface{}{
+			"name":     name,
+			"in":       "query",
+			"required": openapiRules(f, schema),
+			"schema":   schema,
+		})
+	}
+	return params
+}
+
+// openapiSchema 通过反射生成json schema，命名结构体放入components
+func openapiSchema(t reflect.Type, schemas map[string]interface{}, depth int) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if depth > 8 {
+		return map[string]interface{}{"type": "object"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": openapiSchema(t.Elem(), schemas, depth+1)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": openapiSchema(t.Elem(), schemas, depth+1)}
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		if schemas != nil && t.Name() != "" {
+			name := openapiSchemaName(t)
+			if _, ok := schemas[name]; !ok {
+				// 先占位，避免递归引用
+				schemas[name] = map[string]interface{}{"type": "object"}
+				schemas[name] = openapiStruct(t, schemas, depth)
+			}
+			return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+		}
+		return openapiStruct(t, schemas, depth)
+	}
+	return map[string]interface{}{}
+}
+
+func openapiStruct(t reflect.Type, schemas map[string]interface{}, depth int) map[string]interface{} {
+	props := make(map[string]interface{})
+	required := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := fieldName(f, "json", "form")
+		if name == "" {
+			continue
+		}
+		schema := openapiSchema(f.Type, schemas, depth+1)
+		if openapiRules(f, schema) {
+			required = append(required, name)
+		}
+		props[name] = schema
+	}
+	s := map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
@@ -0,0 +1,86 @@
+package wmv2
+
+import (
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xyzj/gopsu"
+)
+
+type openapiItem struct {
+	Name string `json:"name"`
+}
+
+func newOpenAPITestFW(t *testing.T, enable string) *WMFrameWorkV2 {
+	conf, err := gopsu.LoadConfig(filepath.Join(t.TempDir(), "test.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.SetItem("openapi_enable", enable, "")
+	return &WMFrameWorkV2{
+		wmConf:  conf,
+		wmLog:   &gopsu.NilLogger{},
+		mtlsCtl: &mtlsConfigure{},
+		apiDocs: &apiDocs{},
+	}
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	newOpenAPITestFW(t, "false").openapiRoutes(r)
+	if len(r.Routes()) != 0 {
+		t.Fatalf("disabled doc should not add routes: %v", r.Routes())
+	}
+	r = gin.New()
+	newOpenAPITestFW(t, "true").openapiRoutes(r)
+	if w := webGet(r, "/openapi.json", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("doc without token: got %d", w.Code)
+	}
+	if w := webGet(r, "/openapi", nil); w.Code != http.StatusOK {
+		t.Fatalf("doc page: got %d", w.Code)
+	}
+}
+
+func TestOpenAPIPaths(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fw := newOpenAPITestFW(t, "true")
+	r := gin.New()
+	fw.openapiRoutes(r)
+	r.GET("/openapi_user", func(c *gin.Context) {})
+	fw.DocRoute("GET", "/openapi_user", &RouteDoc{Response: openapiItem{}})
+	doc := fw.OpenAPI(r)
+	paths := doc["paths"].(map[string]map[string]interface{})
+	r.GET("/openapi_token", fw.PrepareToken(true), func(c *gin.Context) {})
+	fw.DocRoute("GET", "/openapi_token", &RouteDoc{Token: true})
+	doc = fw.OpenAPI(r)
+	paths = doc["paths"].(map[string]map[string]interface{})
+	op := paths["/openapi_token"]["get"].(map[string]interface{})
+	if _, ok := op["security"]; !ok {
+		t.Fatalf("token route without security: %v", op)
+	}
+	if _, ok := paths["/openapi_user"]["get"].(map[string]interface{})["security"]; ok {
+		t.Fatalf("public route with security")
+	}
+	delete(paths, "/openapi_token")
+	if len(paths) != 1 {
+		t.Fatalf("only the doc routes should be skipped: %v", paths)
+	}
+	if _, ok := paths["/openapi_user"]; !ok {
+		t.Fatalf("got %v", paths)
+	}
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	name := openapiSchemaName(reflect.TypeOf(openapiItem{}))
+	if name != "github.com_xyzj_wlstmicro_v2.openapiItem" {
+		t.Fatalf("schema name %q", name)
+	}
+	if _, ok := schemas[name]; !ok {
+		t.Fatalf("got %v", schemas)
+	}
+	if _, ok := schemas[openapiSchemaName(reflect.TypeOf(Response{}))]; !ok {
+		t.Fatalf("response schema missing: %v", schemas)
+	}
+}
@@ -0,0 +1,128 @@
+package wmv2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrBodyTooLarge 返回数据超过大小限制
+var ErrBodyTooLarge = fmt.Errorf("response body too large")
+
+// limitedBody 限制读取大小，关闭时释放请求上下文
+type limitedBody struct {
+	rc     io.ReadCloser
+	remain int64
+	cancel context.CancelFunc
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remain <= 0 {
+		// 多读一个字节，判断是否正好读完
+		var b [1]byte
+		if n, _ := l.rc.Read(b[:]); n > 0 {
+			return 0, ErrBodyTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.remain {
+		p = p[:l.remain]
+	}
+	n, err := l.rc.Read(p)
+	l.remain -= int64(n)
+	return n, err
+}
+
+func (l *limitedBody) Close() error {
+	defer l.cancel()
+	return l.rc.Close()
+}
+
+// DoRequestStream 进行http request请求，不缓存返回数据，用于下载大文件等场景
+// req: http.NewRequest()
+// timeo: 包含读取返回数据在内的总超时
+// maxSize: 返回数据最大字节数，超过时读取返回ErrBodyTooLarge，<=0不限制
+// 调用方必须关闭resp.Body
+func (fw *WMFrameWorkV2) DoRequestStream(req *http.Request, timeo time.Duration, maxSize int64) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), timeo)
+	// 总超时由ctx控制，不使用httpClientPool的超时
+	resp, err := (&http.Client{Transport: fw.httpClientPool.Transport}).Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		fw.WriteError("HTTP FWD", "request error: "+err.Error())
+		return nil, err
+	}
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		resp.Body.Close()
+		cancel()
+		return nil, ErrBodyTooLarge
+	}
+	if maxSize <= 0 {
+		maxSize = 1<<63 - 1
+	}
+	resp.Body = &limitedBody{
+		rc:     resp.Body,
+		remain: maxSize,
+		cancel: cancel,
+	}
+	if fw.Debug() {
+		fw.WriteDebug("HTTP FWD", fmt.Sprintf("%s response %d from %s|stream", req.Method, resp.StatusCode, req.URL.String()))
+	}
+	return resp, nil
+}
+
+// ProxyService 将gin请求转发到指定服务的实例，请求和返回数据均不缓存
+// svrName: 服务名称，通过etcd选取实例
+// path: 转发的目标路径，留空时使用原请求路径，query参数保持不变
+func (fw *WMFrameWorkV2) ProxyService(c *gin.Context, svrName, path string) {
+	addr, err := fw.PickerDetail(svrName)
+	if err != nil {
+		fw.Fail(c, ErrUpstream, err)
+		return
+	}
+	fw.proxyTo(c, addr, path, nil)
+}
+
+// proxyTo 转发请求到指定地址
+// director: 额外的请求处理，可为nil
+func (fw *WMFrameWorkV2) proxyTo(c *gin.Context, addr, path string, director func(*http.Request)) {
+	target, err := url.Parse(addr)
+	if err != nil {
+		fw.Fail(c, ErrUpstream, err)
+		return
+	}
+	if path == "" {
+		path = c.Request.URL.Path
+	}
+	defer fw.lb.begin(addr)()
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(path, "/")
+			req.URL.RawPath = ""
+			req.Host = target.Host
+			if _, ok := req.Header["User-Agent"]; !ok {
+				req.Header.Set("User-Agent", "")
+			}
+			req.Header.Set("X-Forwarded-Host", c.Request.Host)
+			if director != nil {
+				director(req)
+			}
+		},
+		Transport:     fw.httpClientPool.Transport,
+		FlushInterval: time.Millisecond * 100,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			fw.WriteError("HTTP PROXY", req.URL.String()+"|"+err.Error())
+			fw.Fail(c, ErrUpstream, nil)
+		},
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
@@ -0,0 +1,556 @@
+package wmv2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/xyzj/gopsu"
+)
+
+// 推送服务配置
+type pushConfigure struct {
+	forshow string
+	// 是否启用推送
+	enable bool
+	// 路由前缀
+	path string
+	// 最大连接数
+	maxConns int
+	// 单个连接最大订阅数
+	maxSubs int
+	// 单个连接发送队列长度，队列满时断开连接
+	queueSize int
+	// 心跳间隔
+	heartbeat time.Duration
+	// 当前连接数
+	conns    int32
+	locker   sync.RWMutex
+	clients  map[*pushClient]struct{}
+	upgrader websocket.Upgrader
+}
+
+func (conf *pushConfigure) show() string {
+	conf.forshow, _ = sjson.Set("", "enable", conf.enable)
+	conf.forshow, _ = sjson.Set(conf.forshow, "path", conf.path)
+	conf.forshow, _ = sjson.Set(conf.forshow, "max_conns", conf.maxConns)
+	conf.forshow, _ = sjson.Set(conf.forshow, "max_subs", conf.maxSubs)
+	conf.forshow, _ = sjson.Set(conf.forshow, "queue_size", conf.queueSize)
+	conf.forshow, _ = sjson.Set(conf.forshow, "heartbeat", conf.heartbeat.String())
+	return conf.forshow
+}
+
+// pushMessage 推送给客户端的消息，非json数据使用base64编码
+type pushMessage struct {
+	Key      string          `json:"key"`
+	Encoding string          `json:"encoding,omitempty"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// sseFrame 转换为sse格式，data压缩为一行，避免数据中的换行符截断消息
+func (msg *pushMessage) sseFrame() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("event: ")
+	buf.WriteString(strings.NewReplacer("\r", "", "\n", "").Replace(msg.Key))
+	buf.WriteString("\ndata: ")
+	if msg.Encoding != "" {
+		b, _ := json.Marshal(msg)
+		buf.Write(b)
+	} else if err := json.Compact(&buf, msg.Data); err != nil {
+		buf.WriteString("null")
+	}
+	buf.WriteString("\n\n")
+	return buf.Bytes()
+}
+
+// pushClient 推送连接
+type pushClient struct {
+	user string
+	from string
+	// 是否为管理员，管理员可以订阅所有key
+	admin bool
+	// 可以订阅的key，来自enable_api中push:开头的权限
+	perms   []string
+	locker  sync.RWMutex
+	subs    []string
+	send    chan *pushMessage
+	closed  chan struct{}
+	onClose sync.Once
+}
+
+func (pc *pushClient) close() {
+	pc.onClose.Do(func() {
+		close(pc.closed)
+	})
+}
+
+// allowed 订阅规则是否在权限范围内
+func (pc *pushClient) allowed(key string) bool {
+	if pc.admin {
+		return true
+	}
+	for _, v := range pc.perms {
+		if coverTopic(v, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribe 添加订阅，没有权限或超过数量限制时返回错误
+func (pc *pushClient) subscribe(max int, keys ...string) error {
+	pc.locker.Lock()
+	defer pc.locker.Unlock()
+	for _, k := range keys {
+		if k = strings.TrimSpace(k); k == "" || containsString(pc.subs, k) {
+			continue
+		}
+		if !pc.allowed(k) {
+			return fmt.Errorf("no permission to subscribe %s", k)
+		}
+		if len(pc.subs) >= max {
+			return fmt.Errorf("too many subscriptions, max %d", max)
+		}
+		pc.subs = append(pc.subs, k)
+	}
+	return nil
+}
+
+func (pc *pushClient) unsubscribe(keys ...string) {
+	pc.locker.Lock()
+	defer pc.locker.Unlock()
+	ss := pc.subs[:0]
+	for _, v := range pc.subs {
+		if !containsString(keys, v) {
+			ss = append(ss, v)
+		}
+	}
+	pc.subs = ss
+}
+
+func (pc *pushClient) match(key string) bool {
+	pc.locker.RLock()
+	defer pc.locker.RUnlock()
+	for _, v := range pc.subs {
+		if matchTopic(v, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTopic 按rabbitmq topic规则匹配，*匹配一个单词，#匹配零或多个单词
+func matchTopic(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(p, k []string) bool {
+	for len(p) > 0 {
+		if p[0] == "#" {
+			for i := 0; i <= len(k); i++ {
+				if matchWords(p[1:], k[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(k) == 0 || (p[0] != "*" && p[0] != k[0]) {
+			return false
+		}
+		p, k = p[1:], k[1:]
+	}
+	return len(k) == 0
+}
+
+// coverTopic 订阅规则key匹配的所有消息是否都能被权限规则perm匹配
+func coverTopic(perm, key string) bool {
+	return coverWords(strings.Split(perm, "."), strings.Split(key, "."))
+}
+
+func coverWords(p, k []string) bool {
+	for len(p) > 0 {
+		if p[0] == "#" {
+			for i := 0; i <= len(k); i++ {
+				if coverWords(p[1:], k[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		// 权限中的*只能覆盖一个单词，不能覆盖#
+		if len(k) == 0 || k[0] == "#" || (p[0] != "*" && p[0] != k[0]) {
+			return false
+		}
+		p, k = p[1:], k[1:]
+	}
+	return len(k) == 0
+}
+
+// matchOrigin 按cors规则匹配来源，支持一个*
+func matchOrigin(pattern, origin string) bool {
+	idx := strings.Index(pattern, "*")
+	if idx < 0 {
+		return strings.EqualFold(pattern, origin)
+	}
+	prefix, suffix := strings.ToLower(pattern[:idx]), strings.ToLower(pattern[idx+1:])
+	origin = strings.ToLower(origin)
+	return len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix)
+}
+
+// pushCheckOrigin websocket握手时按cors_origins检查来源，同源和非浏览器客户端不检查
+func pushCheckOrigin(conf cors.Config) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		if conf.AllowAllOrigins {
+			return true
+		}
+		if conf.AllowOriginFunc != nil {
+			return conf.AllowOriginFunc(origin)
+		}
+		for _, v := range conf.AllowOrigins {
+			if matchOrigin(v, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (fw *WMFrameWorkV2) loadPushConfig() {
+	fw.pushCtl.enable, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("push_enable", "false", "是否启用websocket和sse推送，将mq消费者收到的消息推送给订阅的客户端"))
+	fw.pushCtl.path = "/" + strings.Trim(fw.wmConf.GetItemDefault("push_path", "/push", "推送路由前缀，websocket使用<前缀>/ws，sse使用<前缀>/sse"), "/")
+	fw.pushCtl.maxConns = gopsu.String2Int(fw.wmConf.GetItemDefault("push_max_conns", "1000", "推送最大连接数"), 10)
+	fw.pushCtl.maxSubs = gopsu.String2Int(fw.wmConf.GetItemDefault("push_max_subs", "20", "单个推送连接最大订阅数"), 10)
+	fw.pushCtl.queueSize = gopsu.String2Int(fw.wmConf.GetItemDefault("push_queue", "256", "单个推送连接的发送队列长度，客户端接收过慢导致队列满时断开连接"), 10)
+	fw.pushCtl.heartbeat = time.Second * time.Duration(gopsu.String2Int(fw.wmConf.GetItemDefault("push_heartbeat", "30", "推送心跳间隔（秒）"), 10))
+	fw.wmConf.Save()
+	if fw.pushCtl.maxSubs <= 0 {
+		fw.pushCtl.maxSubs = 20
+	}
+	if fw.pushCtl.queueSize <= 0 {
+		fw.pushCtl.queueSize = 256
+	}
+	if fw.pushCtl.heartbeat <= 0 {
+		fw.pushCtl.heartbeat = time.Second * 30
+	}
+	fw.pushCtl.show()
+}
+
+// pushRoutes 添加推送路由
+// corsConf: 跨域配置，用于检查websocket的来源
+func (fw *WMFrameWorkV2) pushRoutes(r *gin.Engine, corsConf cors.Config) {
+	fw.loadPushConfig()
+	if !fw.pushCtl.enable {
+		return
+	}
+	fw.pushCtl.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 4096,
+		CheckOrigin:     pushCheckOrigin(corsConf),
+	}
+	g := r.Group(fw.pushCtl.path)
+	g.POST("/ticket", fw.PrepareToken(true), fw.pushNewTicket)
+	g.GET("/ws", fw.pushTicket, fw.PrepareToken(true), fw.pushAuth, fw.pushWS)
+	g.GET("/sse", fw.pushTicket, fw.PrepareToken(true), fw.pushAuth, fw.pushSSE)
+	fw.DocRoute("POST", fw.pushCtl.path+"/ticket", &RouteDoc{Summary: "获取推送连接凭证", Tags: []string{"framework"}, Token: true})
+	fw.DocRoute("GET", fw.pushCtl.path+"/ws", &RouteDoc{Summary: "websocket推送，浏览器使用ticket参数", Tags: []string{"framework"}, Token: true})
+	fw.DocRoute("GET", fw.pushCtl.path+"/sse", &RouteDoc{Summary: "sse推送，浏览器使用ticket参数", Tags: []string{"framework"}, Token: true})
+}
+
+// pushPath 是否为推送路由
+func (fw *WMFrameWorkV2) pushPath(p string) bool {
+	return fw.pushCtl.enable && strings.HasPrefix(p, fw.pushCtl.path+"/")
+}
+
+// pushTicketLife 连接凭证有效期
+const pushTicketLife = time.Second * 30
+
+// 读取并删除，保证凭证只能使用一次
+var luaGetDel = redis.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if v then
+	redis.call('DEL', KEYS[1])
+end
+return v`)
+
+// pushNewTicket 生成一次性的连接凭证
+// 浏览器的websocket和EventSource无法设置请求头，先使用User-Token获取凭证，再通过ticket参数连接，避免User-Token出现在访问日志中
+func (fw *WMFrameWorkV2) pushNewTicket(c *gin.Context) {
+	uuid := c.GetHeader("User-Token")
+	if uuid == "" {
+		fw.Fail(c, ErrParams, fmt.Errorf("ticket requires User-Token"))
+		return
+	}
+	ticket := newCaptureID()
+	if err := fw.WriteRedis("push/ticket/"+ticket, uuid, pushTicketLife); err != nil {
+		fw.Fail(c, ErrInternal, err)
+		return
+	}
+	fw.OK(c, gin.H{"ticket": ticket, "expire": int(pushTicketLife.Seconds())})
+}
+
+// pushTicket 使用ticket参数时，读取并删除凭证，设置User-Token
+func (fw *WMFrameWorkV2) pushTicket(c *gin.Context) {
+	ticket := c.Query("ticket")
+	if c.GetHeader("User-Token") != "" || ticket == "" || !fw.redisCtl.enable {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisCtxTimeo)
+	defer cancel()
+	uuid, err := luaGetDel.Run(ctx, fw.redisCtl.client, []string{fw.AppendRootPathRedis("push/ticket/" + ticket)}).Text()
+	if err != nil {
+		return
+	}
+	c.Request.Header.Set("User-Token", uuid)
+}
+
+// pushAuth 检查登录状态，占用连接数直到连接结束
+func (fw *WMFrameWorkV2) pushAuth(c *gin.Context) {
+	if c.Param("_userTokenName") == "" {
+		fw.Fail(c, ErrUnauthorized, nil)
+		return
+	}
+	n := atomic.AddInt32(&fw.pushCtl.conns, 1)
+	defer atomic.AddInt32(&fw.pushCtl.conns, -1)
+	if fw.pushCtl.maxConns > 0 && int(n) > fw.pushCtl.maxConns {
+		fw.Fail(c, ErrTooManyRequests, fmt.Errorf("too many push connections"))
+		return
+	}
+	c.Next()
+}
+
+func (fw *WMFrameWorkV2) addPushClient(c *gin.Context) *pushClient {
+	pc := &pushClient{
+		user:   c.Param("_userTokenName"),
+		from:   fw.ClientIP(c),
+		admin:  c.Param("_userAsAdmin") == "1",
+		perms:  make([]string, 0),
+		subs:   make([]string, 0),
+		send:   make(chan *pushMessage, fw.pushCtl.queueSize),
+		closed: make(chan struct{}),
+	}
+	for _, v := range strings.Split(c.Param("_enableAPI"), ",") {
+		if strings.HasPrefix(v, "push:") {
+			pc.perms = append(pc.perms, strings.TrimPrefix(v, "push:"))
+		}
+	}
+	fw.pushCtl.locker.Lock()
+	fw.pushCtl.clients[pc] = struct{}{}
+	fw.pushCtl.locker.Unlock()
+	fw.WriteInfo("PUSH", "connect "+pc.user+"|"+pc.from)
+	return pc
+}
+
+func (fw *WMFrameWorkV2) delPushClient(pc *pushClient) {
+	pc.close()
+	fw.pushCtl.locker.Lock()
+	delete(fw.pushCtl.clients, pc)
+	fw.pushCtl.locker.Unlock()
+	fw.WriteInfo("PUSH", "disconnect "+pc.user+"|"+pc.from)
+}
+
+// Push 推送消息给订阅了key的客户端，mq消费者收到的消息会自动推送
+// key: 不含AppendRootPathRabbit的前缀
+func (fw *WMFrameWorkV2) Push(key string, body []byte) {
+	if !fw.pushCtl.enable {
+		return
+	}
+	var msg *pushMessage
+	fw.pushCtl.locker.RLock()
+	defer fw.pushCtl.locker.RUnlock()
+	for pc := range fw.pushCtl.clients {
+		if !pc.match(key) {
+			continue
+		}
+		if msg == nil {
+			msg = &pushMessage{Key: key}
+			if gjson.ValidBytes(body) {
+				msg.Data = body
+			} else {
+				msg.Encoding = "base64"
+				msg.Data, _ = json.Marshal(body)
+			}
+		}
+		select {
+		case pc.send <- msg:
+		default:
+			// 客户端接收过慢，断开连接，避免占用内存
+			fw.WriteWarning("PUSH", "queue full, close "+pc.user+"|"+pc.from)
+			pc.close()
+		}
+	}
+}
+
+// pushMQ 推送mq消费者收到的消息
+func (fw *WMFrameWorkV2) pushMQ(key string, body []byte) {
+	fw.Push(strings.TrimPrefix(key, fw.rootPathMQ), body)
+}
+
+// pushWS websocket推送
+// 客户端发送{"op":"sub|unsub","keys":["xxx.#"]}订阅或取消订阅，key规则与rabbitmq topic相同
+// 服务端推送{"key":"xxx","data":...}，非json数据为{"key":"xxx","encoding":"base64","data":"xxx"}，操作结果为{"op":"xxx","status":1|0,"detail":"xxx"}
+func (fw *WMFrameWorkV2) pushWS(c *gin.Context) {
+	conn, err := fw.pushCtl.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+	pc := fw.addPushClient(c)
+	defer fw.delPushClient(pc)
+	if err := pc.subscribe(fw.pushCtl.maxSubs, splitConfigList(c.Query("keys"))...); err != nil {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()))
+		conn.Close()
+		return
+	}
+	// 未在超时时间内收到pong时断开
+	wait := fw.pushCtl.heartbeat * 2
+	conn.SetReadLimit(4096)
+	conn.SetReadDeadline(time.Now().Add(wait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wait))
+	})
+	reply := make(chan string, 4)
+	go func() {
+		defer pc.close()
+		for {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(wait))
+			js := gjson.ParseBytes(b)
+			keys := make([]string, 0)
+			for _, v := range js.Get("keys").Array() {
+				keys = append(keys, v.String())
+			}
+			ans, _ := sjson.Set("", "op", js.Get("op").String())
+			ans, _ = sjson.Set(ans, "status", 1)
+			switch js.Get("op").String() {
+			case "sub":
+				if err := pc.subscribe(fw.pushCtl.maxSubs, keys...); err != nil {
+					ans, _ = sjson.Set(ans, "status", 0)
+					ans, _ = sjson.Set(ans, "detail", err.Error())
+				}
+			case "unsub":
+				pc.unsubscribe(keys...)
+			default:
+				ans, _ = sjson.Set(ans, "status", 0)
+				ans, _ = sjson.Set(ans, "detail", "unknown op")
+			}
+			select {
+			case reply <- ans:
+			case <-pc.closed:
+				return
+			}
+		}
+	}()
+	tick := time.NewTicker(fw.pushCtl.heartbeat)
+	defer tick.Stop()
+	defer conn.Close()
+	for {
+		var err error
+		select {
+		case <-pc.closed:
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+			return
+		case <-tick.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second*10))
+		case s := <-reply:
+			conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+			err = conn.WriteMessage(websocket.TextMessage, []byte(s))
+		case msg := <-pc.send:
+			conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+			err = conn.WriteJSON(msg)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// pushSSE sse推送，订阅通过keys参数指定，用`,`分割多个
+// data为一行json，非json数据为{"key":"xxx","encoding":"base64","data":"xxx"}
+// 不受http_write_timeout限制，单次写入超过10秒时断开
+func (fw *WMFrameWorkV2) pushSSE(c *gin.Context) {
+	keys := splitConfigList(c.Query("keys"))
+	if len(keys) == 0 {
+		fw.Fail(c, ErrParams, fmt.Errorf("keys is required"))
+		return
+	}
+	pc := fw.addPushClient(c)
+	defer fw.delPushClient(pc)
+	for _, k := range keys {
+		if !pc.allowed(k) {
+			fw.Fail(c, ErrForbidden, fmt.Errorf("no permission to subscribe %s", k))
+			return
+		}
+	}
+	if err := pc.subscribe(fw.pushCtl.maxSubs, keys...); err != nil {
+		fw.Fail(c, ErrParams, err)
+		return
+	}
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// 禁止nginx缓存
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	conn := requestConn(c.Request)
+	tick := time.NewTicker(fw.pushCtl.heartbeat)
+	defer tick.Stop()
+	for {
+		var b []byte
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-pc.closed:
+			return
+		case <-tick.C:
+			b = []byte(": ping\n\n")
+		case msg := <-pc.send:
+			b = msg.sseFrame()
+		}
+		// 客户端接收过慢时断开，避免阻塞
+		if conn != nil {
+			conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+		}
+		if _, err := c.Writer.Write(b); err != nil {
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+// ViewPushConfig 查看推送配置
+func (fw *WMFrameWorkV2) ViewPushConfig() string {
+	return fw.pushCtl.forshow
+}
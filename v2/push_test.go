@@ -0,0 +1,148 @@
+package wmv2
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/xyzj/gopsu"
+)
+
+func TestSSEFrame(t *testing.T) {
+	msg := &pushMessage{Key: "dev.online", Data: json.RawMessage("{\n  \"a\": 1,\n  \"b\": \"x\\ny\"\n}")}
+	s := string(msg.sseFrame())
+	if s != "event: dev.online\ndata: {\"a\":1,\"b\":\"x\\ny\"}\n\n" {
+		t.Fatalf("unexpected frame %q", s)
+	}
+	msg = &pushMessage{Key: "bad\nkey", Encoding: "base64"}
+	msg.Data, _ = json.Marshal([]byte{0xff, 0x00, '\n'})
+	s = string(msg.sseFrame())
+	if strings.Count(s, "\n") != 3 || !strings.HasPrefix(s, "event: badkey\ndata: ") {
+		t.Fatalf("unexpected frame %q", s)
+	}
+}
+
+func TestCoverTopic(t *testing.T) {
+	cases := []struct {
+		perm, key string
+		want      bool
+	}{
+		{"dev.#", "dev.online", true},
+		{"dev.#", "dev.*.x", true},
+		{"dev.#", "dev.#", true},
+		{"dev.*", "dev.online", true},
+		{"dev.*", "dev.#", false},
+		{"dev.*", "dev.a.b", false},
+		{"dev.online", "dev.*", false},
+		{"#", "#", true},
+		{"a.#.c", "a.x.y.c", true},
+		{"a.#.c", "a.x.y", false},
+	}
+	for _, v := range cases {
+		if got := coverTopic(v.perm, v.key); got != v.want {
+			t.Errorf("coverTopic(%q, %q) = %v", v.perm, v.key, got)
+		}
+	}
+}
+
+func TestPushCheckOrigin(t *testing.T) {
+	check := pushCheckOrigin(cors.Config{AllowOrigins: []string{"https://a.com", "https://*.b.com"}})
+	cases := map[string]bool{
+		"":                    true,
+		"https://svr:6819":    true,
+		"https://a.com":       true,
+		"https://x.b.com":     true,
+		"https://evil.com":    false,
+		"https://a.com.evil":  false,
+		"http://x.b.com.evil": false,
+	}
+	for origin, want := range cases {
+		r, _ := http.NewRequest("GET", "https://svr:6819/push/ws", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if got := check(r); got != want {
+			t.Errorf("origin %q: got %v", origin, got)
+		}
+	}
+}
+
+func TestPushWriteTimeout(t *testing.T) {
+	fw := &WMFrameWorkV2{
+		pushCtl:   &pushConfigure{enable: true, path: "/push"},
+		serverCtl: &serverConfigure{listens: []string{"127.0.0.1:0"}, writeTimeout: time.Millisecond * 200},
+	}
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			w.Write([]byte("data: x\n\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Millisecond * 100)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/push/sse", slow)
+	mux.HandleFunc("/api", slow)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := fw.newHTTPServer(mux)
+	go s.Serve(l)
+	defer s.Close()
+	read := func(p string) (int, error) {
+		resp, err := http.Get("http://" + l.Addr().String() + p)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return strings.Count(string(b), "data:"), err
+	}
+	// 推送连接超过写入超时后仍可继续发送
+	if n, err := read("/push/sse"); err != nil || n != 5 {
+		t.Fatalf("push: got %d %v", n, err)
+	}
+	// 其他请求仍受写入超时限制
+	if n, err := read("/api"); err == nil && n == 5 {
+		t.Fatal("write timeout should apply to other routes")
+	}
+}
+
+func TestPushMaxConns(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fw := &WMFrameWorkV2{
+		wmLog:   &gopsu.NilLogger{},
+		pushCtl: &pushConfigure{enable: true, path: "/push", maxConns: 1},
+	}
+	hold := make(chan struct{})
+	entered := make(chan struct{})
+	r := gin.New()
+	r.GET("/push/sse", func(c *gin.Context) {
+		c.Params = append(c.Params, gin.Param{Key: "_userTokenName", Value: "u"})
+	}, fw.pushAuth, func(c *gin.Context) {
+		entered <- struct{}{}
+		<-hold
+	})
+	done := make(chan struct{})
+	go func() {
+		webGet(r, "/push/sse", nil)
+		close(done)
+	}()
+	<-entered
+	if w := webGet(r, "/push/sse", nil); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d", w.Code)
+	}
+	close(hold)
+	<-done
+	// 连接结束后释放
+	if n := atomic.LoadInt32(&fw.pushCtl.conns); n != 0 {
+		t.Fatalf("conns %d", n)
+	}
+}
@@ -0,0 +1,301 @@
+package wmv2
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/tidwall/sjson"
+	"github.com/xyzj/gopsu"
+)
+
+const (
+	// RateLimitTokenBucket 令牌桶算法
+	RateLimitTokenBucket = "tokenbucket"
+	// RateLimitSlidingWindow 滑动窗口算法
+	RateLimitSlidingWindow = "slidingwindow"
+)
+
+var (
+	// 滑动窗口，返回{是否允许，需等待毫秒}
+	luaSlidingWindow = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], 0, now - window)
+if redis.call('ZCARD', KEYS[1]) < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], window)
+	return {1, 0}
+end
+local first = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+return {0, window - (now - tonumber(first[2]))}`)
+	// 令牌桶，返回{是否允许，需等待毫秒}
+	luaTokenBucket = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local rate = limit / window
+local v = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(v[1])
+local ts = tonumber(v[2])
+if tokens == nil or ts == nil then
+	tokens = limit
+	ts = now
+end
+tokens = math.min(limit, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate)
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], window * 2)
+return {allowed, wait}`)
+)
+
+// 限流配置
+type rateLimitConfigure struct {
+	forshow string
+	// 是否启用全局限流
+	enable bool
+	// 限流算法
+	algorithm string
+	// 统计窗口
+	window time.Duration
+	// 单ip限制次数
+	ipLimit int
+	// 单用户限制次数
+	userLimit int
+	// 路由限制次数
+	routeLimit map[string]int
+	// redis不可用时的本地计数
+	memLocker  sync.Mutex
+	memBuckets map[string]*memBucket
+	cleanOnce  sync.Once
+	// 上次记录redis错误的时间，unix秒
+	lastWarn int64
+}
+
+// 本地计数器
+type memBucket struct {
+	// 滑动窗口请求时间
+	stamps []time.Time
+	// 令牌数量
+	tokens float64
+	// 最后访问时间
+	last time.Time
+	// 统计窗口
+	window time.Duration
+}
+
+func (conf *rateLimitConfigure) show() string {
+	conf.forshow, _ = sjson.Set("", "enable", conf.enable)
+	conf.forshow, _ = sjson.Set(conf.forshow, "algorithm", conf.algorithm)
+	conf.forshow, _ = sjson.Set(conf.forshow, "window", conf.window.String())
+	conf.forshow, _ = sjson.Set(conf.forshow, "ip", conf.ipLimit)
+	conf.forshow, _ = sjson.Set(conf.forshow, "user", conf.userLimit)
+	conf.forshow, _ = sjson.Set(conf.forshow, "route", conf.routeLimit)
+	return conf.forshow
+}
+
+// allow 本地计数，返回是否允许，以及需要等待的时间
+func (conf *rateLimitConfigure) allow(algorithm, key string, limit int, window time.Duration) (bool, time.Duration) {
+	conf.memLocker.Lock()
+	defer conf.memLocker.Unlock()
+	now := time.Now()
+	b, ok := conf.memBuckets[key]
+	if !ok {
+		b = &memBucket{
+			stamps: make([]time.Time, 0),
+			tokens: float64(limit),
+			last:   now,
+		}
+		conf.memBuckets[key] = b
+	}
+	b.window = window
+	switch algorithm {
+	case RateLimitTokenBucket:
+		rate := float64(limit) / float64(window)
+		b.tokens = math.Min(float64(limit), b.tokens+float64(now.Sub(b.last))*rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			return true, 0
+		}
+		return false, time.Duration(math.Ceil((1 - b.tokens) / rate))
+	default:
+		b.last = now
+		idx := 0
+		for idx < len(b.stamps) && now.Sub(b.stamps[idx]) >= window {
+			idx++
+		}
+		b.stamps = b.stamps[idx:]
+		if len(b.stamps) < limit {
+			b.stamps = append(b.stamps, now)
+			return true, 0
+		}
+		return false, window - now.Sub(b.stamps[0])
+	}
+}
+
+// clean 清理超过2个统计窗口未访问的本地计数
+func (conf *rateLimitConfigure) clean() {
+	conf.memLocker.Lock()
+	defer conf.memLocker.Unlock()
+	for k, v := range conf.memBuckets {
+		if time.Since(v.last) > v.window*2 {
+			delete(conf.memBuckets, k)
+		}
+	}
+}
+
+func (fw *WMFrameWorkV2) loadRateLimitConfig() {
+	fw.rateCtl.enable, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("ratelimit_enable", "false", "是否启用http限流"))
+	fw.rateCtl.algorithm = fw.wmConf.GetItemDefault("ratelimit_algorithm", RateLimitSlidingWindow, "限流算法，slidingwindow-滑动窗口，tokenbucket-令牌桶")
+	fw.rateCtl.window = time.Second * time.Duration(gopsu.String2Int(fw.wmConf.GetItemDefault("ratelimit_window", "1", "限流统计窗口（秒）"), 10))
+	fw.rateCtl.ipLimit = gopsu.String2Int(fw.wmConf.GetItemDefault("ratelimit_ip", "0", "单个ip在统计窗口内的最大请求数，0-不限制"), 10)
+	fw.rateCtl.userLimit = gopsu.String2Int(fw.wmConf.GetItemDefault("ratelimit_user", "0", "单个User-Token在统计窗口内的最大请求数，0-不限制"), 10)
+	routes := fw.wmConf.GetItemDefault("ratelimit_route", "", "单个路由在统计窗口内的最大请求数，格式：/path:limit，用`,`分割多个路由")
+	fw.wmConf.Save()
+	if fw.rateCtl.window < time.Second {
+		fw.rateCtl.window = time.Second
+	}
+	fw.rateCtl.routeLimit = make(map[string]int)
+	for _, v := range strings.Split(routes, ",") {
+		idx := strings.LastIndex(v, ":")
+		if idx <= 0 {
+			continue
+		}
+		if l := gopsu.String2Int(strings.TrimSpace(v[idx+1:]), 10); l > 0 {
+			fw.rateCtl.routeLimit[strings.TrimSpace(v[:idx])] = l
+		}
+	}
+	fw.rateCtl.show()
+	// RateLimit也使用本地计数，无论是否启用全局限流都需要清理
+	fw.rateCtl.cleanOnce.Do(func() {
+		go func() {
+			defer func() { recover() }()
+			for {
+				time.Sleep(time.Minute)
+				fw.rateCtl.clean()
+			}
+		}()
+	})
+}
+
+// rateAllow 判断请求是否允许通过，优先使用redis计数，redis不可用时使用本地计数
+func (fw *WMFrameWorkV2) rateAllow(algorithm, key string, limit int, window time.Duration) (bool, time.Duration) {
+	if fw.redisCtl.enable && fw.redisCtl.client != nil {
+		script := luaSlidingWindow
+		if algorithm == RateLimitTokenBucket {
+			script = luaTokenBucket
+		}
+		now := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), redisCtxTimeo)
+		defer cancel()
+		ans, err := script.Run(ctx, fw.redisCtl.client,
+			[]string{fw.AppendRootPathRedis("ratelimit/" + key)},
+			now.UnixNano()/int64(time.Millisecond),
+			window.Milliseconds(),
+			limit,
+			strconv.FormatInt(now.UnixNano(), 10)+gopsu.GetRandomString(4)).Result()
+		if err == nil {
+			if v, ok := ans.([]interface{}); ok && len(v) == 2 {
+				allowed, _ := v[0].(int64)
+				wait, _ := v[1].(int64)
+				return allowed == 1, time.Duration(wait) * time.Millisecond
+			}
+		}
+		// 每分钟最多记录一次
+		if now.Unix()-atomic.LoadInt64(&fw.rateCtl.lastWarn) >= 60 {
+			atomic.StoreInt64(&fw.rateCtl.lastWarn, now.Unix())
+			fw.WriteWarning("RATE", "redis counter error, use local counter instead")
+		}
+	}
+	return fw.rateCtl.allow(algorithm, key, limit, window)
+}
+
+// abortRateLimit 返回429
+func (fw *WMFrameWorkV2) abortRateLimit(c *gin.Context, wait time.Duration) {
+	sec := int(math.Ceil(wait.Seconds()))
+	if sec < 1 {
+		sec = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(sec))
+	fw.Fail(c, ErrTooManyRequests, nil)
+}
+
+// RateLimiter 按配置文件对ip，User-Token，路由进行限流
+func (fw *WMFrameWorkV2) RateLimiter() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !fw.rateCtl.enable {
+			return
+		}
+		if l, ok := fw.rateCtl.routeLimit[c.FullPath()]; ok {
+			if ok, wait := fw.rateAllow(fw.rateCtl.algorithm, "route:"+c.FullPath(), l, fw.rateCtl.window); !ok {
+				fw.abortRateLimit(c, wait)
+				return
+			}
+		}
+		if fw.rateCtl.ipLimit > 0 {
+			if ok, wait := fw.rateAllow(fw.rateCtl.algorithm, "ip:"+fw.ClientIP(c), fw.rateCtl.ipLimit, fw.rateCtl.window); !ok {
+				fw.abortRateLimit(c, wait)
+				return
+			}
+		}
+		if fw.rateCtl.userLimit > 0 {
+			if uuid := c.GetHeader("User-Token"); len(uuid) == 36 {
+				if ok, wait := fw.rateAllow(fw.rateCtl.algorithm, "user:"+MD5Worker.Hash([]byte(uuid)), fw.rateCtl.userLimit, fw.rateCtl.window); !ok {
+					fw.abortRateLimit(c, wait)
+					return
+				}
+			}
+		}
+	}
+}
+
+// RateLimit 对单个路由（组）单独限流
+// name: 限流标识，相同标识共享计数
+// by: 计数依据，ip-按客户端ip，user-按User-Token，其他-所有请求共享
+// limit: 窗口内最大请求数
+// window: 统计窗口
+func (fw *WMFrameWorkV2) RateLimit(name, by string, limit int, window time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit <= 0 {
+			return
+		}
+		key := "custom:" + name
+		switch by {
+		case "ip":
+			key += ":" + fw.ClientIP(c)
+		case "user":
+			uuid := c.GetHeader("User-Token")
+			if len(uuid) != 36 {
+				uuid = fw.ClientIP(c)
+			}
+			key += ":" + MD5Worker.Hash([]byte(uuid))
+		}
+		algorithm := fw.rateCtl.algorithm
+		if algorithm == "" {
+			algorithm = RateLimitSlidingWindow
+		}
+		if ok, wait := fw.rateAllow(algorithm, key, limit, window); !ok {
+			fw.abortRateLimit(c, wait)
+		}
+	}
+}
+
+// ViewRateLimitConfig 查看限流配置,返回json字符串
+func (fw *WMFrameWorkV2) ViewRateLimitConfig() string {
+	return fw.rateCtl.forshow
+}
@@ -0,0 +1,104 @@
+package wmv2
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestRateConf() *rateLimitConfigure {
+	return &rateLimitConfigure{memBuckets: make(map[string]*memBucket)}
+}
+
+func TestSlidingWindowLocal(t *testing.T) {
+	conf := newTestRateConf()
+	window := time.Millisecond * 200
+	for i := 0; i < 3; i++ {
+		if ok, _ := conf.allow(RateLimitSlidingWindow, "k", 3, window); !ok {
+			t.Fatalf("request %d should be allowed", i)
+		}
+	}
+	ok, wait := conf.allow(RateLimitSlidingWindow, "k", 3, window)
+	if ok {
+		t.Fatal("4th request should be limited")
+	}
+	if wait <= 0 || wait > window {
+		t.Fatalf("unexpected wait %v", wait)
+	}
+	// 其他key不受影响
+	if ok, _ := conf.allow(RateLimitSlidingWindow, "other", 3, window); !ok {
+		t.Fatal("other key should be allowed")
+	}
+	time.Sleep(window)
+	if ok, _ := conf.allow(RateLimitSlidingWindow, "k", 3, window); !ok {
+		t.Fatal("request after window should be allowed")
+	}
+}
+
+func TestTokenBucketLocal(t *testing.T) {
+	conf := newTestRateConf()
+	window := time.Millisecond * 200
+	for i := 0; i < 2; i++ {
+		if ok, _ := conf.allow(RateLimitTokenBucket, "k", 2, window); !ok {
+			t.Fatalf("request %d should be allowed", i)
+		}
+	}
+	ok, wait := conf.allow(RateLimitTokenBucket, "k", 2, window)
+	if ok {
+		t.Fatal("3rd request should be limited")
+	}
+	// 每100ms补充一个令牌
+	if wait <= 0 || wait > window/2 {
+		t.Fatalf("unexpected wait %v", wait)
+	}
+	time.Sleep(wait + time.Millisecond*5)
+	if ok, _ := conf.allow(RateLimitTokenBucket, "k", 2, window); !ok {
+		t.Fatal("request after refill should be allowed")
+	}
+}
+
+func TestRateLimitClean(t *testing.T) {
+	conf := newTestRateConf()
+	conf.allow(RateLimitSlidingWindow, "short", 1, time.Millisecond*10)
+	conf.allow(RateLimitSlidingWindow, "long", 1, time.Hour)
+	time.Sleep(time.Millisecond * 30)
+	conf.clean()
+	if _, ok := conf.memBuckets["short"]; ok {
+		t.Fatal("expired bucket should be removed")
+	}
+	// 按各自的窗口清理
+	if _, ok := conf.memBuckets["long"]; !ok {
+		t.Fatal("bucket with longer window should be kept")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	fw := &WMFrameWorkV2{}
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	get := func(remote string, h map[string]string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		for k, v := range h {
+			req.Header.Set(k, v)
+		}
+		return fw.ClientIP(&gin.Context{Request: req})
+	}
+	// 没有可信代理时忽略转发头
+	if ip := get("1.2.3.4:5", map[string]string{"X-Forwarded-For": "9.9.9.9", "X-Real-IP": "8.8.8.8"}); ip != "1.2.3.4" {
+		t.Fatalf("got %s", ip)
+	}
+	fw.trustedProxies = []*net.IPNet{n}
+	if ip := get("1.2.3.4:5", map[string]string{"X-Forwarded-For": "9.9.9.9"}); ip != "1.2.3.4" {
+		t.Fatalf("untrusted proxy: got %s", ip)
+	}
+	// 客户端可以在X-Forwarded-For前部添加任意地址，从右向左取第一个不可信的地址
+	if ip := get("10.0.0.1:5", map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8, 10.0.0.2"}); ip != "5.6.7.8" {
+		t.Fatalf("trusted proxy: got %s", ip)
+	}
+	if ip := get("10.0.0.1:5", map[string]string{"X-Real-IP": "5.6.7.8"}); ip != "5.6.7.8" {
+		t.Fatalf("x-real-ip: got %s", ip)
+	}
+}
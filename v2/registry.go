@@ -0,0 +1,342 @@
+package wmv2
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/xyzj/gopsu"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// Instance 服务实例
+type Instance struct {
+	// 服务名称
+	Name string `json:"name"`
+	// 地址，ip:port格式
+	Addr string `json:"addr"`
+	// 服务类型，默认http或https
+	Protocol string `json:"protocol"`
+	// 交互协议，默认json
+	Interface string `json:"interface,omitempty"`
+	// 权重，默认1
+	Weight int `json:"weight"`
+	// 区域
+	Zone string `json:"zone,omitempty"`
+	// 版本
+	Version string `json:"version,omitempty"`
+	// 启动时间
+	StartAt string `json:"start_at,omitempty"`
+	// tcp服务端口，未启用时为0
+	TCPPort int `json:"tcp_port,omitempty"`
+	// grpc服务端口，未启用时为0
+	GRPCPort int `json:"grpc_port,omitempty"`
+	// 标签
+	Tags []string `json:"tags,omitempty"`
+	// 健康检查地址
+	HealthURL string `json:"health_url,omitempty"`
+	// 其他信息
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// URL 返回带http(s)前缀的地址，其他类型的服务与原PickerDetail相同，只返回地址
+func (i *Instance) URL() string {
+	if strings.HasPrefix(i.Protocol, "http") {
+		return i.Protocol + "://" + i.Addr
+	}
+	return i.Addr
+}
+
+// registryPrefix 服务实例注册路径
+func (fw *WMFrameWorkV2) registryPrefix(svrName string) string {
+	s := "/" + fw.rootPath + "/instances/"
+	if svrName != "" {
+		s += svrName + "/"
+	}
+	return s
+}
+
+// localInstance 本实例的注册信息
+// addr: ip:port格式
+// httpType: http或https
+func (fw *WMFrameWorkV2) localInstance(addr, httpType string) *Instance {
+	inst := &Instance{
+		Name:      fw.serverName,
+		Addr:      addr,
+		Protocol:  httpType,
+		Interface: "json",
+		Weight:    fw.etcdCtl.weight,
+		Zone:      fw.etcdCtl.zone,
+		Version:   fw.Tag(),
+		StartAt:   fw.startAt,
+		HealthURL: httpType + "://" + addr + "/health/mod",
+	}
+	if opt := fw.cnf.UseETCD; opt != nil {
+		if opt.SvrType != "" {
+			inst.Protocol = opt.SvrType
+		}
+		if opt.SvrProtocol != "" {
+			inst.Interface = opt.SvrProtocol
+		}
+		inst.GRPCPort = opt.GRPCPort
+		inst.Tags = opt.Tags
+		inst.Meta = opt.Meta
+	}
+	if fw.cnf.UseTCP != nil && fw.cnf.UseTCP.Activation {
+		inst.TCPPort = fw.tcpCtl.bindPort
+	}
+	return inst
+}
+
+// newRegistryClient 创建用于服务实例注册和发现的etcd客户端
+func (fw *WMFrameWorkV2) newRegistryClient() error {
+	fw.etcdCtl.cliLocker.Lock()
+	defer fw.etcdCtl.cliLocker.Unlock()
+	if fw.etcdCtl.cli != nil {
+		return nil
+	}
+	conf := clientv3.Config{
+		Endpoints:   []string{fw.etcdCtl.addr},
+		DialTimeout: time.Second * 5,
+		Username:    fw.etcdCtl.username,
+		Password:    fw.etcdCtl.password,
+	}
+	if fw.etcdCtl.usetls {
+		if _, err := tls.LoadX509KeyPair(fw.tlsCert, fw.tlsKey); err != nil {
+			return err
+		}
+		conf.TLS = fw.clientTLSConfig("")
+	}
+	cli, err := clientv3.New(conf)
+	if err != nil {
+		return err
+	}
+	fw.etcdCtl.cli = cli
+	return nil
+}
+
+// instanceReady 检查已启用的模块是否可用，返回不可用的模块名称
+func (fw *WMFrameWorkV2) instanceReady() (bool, string) {
+	if fw.cnf.UseSQL != nil && fw.cnf.UseSQL.Activation && !fw.MysqlIsReady() {
+		return false, "sql"
+	}
+	if fw.cnf.UseRedis != nil && fw.cnf.UseRedis.Activation && !fw.RedisIsReady() {
+		return false, "redis"
+	}
+	if fw.cnf.UseMQProducer != nil && fw.cnf.UseMQProducer.Activation && !fw.ProducerIsReady() {
+		return false, "mq_producer"
+	}
+	if fw.cnf.UseMQConsumer != nil && fw.cnf.UseMQConsumer.Activation && !fw.ConsumerIsReady() {
+		return false, "mq_consumer"
+	}
+	return true, ""
+}
+
+// keepInstance 使用租约注册服务实例并保持，阻塞直到租约失效或框架停止
+// 模块不可用时撤销租约，即删除注册信息，恢复后重新注册
+func (fw *WMFrameWorkV2) keepInstance(inst *Instance) error {
+	ctx := fw.etcdCtl.ctx
+	b, _ := json.Marshal(inst)
+	key := fw.registryPrefix(inst.Name) + inst.Addr
+	if fw.etcdCtl.legacyKey == "" {
+		fw.etcdCtl.legacyKey = fmt.Sprintf("/%s/%s/%s_%s", fw.rootPath, inst.Name, inst.Name, gopsu.GetUUID1())
+	}
+	tick := time.NewTicker(fw.etcdCtl.checkInterval)
+	defer tick.Stop()
+	defer fw.revokeInstance()
+	for {
+		// 等待模块可用
+		if ok, mod := fw.instanceReady(); !ok && fw.etcdCtl.readiness {
+			fw.WriteWarning("ETCD", "Instance not ready, waiting for "+mod)
+			for !ok {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-tick.C:
+				}
+				ok, _ = fw.instanceReady()
+			}
+		}
+		tctx, cancel := context.WithTimeout(ctx, time.Second*5)
+		lease, err := fw.etcdCtl.cli.Grant(tctx, fw.etcdCtl.ttl)
+		if err == nil {
+			// 旧版注册信息供未使用实例信息的服务选取，随租约一起撤销
+			_, err = fw.etcdCtl.cli.Txn(tctx).Then(
+				clientv3.OpPut(key, string(b), clientv3.WithLease(lease.ID)),
+				clientv3.OpPut(fw.etcdCtl.legacyKey, legacyRecord(inst), clientv3.WithLease(lease.ID)),
+			).Commit()
+			if err != nil {
+				fw.etcdCtl.cli.Revoke(tctx, lease.ID)
+			}
+		}
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		fw.etcdCtl.leaseLocker.Lock()
+		fw.etcdCtl.leaseID = lease.ID
+		fw.etcdCtl.leaseLocker.Unlock()
+		kctx, kcancel := context.WithCancel(ctx)
+		ka, err := fw.etcdCtl.cli.KeepAlive(kctx, lease.ID)
+		if err != nil {
+			kcancel()
+			return err
+		}
+		fw.WriteInfo("ETCD", "Success register instance "+key)
+		err = func() error {
+			defer kcancel()
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case _, ok := <-ka:
+					if !ok {
+						return fmt.Errorf("lease keep alive closed")
+					}
+				case <-tick.C:
+					if ok, mod := fw.instanceReady(); !ok && fw.etcdCtl.readiness {
+						fw.WriteWarning("ETCD", "Withdraw instance registration, "+mod+" is not ready")
+						fw.revokeInstance()
+						return nil
+					}
+				}
+			}
+		}()
+		if err != nil || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// revokeInstance 撤销租约，删除实例信息和旧版注册信息
+func (fw *WMFrameWorkV2) revokeInstance() {
+	fw.etcdCtl.leaseLocker.Lock()
+	defer fw.etcdCtl.leaseLocker.Unlock()
+	if fw.etcdCtl.cli == nil || fw.etcdCtl.leaseID == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	fw.etcdCtl.cli.Revoke(ctx, fw.etcdCtl.leaseID)
+	fw.etcdCtl.leaseID = 0
+}
+
+// legacyRecord 旧版注册信息，与microgo的格式相同
+func legacyRecord(inst *Instance) string {
+	ip, port, _ := net.SplitHostPort(inst.Addr)
+	js, _ := sjson.Set("", "ip", ip)
+	js, _ = sjson.Set(js, "port", port)
+	js, _ = sjson.Set(js, "name", inst.Name)
+	js, _ = sjson.Set(js, "INTFC", inst.Protocol)
+	js, _ = sjson.Set(js, "protocol", inst.Interface)
+	js, _ = sjson.Set(js, "timeConnect", time.Now().Unix())
+	js, _ = sjson.Set(js, "timeActive", time.Now().Unix())
+	js, _ = sjson.Set(js, "source", ip)
+	return js
+}
+
+// listLegacyInstances 读取只有旧版注册信息的服务实例
+func (fw *WMFrameWorkV2) listLegacyInstances(svrName string) ([]*Instance, error) {
+	if fw.etcdCtl.cli == nil {
+		return nil, fmt.Errorf("etcd client not ready")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	resp, err := fw.etcdCtl.cli.Get(ctx, "/"+fw.rootPath+"/"+svrName+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	ins := make([]*Instance, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		js := gjson.ParseBytes(kv.Value)
+		if js.Get("ip").String() == "" || js.Get("port").String() == "" {
+			continue
+		}
+		inst := &Instance{
+			Name:      svrName,
+			Addr:      net.JoinHostPort(js.Get("ip").String(), js.Get("port").String()),
+			Protocol:  js.Get("INTFC").String(),
+			Interface: js.Get("protocol").String(),
+			Weight:    1,
+		}
+		if inst.Protocol == "" {
+			inst.Protocol = "http"
+		}
+		ins = append(ins, inst)
+	}
+	return ins, nil
+}
+
+// listInstances 读取服务的所有实例
+// 已与etcd同步时使用本地快照，否则查询etcd，etcd不可用时使用缓存的快照
+func (fw *WMFrameWorkV2) listInstances(svrName string) ([]*Instance, error) {
+	fw.snapshot.locker.RLock()
+	synced := fw.snapshot.synced
+	fw.snapshot.locker.RUnlock()
+	if synced {
+		return fw.snapshot.list(svrName), nil
+	}
+	var err = fmt.Errorf("etcd client not ready")
+	if fw.etcdCtl.cli != nil {
+		var resp *clientv3.GetResponse
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
+		resp, err = fw.etcdCtl.cli.Get(ctx, fw.registryPrefix(svrName), clientv3.WithPrefix())
+		if err == nil {
+			ins := make([]*Instance, 0, len(resp.Kvs))
+			for _, kv := range resp.Kvs {
+				if _, inst := fw.parseInstance(string(kv.Key), kv.Value); inst != nil {
+					ins = append(ins, inst)
+				}
+			}
+			return ins, nil
+		}
+	}
+	if ins := fw.snapshot.list(svrName); len(ins) > 0 {
+		return ins, nil
+	}
+	return nil, err
+}
+
+// listAllInstances 读取所有服务的实例
+func (fw *WMFrameWorkV2) listAllInstances() ([]*Instance, error) {
+	fw.snapshot.locker.RLock()
+	synced := fw.snapshot.synced
+	names := make([]string, 0, len(fw.snapshot.services))
+	for k := range fw.snapshot.services {
+		names = append(names, k)
+	}
+	fw.snapshot.locker.RUnlock()
+	if !synced && fw.etcdCtl.cli != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
+		if resp, err := fw.etcdCtl.cli.Get(ctx, fw.registryPrefix(""), clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend)); err == nil {
+			ins := make([]*Instance, 0, len(resp.Kvs))
+			for _, kv := range resp.Kvs {
+				if _, inst := fw.parseInstance(string(kv.Key), kv.Value); inst != nil {
+					ins = append(ins, inst)
+				}
+			}
+			return ins, nil
+		}
+	}
+	if !synced && len(names) == 0 {
+		return nil, fmt.Errorf("etcd client not ready")
+	}
+	sort.Strings(names)
+	ins := make([]*Instance, 0)
+	for _, name := range names {
+		ins = append(ins, fw.snapshot.list(name)...)
+	}
+	return ins, nil
+}
@@ -0,0 +1,202 @@
+package wmv2
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xyzj/gopsu"
+)
+
+// 通用业务错误码
+const (
+	// CodeOK 成功
+	CodeOK = 0
+	// ErrInternal 服务内部错误
+	ErrInternal = 10000
+	// ErrParams 参数错误
+	ErrParams = 10001
+	// ErrUnauthorized 未登录或User-Token非法
+	ErrUnauthorized = 10002
+	// ErrForbidden 没有权限
+	ErrForbidden = 10003
+	// ErrNotFound 资源不存在
+	ErrNotFound = 10004
+	// ErrConflict 资源冲突或重复提交
+	ErrConflict = 10005
+	// ErrTooManyRequests 请求过于频繁
+	ErrTooManyRequests = 10006
+	// ErrSQL 数据库错误
+	ErrSQL = 10007
+	// ErrUpstream 上游服务错误
+	ErrUpstream = 10008
+	// ErrUnavailable 依赖的服务不可用，暂时无法处理
+	ErrUnavailable = 10009
+)
+
+const (
+	// LangZhCN 简体中文
+	LangZhCN = "zh-CN"
+	// LangEn 英文
+	LangEn = "en"
+)
+
+// ErrCode 业务错误码定义
+type ErrCode struct {
+	// 业务错误码
+	Code int
+	// 对应的http状态码
+	HTTPStatus int
+	// 多语言提示信息，key为语言
+	Messages map[string]string
+}
+
+// Message 返回指定语言的提示信息，找不到时返回中文
+func (e *ErrCode) Message(lang string) string {
+	if s, ok := e.Messages[lang]; ok {
+		return s
+	}
+	return e.Messages[LangZhCN]
+}
+
+// Response 标准返回结构
+type Response struct {
+	// 状态，1-成功，0-失败
+	Status int `json:"status"`
+	// 业务错误码，0-成功
+	Code int `json:"code"`
+	// 提示信息
+	Detail string `json:"detail"`
+	// 返回数据
+	Data interface{} `json:"data,omitempty"`
+	// 请求id
+	RequestID string `json:"request_id,omitempty"`
+}
+
+var (
+	errCodes = make(map[int]*ErrCode)
+	// 读写锁
+	errCodesLocker sync.RWMutex
+	// 默认语言
+	defaultLang = LangZhCN
+)
+
+func init() {
+	RegisterErrCode(CodeOK, http.StatusOK, "成功", "success")
+	RegisterErrCode(ErrInternal, http.StatusInternalServerError, "服务内部错误", "internal server error")
+	RegisterErrCode(ErrParams, http.StatusBadRequest, "参数错误", "invalid parameters")
+	RegisterErrCode(ErrUnauthorized, http.StatusUnauthorized, "User-Token非法", "User-Token illegal")
+	RegisterErrCode(ErrForbidden, http.StatusForbidden, "没有访问权限", "permission denied")
+	RegisterErrCode(ErrNotFound, http.StatusNotFound, "资源不存在", "resource not found")
+	RegisterErrCode(ErrConflict, http.StatusConflict, "请求冲突", "request conflict")
+	RegisterErrCode(ErrTooManyRequests, http.StatusTooManyRequests, "请求过于频繁", "too many requests")
+	RegisterErrCode(ErrSQL, http.StatusInternalServerError, "数据库错误", "sql error")
+	RegisterErrCode(ErrUpstream, http.StatusBadGateway, "上游服务错误", "upstream service error")
+	RegisterErrCode(ErrUnavailable, http.StatusServiceUnavailable, "服务暂不可用", "service unavailable")
+}
+
+// RegisterErrCode 注册业务错误码，已存在时覆盖
+// code: 业务错误码
+// httpStatus: 对应的http状态码
+// zh,en: 中英文提示信息
+func RegisterErrCode(code, httpStatus int, zh, en string) {
+	errCodesLocker.Lock()
+	defer errCodesLocker.Unlock()
+	errCodes[code] = &ErrCode{
+		Code:       code,
+		HTTPStatus: httpStatus,
+		Messages: map[string]string{
+			LangZhCN: zh,
+			LangEn:   en,
+		},
+	}
+}
+
+// LookupErrCode 查询业务错误码，未注册的错误码按服务内部错误处理
+func LookupErrCode(code int) *ErrCode {
+	errCodesLocker.RLock()
+	defer errCodesLocker.RUnlock()
+	if e, ok := errCodes[code]; ok {
+		return e
+	}
+	return &ErrCode{
+		Code:       code,
+		HTTPStatus: http.StatusInternalServerError,
+		Messages:   errCodes[ErrInternal].Messages,
+	}
+}
+
+func (fw *WMFrameWorkV2) loadResponseConfig() {
+	defaultLang = fw.wmConf.GetItemDefault("response_lang", LangZhCN, "接口默认提示语言，zh-CN 或 en，请求头Accept-Language优先")
+	fw.withRequestID, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("response_request_id", "false", "接口返回数据中是否包含请求id"))
+	fw.wmConf.Save()
+}
+
+// requestLang 根据Accept-Language选择提示语言
+func requestLang(c *gin.Context) string {
+	for _, v := range strings.Split(c.GetHeader("Accept-Language"), ",") {
+		v = strings.ToLower(strings.TrimSpace(strings.Split(v, ";")[0]))
+		switch {
+		case strings.HasPrefix(v, "zh"):
+			return LangZhCN
+		case strings.HasPrefix(v, "en"):
+			return LangEn
+		}
+	}
+	return defaultLang
+}
+
+// RequestID 为请求设置X-Request-ID，已有时沿用
+func (fw *WMFrameWorkV2) RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id = gopsu.GetUUID1()
+		}
+		c.Params = append(c.Params, gin.Param{
+			Key:   "_requestID",
+			Value: id,
+		})
+		c.Header("X-Request-ID", id)
+	}
+}
+
+func (fw *WMFrameWorkV2) newResponse(c *gin.Context, code int, detail string, data interface{}) *Response {
+	resp := &Response{
+		Code:   code,
+		Detail: detail,
+		Data:   data,
+	}
+	if code == CodeOK {
+		resp.Status = 1
+	}
+	if fw.withRequestID {
+		resp.RequestID = c.Param("_requestID")
+	}
+	return resp
+}
+
+// OK 返回成功
+func (fw *WMFrameWorkV2) OK(c *gin.Context, data interface{}) {
+	c.PureJSON(http.StatusOK, fw.newResponse(c, CodeOK, LookupErrCode(CodeOK).Message(requestLang(c)), data))
+}
+
+// Fail 返回失败，并退出后续处理
+// code: 业务错误码，http状态码根据注册信息自动设置
+// err: 错误详情，可为nil
+func (fw *WMFrameWorkV2) Fail(c *gin.Context, code int, err error) {
+	fw.FailWithData(c, code, err, nil)
+}
+
+// FailWithData 返回失败，同时返回额外数据，并退出后续处理
+func (fw *WMFrameWorkV2) FailWithData(c *gin.Context, code int, err error, data interface{}) {
+	e := LookupErrCode(code)
+	detail := e.Message(requestLang(c))
+	if err != nil {
+		detail += ": " + err.Error()
+	}
+	c.Abort()
+	c.PureJSON(e.HTTPStatus, fw.newResponse(c, code, detail, data))
+}
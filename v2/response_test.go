@@ -0,0 +1,81 @@
+package wmv2
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xyzj/gopsu"
+)
+
+// responseRequest 请求并解析标准返回
+func responseRequest(t *testing.T, r *gin.Engine, p string, h map[string]string) (int, *Response) {
+	w := webGet(r, p, h)
+	resp := &Response{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatalf("%s: %v %s", p, err, w.Body.String())
+	}
+	return w.Code, resp
+}
+
+func TestResponse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fw := &WMFrameWorkV2{wmLog: &gopsu.NilLogger{}, withRequestID: true}
+	r := gin.New()
+	r.Use(fw.RequestID())
+	r.GET("/ok", func(c *gin.Context) {
+		fw.OK(c, map[string]int{"a": 1})
+	})
+	r.GET("/fail", func(c *gin.Context) {
+		fw.Fail(c, ErrNotFound, errors.New("user"))
+	}, func(c *gin.Context) {
+		c.String(http.StatusOK, "not reached")
+	})
+	r.GET("/sql", func(c *gin.Context) {
+		if fw.DealWithSQLError(c, errors.New("secret table")) {
+			return
+		}
+		fw.OK(c, nil)
+	})
+	code, resp := responseRequest(t, r, "/ok", map[string]string{"X-Request-ID": "rid"})
+	if code != http.StatusOK || resp.Status != 1 || resp.Code != CodeOK || resp.Detail != "成功" || resp.RequestID != "rid" {
+		t.Fatalf("ok: %d %+v", code, resp)
+	}
+	if resp.Data.(map[string]interface{})["a"] != float64(1) {
+		t.Fatalf("ok data: %+v", resp.Data)
+	}
+	code, resp = responseRequest(t, r, "/fail", map[string]string{"Accept-Language": "en-US,en;q=0.9"})
+	if code != http.StatusNotFound || resp.Status != 0 || resp.Code != ErrNotFound || resp.Detail != "resource not found: user" || resp.RequestID == "" {
+		t.Fatalf("fail: %d %+v", code, resp)
+	}
+	// sql错误只记录日志，不返回详情
+	code, resp = responseRequest(t, r, "/sql", nil)
+	if code != http.StatusInternalServerError || resp.Status != 0 || resp.Code != ErrSQL || resp.Detail != "数据库错误" || resp.Data != nil {
+		t.Fatalf("sql: %d %+v", code, resp)
+	}
+}
+
+func TestRegisterErrCode(t *testing.T) {
+	const code = 20001
+	defer func() {
+		errCodesLocker.Lock()
+		delete(errCodes, code)
+		errCodesLocker.Unlock()
+	}()
+	// 未注册的错误码按服务内部错误处理
+	if e := LookupErrCode(code); e.HTTPStatus != http.StatusInternalServerError || e.Message(LangZhCN) != "服务内部错误" {
+		t.Fatalf("unregistered: %+v", e)
+	}
+	RegisterErrCode(code, http.StatusPaymentRequired, "余额不足", "insufficient balance")
+	if e := LookupErrCode(code); e.HTTPStatus != http.StatusPaymentRequired || e.Message(LangEn) != "insufficient balance" {
+		t.Fatalf("registered: %+v", e)
+	}
+	// 重复注册时覆盖
+	RegisterErrCode(code, http.StatusBadRequest, "额度不足", "insufficient quota")
+	e := LookupErrCode(code)
+	if e.HTTPStatus != http.StatusBadRequest || e.Message(LangZhCN) != "额度不足" || e.Message("fr") != "额度不足" {
+		t.Fatalf("overwritten: %+v", e)
+	}
+}
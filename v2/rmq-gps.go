@@ -1,7 +1,6 @@
 package wmv2
 
 import (
-	"crypto/tls"
 	"fmt"
 	"math"
 	"os/exec"
@@ -29,7 +28,7 @@ func (fw *WMFrameWorkV2) newGPSConsumer() {
 	})
 
 	if fw.rmqCtl.usetls {
-		fw.rmqCtl.gpsConsumer.StartTLS(&tls.Config{InsecureSkipVerify: true})
+		fw.rmqCtl.gpsConsumer.StartTLS(fw.mqTLSConfig())
 	} else {
 		fw.rmqCtl.gpsConsumer.Start()
 	}
@@ -1,7 +1,6 @@
 package wmv2
 
 import (
-	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"strconv"
@@ -42,6 +41,8 @@ type rabbitConfigure struct {
 	autodel bool
 	// 是否启用tls
 	usetls bool
+	// 是否跳过服务端证书校验
+	tlsInsecure bool
 	// protocol
 	protocol string
 	// 是否启用rmq
@@ -76,6 +77,7 @@ func (fw *WMFrameWorkV2) loadMQConfig() {
 	fw.rmqCtl.autodel, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("mq_autodel", "true", "队列在未使用时是否删除"))
 	fw.rmqCtl.enable, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("mq_enable", "true", "是否启用rabbitmq"))
 	fw.rmqCtl.usetls, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("mq_tls", "true", "是否使用证书连接rabbitmq服务"))
+	fw.rmqCtl.tlsInsecure, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("mq_tls_insecure", "false", "是否跳过rabbitmq服务端证书校验，仅在无法使用有效证书时设置为true"))
 	fw.rmqCtl.protocol = "amqps"
 	if !fw.rmqCtl.usetls {
 		fw.rmqCtl.addr = strings.Replace(fw.rmqCtl.addr, "5671", "5672", 1)
@@ -98,7 +100,7 @@ func (fw *WMFrameWorkV2) newMQProducer() bool {
 		LogWriter:   fw.wmLog,
 	})
 	if fw.rmqCtl.usetls {
-		return fw.rmqCtl.mqProducer.StartTLS(&tls.Config{InsecureSkipVerify: true})
+		return fw.rmqCtl.mqProducer.StartTLS(fw.mqTLSConfig())
 	}
 	return fw.rmqCtl.mqProducer.Start()
 }
@@ -128,7 +130,7 @@ func (fw *WMFrameWorkV2) newMQConsumer() bool {
 		LogWriter:   fw.wmLog,
 	})
 	if fw.rmqCtl.usetls {
-		return fw.rmqCtl.mqConsumer.StartTLS(&tls.Config{InsecureSkipVerify: true})
+		return fw.rmqCtl.mqConsumer.StartTLS(fw.mqTLSConfig())
 	}
 	return fw.rmqCtl.mqConsumer.Start()
 }
@@ -153,6 +155,7 @@ RECV:
 		}
 		for d := range rcvMQ {
 			f(d.RoutingKey, d.Body)
+			fw.pushMQ(d.RoutingKey, d.Body)
 			if !fw.Debug() {
 				continue
 			}
@@ -0,0 +1,58 @@
+package wmv2
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/xyzj/gopsu"
+)
+
+// readSecret 读取敏感配置项，默认值为空
+// 配置值支持以下格式：
+//
+//	env:NAME 从环境变量NAME读取
+//	file:/path/to/secret 从文件读取，去除首尾空白
+//	其他 与其他密码配置相同，使用gopsu.DecodeString解码
+func (fw *WMFrameWorkV2) readSecret(key, remark string) string {
+	s := fw.wmConf.GetItemDefault(key, "", remark+"，支持env:环境变量名，file:文件路径")
+	switch {
+	case s == "":
+		return ""
+	case strings.HasPrefix(s, "env:"):
+		return os.Getenv(strings.TrimPrefix(s, "env:"))
+	case strings.HasPrefix(s, "file:"):
+		b, err := ioutil.ReadFile(strings.TrimPrefix(s, "file:"))
+		if err != nil {
+			fw.WriteError("CORE", "read secret "+key+" error: "+err.Error())
+			return ""
+		}
+		return strings.TrimSpace(string(b))
+	default:
+		return gopsu.DecodeString(s)
+	}
+}
+
+// production 是否为生产模式，生产模式下缺少敏感配置时拒绝使用相关功能
+func (fw *WMFrameWorkV2) production() bool {
+	return !*debug
+}
+
+// loadSecretConfig 读取加密密钥等框架级敏感配置
+func (fw *WMFrameWorkV2) loadSecretConfig() {
+	key := fw.readSecret("crypto_key", "CWorker加密密钥，16字节，生产模式下未设置时CWorker不可用")
+	iv := fw.readSecret("crypto_iv", "CWorker加密向量，16字节，生产模式下未设置时CWorker不可用")
+	switch {
+	case len(key) == 16 && len(iv) == 16:
+		CWorker.SetKey(key, iv)
+	case fw.production():
+		// 不设置密钥，加密和解密返回空字符串，避免使用重启后无法解密的随机密钥
+		fw.WriteError("CORE", "crypto_key and crypto_iv should both be 16 bytes, CWorker is disabled")
+	default:
+		fw.WriteWarning("CORE", "crypto_key and crypto_iv should both be 16 bytes, use random key in debug mode")
+		CWorker.SetKey(gopsu.GetRandomString(16), gopsu.GetRandomString(16))
+	}
+	fw.legalHigh = fw.readSecret("uuid_legal", "调用usermanager获取固定uuid时的Legal-High凭据")
+	fw.legalHighLegacy, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("uuid_legal_legacy", "false", "未设置uuid_legal时是否使用旧版按月计算的Legal-High凭据，仅用于usermanager升级前的过渡"))
+}
@@ -0,0 +1,188 @@
+package wmv2
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/sjson"
+	"github.com/xyzj/gopsu"
+	ginmiddleware "github.com/xyzj/gopsu/gin-middleware"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// http服务配置
+type serverConfigure struct {
+	forshow string
+	// 监听地址
+	listens []string
+	// 读取请求头超时
+	readHeaderTimeout time.Duration
+	// 读取请求超时
+	readTimeout time.Duration
+	// 写入返回超时
+	writeTimeout time.Duration
+	// 空闲连接超时
+	idleTimeout time.Duration
+	// 请求头最大字节数
+	maxHeaderBytes int
+	// 是否启用http2
+	h2 bool
+	// http2单连接最大并发流
+	h2MaxStreams uint32
+	// http2最大帧大小
+	h2MaxFrameSize uint32
+	// http服务是否启用h2c
+	h2c bool
+}
+
+func (conf *serverConfigure) show() string {
+	conf.forshow, _ = sjson.Set("", "listen", conf.listens)
+	conf.forshow, _ = sjson.Set(conf.forshow, "read_header_timeout", conf.readHeaderTimeout.String())
+	conf.forshow, _ = sjson.Set(conf.forshow, "read_timeout", conf.readTimeout.String())
+	conf.forshow, _ = sjson.Set(conf.forshow, "write_timeout", conf.writeTimeout.String())
+	conf.forshow, _ = sjson.Set(conf.forshow, "idle_timeout", conf.idleTimeout.String())
+	conf.forshow, _ = sjson.Set(conf.forshow, "max_header_bytes", conf.maxHeaderBytes)
+	conf.forshow, _ = sjson.Set(conf.forshow, "h2", conf.h2)
+	conf.forshow, _ = sjson.Set(conf.forshow, "h2c", conf.h2c)
+	return conf.forshow
+}
+
+// readDuration 读取秒为单位的时长配置
+func (fw *WMFrameWorkV2) readDuration(key string, def time.Duration, remark string) time.Duration {
+	s := fw.wmConf.GetItemDefault(key, strconv.Itoa(int(def.Seconds())), remark)
+	return time.Second * time.Duration(gopsu.String2Int(s, 10))
+}
+
+func (fw *WMFrameWorkV2) loadServerConfig(port int) {
+	// 默认与原有的全局超时一致
+	st := ginmiddleware.GetSocketTimeout()
+	fw.serverCtl.listens = splitConfigList(fw.wmConf.GetItemDefault("http_listen", "", "http服务监听地址，用`,`分割多个，如0.0.0.0:6819,[::1]:6819,unix:/run/svr.sock，留空监听所有地址的http启动参数端口"))
+	fw.serverCtl.readHeaderTimeout = fw.readDuration("http_read_header_timeout", time.Second*10, "读取请求头超时（秒）")
+	fw.serverCtl.readTimeout = fw.readDuration("http_read_timeout", st, "读取请求超时（秒），0不限制")
+	fw.serverCtl.writeTimeout = fw.readDuration("http_write_timeout", st, "写入返回超时（秒），0不限制")
+	fw.serverCtl.idleTimeout = fw.readDuration("http_idle_timeout", st, "空闲连接超时（秒）")
+	fw.serverCtl.maxHeaderBytes = gopsu.String2Int(fw.wmConf.GetItemDefault("http_max_header_bytes", strconv.Itoa(http.DefaultMaxHeaderBytes), "请求头最大字节数"), 10)
+	fw.serverCtl.h2, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("http_h2", "true", "https服务是否启用http2"))
+	fw.serverCtl.h2MaxStreams = uint32(gopsu.String2Int(fw.wmConf.GetItemDefault("http_h2_max_streams", "250", "http2单个连接的最大并发请求数"), 10))
+	fw.serverCtl.h2MaxFrameSize = uint32(gopsu.String2Int(fw.wmConf.GetItemDefault("http_h2_max_frame_size", "1048576", "http2最大帧字节数，16384-16777215"), 10))
+	fw.serverCtl.h2c, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("http_h2c", "false", "http服务（-forcehttp或-debug）是否支持h2c，仅用于内网"))
+	fw.wmConf.Save()
+	if len(fw.serverCtl.listens) == 0 {
+		fw.serverCtl.listens = []string{fmt.Sprintf(":%d", port)}
+	}
+	if fw.serverCtl.maxHeaderBytes <= 0 {
+		fw.serverCtl.maxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+	fw.serverCtl.show()
+}
+
+type connCtxKey struct{}
+
+// requestConn 返回http/1.x请求使用的连接，http2请求返回nil
+func requestConn(r *http.Request) net.Conn {
+	if r.ProtoMajor != 1 {
+		return nil
+	}
+	conn, _ := r.Context().Value(connCtxKey{}).(net.Conn)
+	return conn
+}
+
+// withWriteTimeout 按请求设置写入超时，推送路由不限制
+// http.Server的WriteTimeout对所有请求生效，会断开sse长连接，因此由这里设置；http2请求由流控和空闲超时限制
+func (fw *WMFrameWorkV2) withWriteTimeout(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn := requestConn(r); conn != nil {
+			// 连接复用时需覆盖上一个请求的设置
+			switch {
+			case fw.pushPath(r.URL.Path), fw.serverCtl.writeTimeout <= 0:
+				conn.SetWriteDeadline(time.Time{})
+			default:
+				conn.SetWriteDeadline(time.Now().Add(fw.serverCtl.writeTimeout))
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// newHTTPServer 按配置创建http服务
+func (fw *WMFrameWorkV2) newHTTPServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              fw.serverCtl.listens[0],
+		Handler:           fw.withWriteTimeout(h),
+		ReadHeaderTimeout: fw.serverCtl.readHeaderTimeout,
+		ReadTimeout:       fw.serverCtl.readTimeout,
+		IdleTimeout:       fw.serverCtl.idleTimeout,
+		MaxHeaderBytes:    fw.serverCtl.maxHeaderBytes,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connCtxKey{}, c)
+		},
+	}
+}
+
+func (fw *WMFrameWorkV2) http2Server() *http2.Server {
+	return &http2.Server{
+		MaxConcurrentStreams: fw.serverCtl.h2MaxStreams,
+		MaxReadFrameSize:     fw.serverCtl.h2MaxFrameSize,
+		IdleTimeout:          fw.serverCtl.idleTimeout,
+	}
+}
+
+// listen 监听地址，unix:开头时监听unix socket
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		p := strings.TrimPrefix(addr, "unix:")
+		// 删除上次运行残留的socket文件
+		os.Remove(p)
+		return net.Listen("unix", p)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// serve 在所有监听地址上启动服务，任一地址监听失败时关闭已打开的地址并返回错误，
+// 任一地址服务退出时关闭服务并返回该错误
+// useTLS: 是否启用https，s.TLSConfig需已设置
+func (fw *WMFrameWorkV2) serve(s *http.Server, useTLS bool) error {
+	if useTLS {
+		if fw.serverCtl.h2 {
+			if err := http2.ConfigureServer(s, fw.http2Server()); err != nil {
+				return err
+			}
+		} else {
+			s.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+	} else if fw.serverCtl.h2c {
+		s.Handler = h2c.NewHandler(s.Handler, fw.http2Server())
+	}
+	ls := make([]net.Listener, 0, len(fw.serverCtl.listens))
+	for _, addr := range fw.serverCtl.listens {
+		l, err := listen(addr)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return fmt.Errorf("listen %s: %w", addr, err)
+		}
+		ls = append(ls, l)
+	}
+	chErr := make(chan error, len(ls))
+	for _, l := range ls {
+		go func(l net.Listener) {
+			if useTLS {
+				chErr <- s.ServeTLS(l, "", "")
+			} else {
+				chErr <- s.Serve(l)
+			}
+		}(l)
+	}
+	err := <-chErr
+	s.Close()
+	return err
+}
@@ -0,0 +1,28 @@
+package wmv2
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeListenFail(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	sock := filepath.Join(t.TempDir(), "svr.sock")
+	fw := &WMFrameWorkV2{
+		serverCtl: &serverConfigure{listens: []string{"unix:" + sock, busy.Addr().String()}},
+	}
+	if err := fw.serve(fw.newHTTPServer(http.NewServeMux()), false); err == nil {
+		t.Fatal("serve should fail when an address is in use")
+	}
+	// 已打开的地址应被关闭
+	if c, err := net.Dial("unix", sock); err == nil {
+		c.Close()
+		t.Fatal("listener opened before the failure is still serving")
+	}
+}
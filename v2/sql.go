@@ -142,32 +142,38 @@ MAINTAIN:
 		for {
 			t := time.Now()
 			if t.Minute() == 1 && t.Hour() == 2 {
-				// 重新刷新配置
-				fw.dbCtl.mrgTables = strings.Split(fw.wmConf.GetItemDefault("db_mrg_tables", "", "使用mrg_myisam引擎分表的总表名称，用`,`分割多个总表"), ",")
-				fw.dbCtl.mrgMaxSubTables = gopsu.String2Int(fw.wmConf.GetItemDefault("db_mrg_maxsubtables", "10", "分表子表数量，最小为1"), 10)
-				fw.dbCtl.mrgSubTableSize = gopsu.String2Int64(fw.wmConf.GetItemDefault("db_mrg_subtablesize", "1800", "子表最大磁盘空间容量（MB），当超过该值时，进行分表操作,推荐默认值1800"), 10)
-				if fw.dbCtl.mrgSubTableSize < 1 {
-					fw.dbCtl.mrgSubTableSize = 10
-				}
-				fw.dbCtl.mrgSubTableRows = gopsu.String2Int64(fw.wmConf.GetItemDefault("db_mrg_subtablerows", "4500000", "子表最大行数，当超过该值时，进行分表操作，推荐默认值4500000"), 10)
-
-				for _, v := range fw.dbCtl.mrgTables {
-					tableName := strings.TrimSpace(v)
-					if tableName == "" {
-						continue
+				// 多实例时每天仅由一个实例维护，其他实例不等待
+				err := fw.RunOncePerDay("mrg-tables", func() {
+					// 重新刷新配置
+					fw.dbCtl.mrgTables = strings.Split(fw.wmConf.GetItemDefault("db_mrg_tables", "", "使用mrg_myisam引擎分表的总表名称，用`,`分割多个总表"), ",")
+					fw.dbCtl.mrgMaxSubTables = gopsu.String2Int(fw.wmConf.GetItemDefault("db_mrg_maxsubtables", "10", "分表子表数量，最小为1"), 10)
+					fw.dbCtl.mrgSubTableSize = gopsu.String2Int64(fw.wmConf.GetItemDefault("db_mrg_subtablesize", "1800", "子表最大磁盘空间容量（MB），当超过该值时，进行分表操作,推荐默认值1800"), 10)
+					if fw.dbCtl.mrgSubTableSize < 1 {
+						fw.dbCtl.mrgSubTableSize = 10
 					}
-					_, _, size, rows, err := fw.dbCtl.client.ShowTableInfo(tableName)
-					if err != nil {
-						fw.WriteError("SQL", "SHOW table "+tableName+" "+err.Error())
-						continue
-					}
-					if size >= fw.dbCtl.mrgSubTableSize || rows >= fw.dbCtl.mrgSubTableRows {
-						err = fw.dbCtl.client.MergeTable(tableName, fw.dbCtl.mrgMaxSubTables)
+					fw.dbCtl.mrgSubTableRows = gopsu.String2Int64(fw.wmConf.GetItemDefault("db_mrg_subtablerows", "4500000", "子表最大行数，当超过该值时，进行分表操作，推荐默认值4500000"), 10)
+
+					for _, v := range fw.dbCtl.mrgTables {
+						tableName := strings.TrimSpace(v)
+						if tableName == "" {
+							continue
+						}
+						_, _, size, rows, err := fw.dbCtl.client.ShowTableInfo(tableName)
 						if err != nil {
-							fw.WriteError("SQL", "MRG table "+tableName+" "+err.Error())
+							fw.WriteError("SQL", "SHOW table "+tableName+" "+err.Error())
 							continue
 						}
+						if size >= fw.dbCtl.mrgSubTableSize || rows >= fw.dbCtl.mrgSubTableRows {
+							err = fw.dbCtl.client.MergeTable(tableName, fw.dbCtl.mrgMaxSubTables)
+							if err != nil {
+								fw.WriteError("SQL", "MRG table "+tableName+" "+err.Error())
+								continue
+							}
+						}
 					}
+				})
+				if err != nil {
+					fw.WriteError("SQL", "maintain mrg tables error|"+err.Error())
 				}
 				time.Sleep(time.Hour)
 			}
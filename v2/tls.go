@@ -0,0 +1,121 @@
+package wmv2
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// caPoolCache 校验服务端证书使用的根证书，ca.pem变化时重新读取
+type caPoolCache struct {
+	locker  sync.Mutex
+	modTime time.Time
+	size    int64
+	pool    *x509.CertPool
+}
+
+// rootCAPool 系统根证书和框架ca证书
+func (fw *WMFrameWorkV2) rootCAPool() *x509.CertPool {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if b, err := ioutil.ReadFile(fw.tlsRoot); err == nil {
+		pool.AppendCertsFromPEM(b)
+	}
+	return pool
+}
+
+// verifyPool 返回当前的根证书，ca.pem的修改时间或大小变化时重新生成
+func (fw *WMFrameWorkV2) verifyPool() *x509.CertPool {
+	c := fw.caPool
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	info, err := os.Stat(fw.tlsRoot)
+	if c.pool != nil && (err != nil || (info.ModTime().Equal(c.modTime) && info.Size() == c.size)) {
+		return c.pool
+	}
+	c.pool = fw.rootCAPool()
+	if err == nil {
+		c.modTime, c.size = info.ModTime(), info.Size()
+	}
+	return c.pool
+}
+
+// clientTLSConfig 客户端tls配置，使用系统根证书和框架ca证书校验服务端证书，服务端要求时提供框架证书作为客户端证书
+// serverName: 校验的域名或ip，留空时由etcd，rabbitmq客户端按连接地址设置
+func (fw *WMFrameWorkV2) clientTLSConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName:           serverName,
+		RootCAs:              fw.verifyPool(),
+		GetClientCertificate: fw.getClientCertificate,
+	}
+}
+
+// matchTarget 检查连接地址是否在目标列表中，目标可以是ip，域名或ip:端口
+func matchTarget(targets []string, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	for _, v := range targets {
+		if strings.EqualFold(v, host) || strings.EqualFold(v, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialTLS 建立tls连接，按实际连接的ip或域名校验服务端证书，每次连接使用当前的根证书，ca.pem更新后无需重启
+// insecureTargets: 不校验证书的目标，仅用于明确配置的场景
+// clientCert: 服务端要求时是否提供框架证书
+// timeo: 连接和握手的超时
+func (fw *WMFrameWorkV2) dialTLS(insecureTargets []string, clientCert bool, timeo time.Duration) func(context.Context, string, string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: timeo}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		tc := fw.clientTLSConfig(host)
+		if !clientCert {
+			tc.GetClientCertificate = nil
+		}
+		if matchTarget(insecureTargets, addr) {
+			tc.InsecureSkipVerify = true
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeo*2)
+		defer cancel()
+		return (&tls.Dialer{NetDialer: d, Config: tc}).DialContext(ctx, network, addr)
+	}
+}
+
+// getClientCertificate 服务端要求时提供框架证书，证书更新后重新读取
+func (fw *WMFrameWorkV2) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if c, ok := fw.clientCert.Load().(*tls.Certificate); ok && c != nil {
+		return c, nil
+	}
+	cert, err := tls.LoadX509KeyPair(fw.tlsCert, fw.tlsKey)
+	if err != nil {
+		// 不提供证书，由服务端决定是否拒绝
+		return &tls.Certificate{}, nil
+	}
+	fw.clientCert.Store(&cert)
+	return &cert, nil
+}
+
+// mqTLSConfig rabbitmq的tls配置
+func (fw *WMFrameWorkV2) mqTLSConfig() *tls.Config {
+	tc := fw.clientTLSConfig("")
+	if fw.rmqCtl.tlsInsecure {
+		fw.WriteWarning("MQ", "tls certificate verification is disabled by mq_tls_insecure")
+		tc.InsecureSkipVerify = true
+	}
+	return tc
+}
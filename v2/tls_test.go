@@ -0,0 +1,96 @@
+package wmv2
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientTLSReloadCA(t *testing.T) {
+	dir := t.TempDir()
+	fw := &WMFrameWorkV2{
+		rootPath:   "test",
+		baseCAPath: dir,
+		tlsRoot:    filepath.Join(dir, "ca.pem"),
+		caPool:     &caPoolCache{},
+	}
+	certfile, keyfile := filepath.Join(dir, "s.pem"), filepath.Join(dir, "s-key.pem")
+	serve := func() *httptest.Server {
+		if err := fw.IssueCert(&CertRequest{CommonName: "s", Hosts: []string{"127.0.0.1"}, Server: true}, certfile, keyfile); err != nil {
+			t.Fatal(err)
+		}
+		cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		s.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		s.StartTLS()
+		return s
+	}
+	client := &http.Client{Transport: &http.Transport{DialTLSContext: fw.dialTLS(nil, true, time.Second), DisableKeepAlives: true}}
+	if err := fw.CAInit(false); err != nil {
+		t.Fatal(err)
+	}
+	s := serve()
+	if _, err := client.Get(s.URL); err != nil {
+		t.Fatalf("first ca: %v", err)
+	}
+	s.Close()
+	// 更换根证书后无需重建客户端
+	if err := fw.CAInit(true); err != nil {
+		t.Fatal(err)
+	}
+	s = serve()
+	defer s.Close()
+	if _, err := client.Get(s.URL); err != nil {
+		t.Fatalf("rotated ca: %v", err)
+	}
+	// 其他ca签发的证书不被信任
+	other := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+	if _, err := client.Get(other.URL); err == nil {
+		t.Fatal("certificate from unknown ca should be rejected")
+	}
+}
+
+func TestClientTLSServerName(t *testing.T) {
+	dir := t.TempDir()
+	fw := &WMFrameWorkV2{
+		rootPath:   "test",
+		baseCAPath: dir,
+		tlsRoot:    filepath.Join(dir, "ca.pem"),
+		caPool:     &caPoolCache{},
+	}
+	if err := fw.CAInit(false); err != nil {
+		t.Fatal(err)
+	}
+	certfile, keyfile := filepath.Join(dir, "s.pem"), filepath.Join(dir, "s-key.pem")
+	if err := fw.IssueCert(&CertRequest{CommonName: "evil.example", Hosts: []string{"evil.example"}, Server: true}, certfile, keyfile); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s.StartTLS()
+	defer s.Close()
+	// 证书由信任的ca签发，但不包含访问使用的ip
+	client := &http.Client{Transport: &http.Transport{DialTLSContext: fw.dialTLS(nil, true, time.Second), DisableKeepAlives: true}}
+	if _, err := client.Get(s.URL); err == nil {
+		t.Fatal("certificate for another name should be rejected")
+	}
+	client = &http.Client{Transport: &http.Transport{DialTLSContext: fw.dialTLS([]string{"127.0.0.1"}, true, time.Second), DisableKeepAlives: true}}
+	if _, err := client.Get(s.URL); err != nil {
+		t.Fatalf("insecure target: %v", err)
+	}
+	addr := s.Listener.Addr().String()
+	if !matchTarget([]string{addr}, addr) || matchTarget([]string{"127.0.0.2"}, addr) {
+		t.Fatal("unexpected target match")
+	}
+}
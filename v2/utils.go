@@ -2,8 +2,11 @@ package wmv2
 
 import (
 	"flag"
+	"io/fs"
+	"net"
 	"net/http"
 	"runtime"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -33,6 +36,12 @@ var (
 	conf = flag.String("conf", "", "set the config file path.")
 	// 服务名增加随机字符，用于调试时名称不重复
 	nameTail = flag.String("nametail", "", "Add a string tail after the service name")
+	// 证书管理
+	caCmd   = flag.String("ca", "", "manage the site certificates and exit. init-create root ca, server-reissue the service certificate, client-issue a client certificate named by -cacn.")
+	caHosts = flag.String("cahosts", "", "extra hosts or ips for -ca server/client, separated by `,`")
+	caCN    = flag.String("cacn", "", "the common name of the client certificate for -ca client")
+	// 输出api文档
+	openapiOut = flag.String("openapi", "", "write the OpenAPI 3 spec of all http routes to the file and exit.")
 	// 版本信息
 	ver = flag.Bool("version", false, "print version info and exit.")
 	// 帮助信息
@@ -54,6 +63,12 @@ type OptionETCD struct {
 	SvrType string
 	// 交互协议，留空默认json
 	SvrProtocol string
+	// grpc服务端口，未启用时留空
+	GRPCPort int
+	// 发布到etcd的实例标签
+	Tags []string
+	// 发布到etcd的实例附加信息
+	Meta map[string]string
 	// 启用
 	Activation bool
 }
@@ -104,6 +119,10 @@ type OptionMQConsumer struct {
 type OptionHTTP struct {
 	// 路由引擎组合方法，推荐使用这个方法代替GinEngine值，可以避免过早初始化
 	EngineFunc func() *gin.Engine
+	// web页面文件，通常为embed.FS，路由由webui_path配置
+	WebUI fs.FS
+	// WebUI中页面所在的子目录，如dist
+	WebUIRoot string
 	// 启用
 	Activation bool
 }
@@ -165,6 +184,10 @@ type WMFrameWorkV2 struct {
 	rootPathMQ    string
 	gpsTimer      int64 // 启用gps校时,0-不启用，1-启用（30～900s内进行矫正），2-强制对时
 	httpProtocol  string
+	withRequestID bool // 接口返回数据包含请求id
+	// 获取固定uuid的凭据
+	legalHigh       string
+	legalHighLegacy bool
 	// tls配置
 	baseCAPath   string
 	tlsCert      string //  = filepath.Join(baseCAPath, "client-cert.pem")
@@ -185,6 +208,26 @@ type WMFrameWorkV2 struct {
 	dbCtl          *dbConfigure
 	rmqCtl         *rabbitConfigure
 	tcpCtl         *tcpConfigure
+	rateCtl        *rateLimitConfigure
+	compressCtl    *compressConfigure
+	apiDocs        *apiDocs
+	svcCtl         *serviceClientConfigure
+	gatewayCtl     *gatewayConfigure
+	lb             *balancer
+	snapshot       *serviceSnapshot
+	certCtl        *certConfigure
+	serverCtl      *serverConfigure
+	pushCtl        *pushConfigure
+	idemCtl        *idempotencyConfigure
+	auditCtl       *auditConfigure
+	captureCtl     *captureConfigure
+	webCtl         *webConfigure
+	httpEngine     *gin.Engine          // NewHTTPEngine创建的引擎
+	apiSunset      map[string]time.Time // 已弃用的接口版本
+	clientCert     atomic.Value         // 框架证书，*tls.Certificate
+	caPool         *caPoolCache         // 校验服务端证书的根证书
+	trustedProxies []*net.IPNet         // 可信的反向代理地址
+	mtlsCtl        *mtlsConfigure
 	httpClientPool *http.Client
 	JSON           jsoniter.API
 	cnf            *OptionFrameWorkV2
@@ -194,8 +237,8 @@ func init() {
 	// 设置使用的cpu核心数量
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	// CWorker 加密
+	// 密钥由crypto_key和crypto_iv配置，读取配置前不可用
 	CWorker = gopsu.GetNewCryptoWorker(gopsu.CryptoAES128CBC)
-	CWorker.SetKey("(NMNle+XW!ykVjf1", "Zq0V+,.2u|3sGAzH")
 	// MD5Worker md5计算
 	MD5Worker = gopsu.GetNewCryptoWorker(gopsu.CryptoMD5)
 }
@@ -0,0 +1,222 @@
+package wmv2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/sjson"
+	"github.com/xyzj/gopsu"
+	ginmiddleware "github.com/xyzj/gopsu/gin-middleware"
+)
+
+// web页面配置
+type webConfigure struct {
+	forshow string
+	// 挂载路径
+	mount string
+	// 磁盘目录，不为空时代替内嵌文件
+	dir string
+	// 是否为单页应用，找不到文件时返回index.html
+	spa bool
+	// 普通文件缓存时长
+	maxAge int
+	// 长期缓存的路径前缀，通常为带hash的文件
+	immutable []string
+	// 文件
+	fsys fs.FS
+	// etag缓存
+	etags sync.Map
+}
+
+func (conf *webConfigure) show() string {
+	conf.forshow, _ = sjson.Set("", "mount", conf.mount)
+	conf.forshow, _ = sjson.Set(conf.forshow, "dir", conf.dir)
+	conf.forshow, _ = sjson.Set(conf.forshow, "spa", conf.spa)
+	conf.forshow, _ = sjson.Set(conf.forshow, "max_age", conf.maxAge)
+	conf.forshow, _ = sjson.Set(conf.forshow, "immutable", conf.immutable)
+	return conf.forshow
+}
+
+// SetWebUI 设置web页面文件，需在NewHTTPEngine之前调用，也可以通过OptionHTTP.WebUI设置
+// fsys: 页面文件，通常为embed.FS
+// root: fsys中页面所在的子目录，如dist，为空时使用fsys根目录
+func (fw *WMFrameWorkV2) SetWebUI(fsys fs.FS, root string) error {
+	if root != "" && root != "." {
+		sub, err := fs.Sub(fsys, root)
+		if err != nil {
+			return err
+		}
+		fsys = sub
+	}
+	fw.webCtl.fsys = fsys
+	return nil
+}
+
+func (fw *WMFrameWorkV2) loadWebConfig() {
+	fw.webCtl.mount = "/" + strings.Trim(fw.wmConf.GetItemDefault("webui_path", "/ui", "web页面的挂载路径，为/时未匹配其他路由的请求都由web页面处理"), "/")
+	fw.webCtl.dir = fw.wmConf.GetItemDefault("webui_dir", "", "web页面所在目录，设置后代替程序内嵌的页面，留空使用内嵌页面")
+	fw.webCtl.spa, _ = strconv.ParseBool(fw.wmConf.GetItemDefault("webui_spa", "true", "是否为单页应用，找不到文件时返回index.html"))
+	fw.webCtl.maxAge = gopsu.String2Int(fw.wmConf.GetItemDefault("webui_maxage", "3600", "web页面文件的缓存时长（秒），index.html不缓存"), 10)
+	fw.webCtl.immutable = splitConfigList(fw.wmConf.GetItemDefault("webui_immutable", "assets/,static/js/,static/css/", "文件名带hash的路径前缀，缓存一年，用`,`分割多个"))
+	fw.wmConf.Save()
+	if fw.webCtl.dir != "" {
+		if !gopsu.IsExist(fw.webCtl.dir) {
+			fw.WriteError("WEB", "webui_dir not found: "+fw.webCtl.dir)
+		} else {
+			fw.webCtl.fsys = os.DirFS(fw.webCtl.dir)
+		}
+	}
+	fw.webCtl.show()
+}
+
+// webRoutes 添加web页面路由
+func (fw *WMFrameWorkV2) webRoutes(r *gin.Engine) {
+	fw.loadWebConfig()
+	fw.mountWebUI(r)
+}
+
+// mountWebUI 在挂载路径添加页面路由，与已有路由冲突时不启用
+func (fw *WMFrameWorkV2) mountWebUI(r *gin.Engine) {
+	if fw.webCtl.fsys == nil {
+		return
+	}
+	if fw.webCtl.mount == "/" {
+		// 根路径与其他路由冲突，包括/在内都由noRoute处理，服务注册的路由优先
+		return
+	}
+	for _, v := range r.Routes() {
+		if v.Path == fw.webCtl.mount || strings.HasPrefix(v.Path, fw.webCtl.mount+"/") {
+			fw.WriteError("WEB", "webui_path "+fw.webCtl.mount+" conflicts with route "+v.Method+" "+v.Path+", web ui is disabled")
+			fw.webCtl.fsys = nil
+			return
+		}
+	}
+	h := func(c *gin.Context) {
+		fw.serveWeb(c, c.Param("filepath"))
+	}
+	r.GET(fw.webCtl.mount, func(c *gin.Context) {
+		c.Redirect(http.StatusMovedPermanently, fw.webCtl.mount+"/")
+	})
+	r.GET(fw.webCtl.mount+"/*filepath", h)
+	r.HEAD(fw.webCtl.mount+"/*filepath", h)
+}
+
+// webNoRoute 挂载路径为/时，返回未匹配路由的GET请求对应的页面文件，返回是否已处理
+func (fw *WMFrameWorkV2) webNoRoute(c *gin.Context) bool {
+	if fw.webCtl.fsys == nil || fw.webCtl.mount != "/" {
+		return false
+	}
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return false
+	}
+	fw.serveWeb(c, c.Request.URL.Path)
+	return true
+}
+
+// etag 按文件内容计算etag，磁盘文件按大小和修改时间缓存
+func (fw *WMFrameWorkV2) etag(name string, info fs.FileInfo, b []byte) string {
+	key := name + "|" + strconv.FormatInt(info.Size(), 10) + "|" + strconv.FormatInt(info.ModTime().UnixNano(), 10)
+	if v, ok := fw.webCtl.etags.Load(key); ok {
+		return v.(string)
+	}
+	sum := sha256.Sum256(b)
+	tag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	fw.webCtl.etags.Store(key, tag)
+	return tag
+}
+
+// openWeb 读取文件，返回内容，文件信息和是否存在
+func (fw *WMFrameWorkV2) openWeb(name string) ([]byte, fs.FileInfo, bool) {
+	info, err := fs.Stat(fw.webCtl.fsys, name)
+	if err != nil || info.IsDir() {
+		return nil, nil, false
+	}
+	b, err := fs.ReadFile(fw.webCtl.fsys, name)
+	if err != nil {
+		return nil, nil, false
+	}
+	return b, info, true
+}
+
+// serveWeb 返回web页面文件，支持etag，range和预压缩的.br，.gz文件
+func (fw *WMFrameWorkV2) serveWeb(c *gin.Context, p string) {
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	if info, err := fs.Stat(fw.webCtl.fsys, name); err == nil && info.IsDir() {
+		name = path.Join(name, "index.html")
+	}
+	b, info, ok := fw.openWeb(name)
+	if !ok {
+		// 单页应用的前端路由，带扩展名的视为缺失的文件
+		if !fw.webCtl.spa || path.Ext(name) != "" {
+			ginmiddleware.Page404(c)
+			return
+		}
+		name = "index.html"
+		if b, info, ok = fw.openWeb(name); !ok {
+			ginmiddleware.Page404(c)
+			return
+		}
+	}
+	ct := mime.TypeByExtension(path.Ext(name))
+	if ct == "" {
+		ct = http.DetectContentType(b)
+	}
+	// 预压缩文件
+	tagName := name
+	ae := c.GetHeader("Accept-Encoding")
+	for _, v := range []struct{ ext, enc string }{{".br", "br"}, {".gz", "gzip"}} {
+		if !strings.Contains(ae, v.enc) {
+			continue
+		}
+		if zb, zinfo, ok := fw.openWeb(name + v.ext); ok {
+			b, info, tagName = zb, zinfo, name+v.ext
+			c.Header("Content-Encoding", v.enc)
+			break
+		}
+	}
+	c.Header("Vary", "Accept-Encoding")
+	c.Header("Content-Type", ct)
+	c.Header("ETag", fw.etag(tagName, info, b))
+	switch {
+	case path.Base(name) == "index.html":
+		c.Header("Cache-Control", "no-cache")
+	case fw.immutableWeb(name):
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	default:
+		c.Header("Cache-Control", "public, max-age="+strconv.Itoa(fw.webCtl.maxAge))
+	}
+	// 内嵌文件没有修改时间，仅使用etag
+	var mt time.Time
+	if fw.webCtl.dir != "" {
+		mt = info.ModTime()
+	}
+	http.ServeContent(c.Writer, c.Request, name, mt, bytes.NewReader(b))
+}
+
+func (fw *WMFrameWorkV2) immutableWeb(name string) bool {
+	for _, v := range fw.webCtl.immutable {
+		if strings.HasPrefix(name, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// ViewWebConfig 查看web页面配置，返回json字符串
+func (fw *WMFrameWorkV2) ViewWebConfig() string {
+	return fw.webCtl.forshow
+}
@@ -0,0 +1,109 @@
+package wmv2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xyzj/gopsu"
+)
+
+func newWebTestEngine(mount string) (*WMFrameWorkV2, *gin.Engine) {
+	gin.SetMode(gin.TestMode)
+	fw := &WMFrameWorkV2{
+		wmLog:      &gopsu.NilLogger{},
+		gatewayCtl: &gatewayConfigure{},
+		webCtl: &webConfigure{
+			mount:     mount,
+			spa:       true,
+			maxAge:    60,
+			immutable: []string{"assets/"},
+			fsys: fstest.MapFS{
+				"index.html":    {Data: []byte("<html>index</html>")},
+				"assets/app.js": {Data: []byte("console.log(1)")},
+				"favicon.ico":   {Data: []byte("ico")},
+			},
+		},
+	}
+	r := gin.New()
+	r.NoRoute(fw.noRoute)
+	return fw, r
+}
+
+func webGet(r *gin.Engine, p string, h map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", p, nil)
+	for k, v := range h {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestWebETag(t *testing.T) {
+	fw, r := newWebTestEngine("/ui")
+	fw.mountWebUI(r)
+	w := webGet(r, "/ui/assets/app.js", nil)
+	tag := w.Header().Get("ETag")
+	if w.Code != 200 || tag == "" || w.Header().Get("Cache-Control") != "public, max-age=31536000, immutable" {
+		t.Fatalf("unexpected response %d %v", w.Code, w.Header())
+	}
+	if w := webGet(r, "/ui/assets/app.js", map[string]string{"If-None-Match": tag}); w.Code != http.StatusNotModified {
+		t.Fatalf("etag: got %d", w.Code)
+	}
+	if w := webGet(r, "/ui/", nil); w.Header().Get("Cache-Control") != "no-cache" || w.Body.String() != "<html>index</html>" {
+		t.Fatalf("index: %v %q", w.Header(), w.Body.String())
+	}
+}
+
+func TestWebSPAFallback(t *testing.T) {
+	fw, r := newWebTestEngine("/ui")
+	fw.mountWebUI(r)
+	if w := webGet(r, "/ui/user/1", nil); w.Code != 200 || w.Body.String() != "<html>index</html>" {
+		t.Fatalf("spa route: %d %q", w.Code, w.Body.String())
+	}
+	// 带扩展名的缺失文件返回404
+	if w := webGet(r, "/ui/missing.js", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("missing file: got %d", w.Code)
+	}
+	fw.webCtl.spa = false
+	if w := webGet(r, "/ui/user/1", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("spa disabled: got %d", w.Code)
+	}
+}
+
+func TestWebRootMount(t *testing.T) {
+	fw, r := newWebTestEngine("/")
+	fw.mountWebUI(r)
+	// 服务可以注册自己的/，优先于页面
+	r.GET("/", func(c *gin.Context) { c.String(200, "service") })
+	r.GET("/api", func(c *gin.Context) { c.String(200, "api") })
+	if w := webGet(r, "/", nil); w.Body.String() != "service" {
+		t.Fatalf("root: %q", w.Body.String())
+	}
+	if w := webGet(r, "/api", nil); w.Body.String() != "api" {
+		t.Fatalf("api: %q", w.Body.String())
+	}
+	if w := webGet(r, "/favicon.ico", nil); w.Code != 200 || w.Body.String() != "ico" {
+		t.Fatalf("file: %d %q", w.Code, w.Body.String())
+	}
+	if w := webGet(r, "/index.html", nil); w.Code != 200 {
+		t.Fatalf("index: %d", w.Code)
+	}
+}
+
+func TestWebMountConflict(t *testing.T) {
+	fw, r := newWebTestEngine("/ui")
+	r.GET("/ui/x", func(c *gin.Context) {})
+	defer func() {
+		if err := recover(); err != nil {
+			t.Fatalf("should not panic: %v", err)
+		}
+	}()
+	fw.mountWebUI(r)
+	if fw.webCtl.fsys != nil {
+		t.Fatal("web ui should be disabled")
+	}
+}